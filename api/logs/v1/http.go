@@ -1,9 +1,7 @@
 package http
 
 import (
-	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"path"
 	"time"
@@ -23,10 +21,14 @@ const (
 
 type handlerConfiguration struct {
 	logger           log.Logger
-	registry         *prometheus.Registry
+	registry         prometheus.Registerer
 	instrument       handlerInstrumenter
 	readMiddlewares  []func(http.Handler) http.Handler
 	writeMiddlewares []func(http.Handler) http.Handler
+	proxyOptions     []proxy.Option
+
+	readProxyOptions  []proxy.Option
+	writeProxyOptions []proxy.Option
 }
 
 // HandlerOption modifies the handler's configuration
@@ -40,7 +42,7 @@ func Logger(logger log.Logger) HandlerOption {
 }
 
 // Registry adds a custom Prometheus registry for the handler to use.
-func Registry(r *prometheus.Registry) HandlerOption {
+func Registry(r prometheus.Registerer) HandlerOption {
 	return func(h *handlerConfiguration) {
 		h.registry = r
 	}
@@ -67,6 +69,29 @@ func WriteMiddleware(m func(http.Handler) http.Handler) HandlerOption {
 	}
 }
 
+// ProxyOptions adds options for all proxies forwarding requests to the upstreams.
+func ProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.proxyOptions = append(h.proxyOptions, opts...)
+	}
+}
+
+// ReadProxyOptions adds options for the proxies forwarding read requests to the upstreams.
+// They are applied after the options for all proxies.
+func ReadProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.readProxyOptions = append(h.readProxyOptions, opts...)
+	}
+}
+
+// WriteProxyOptions adds options for the proxies forwarding write requests to the upstreams.
+// They are applied after the options for all proxies.
+func WriteProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.writeProxyOptions = append(h.writeProxyOptions, opts...)
+	}
+}
+
 type handlerInstrumenter interface {
 	NewHandler(labels prometheus.Labels, handler http.Handler) http.HandlerFunc
 }
@@ -100,15 +125,7 @@ func NewHandler(read, tail, write *url.URL, opts ...HandlerOption) http.Handler
 				proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "logsv1-read"}),
 			)
 
-			proxyRead = &httputil.ReverseProxy{
-				Director: middlewares,
-				ErrorLog: proxy.Logger(c.logger),
-				Transport: &http.Transport{
-					DialContext: (&net.Dialer{
-						Timeout: ReadTimeout,
-					}).DialContext,
-				},
-			}
+			proxyRead = c.newProxy(middlewares, ReadTimeout, c.readProxyOptions...)
 		}
 		r.Group(func(r chi.Router) {
 			r.Use(c.readMiddlewares...)
@@ -133,15 +150,7 @@ func NewHandler(read, tail, write *url.URL, opts ...HandlerOption) http.Handler
 				proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "logsv1-tail"}),
 			)
 
-			tailRead = &httputil.ReverseProxy{
-				Director: middlewares,
-				ErrorLog: proxy.Logger(c.logger),
-				Transport: &http.Transport{
-					DialContext: (&net.Dialer{
-						Timeout: ReadTimeout,
-					}).DialContext,
-				},
-			}
+			tailRead = c.newProxy(middlewares, ReadTimeout, c.readProxyOptions...)
 		}
 		r.Group(func(r chi.Router) {
 			r.Use(c.readMiddlewares...)
@@ -162,15 +171,7 @@ func NewHandler(read, tail, write *url.URL, opts ...HandlerOption) http.Handler
 				proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "logsv1-write"}),
 			)
 
-			proxyWrite = &httputil.ReverseProxy{
-				Director: middlewares,
-				ErrorLog: proxy.Logger(c.logger),
-				Transport: &http.Transport{
-					DialContext: (&net.Dialer{
-						Timeout: WriteTimeout,
-					}).DialContext,
-				},
-			}
+			proxyWrite = c.newProxy(middlewares, WriteTimeout, c.writeProxyOptions...)
 		}
 		r.Group(func(r chi.Router) {
 			r.Use(c.writeMiddlewares...)
@@ -183,3 +184,16 @@ func NewHandler(read, tail, write *url.URL, opts ...HandlerOption) http.Handler
 
 	return r
 }
+
+// newProxy creates a proxy with the given dial timeout that is further configured by the user-provided proxy options
+// and the given route-specific options.
+func (h *handlerConfiguration) newProxy(director func(r *http.Request), dialTimeout time.Duration, routeOpts ...proxy.Option) http.Handler {
+	opts := append([]proxy.Option{
+		proxy.WithLogger(h.logger),
+		proxy.WithRegistry(h.registry),
+		proxy.WithDialTimeout(dialTimeout),
+	}, h.proxyOptions...)
+	opts = append(opts, routeOpts...)
+
+	return proxy.New(director, opts...)
+}
@@ -0,0 +1,85 @@
+// Package metricstest provides tests shared by the handlers of the metrics APIs.
+package metricstest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// RulesAndAlerts tests that the handler created for a read upstream forwards requests
+// to the Prometheus rules and alerts endpoints to it and passes its responses on.
+func RulesAndAlerts(t *testing.T, newHandler func(read *url.URL) http.Handler) {
+	t.Helper()
+
+	const body = `{"status":"success","data":{"groups":[]}}`
+
+	var got *http.Request
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHandler(u)
+
+	for _, tc := range []struct {
+		name string
+		path string
+	}{
+		{
+			name: "rules",
+			path: "/api/v1/rules",
+		},
+		{
+			name: "rules with type",
+			path: "/api/v1/rules?type=alert",
+		},
+		{
+			name: "alerts",
+			path: "/api/v1/alerts",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got = nil
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status code %d; got %d", http.StatusOK, rec.Code)
+			}
+
+			if got == nil {
+				t.Fatal("expected the request to be forwarded to the upstream")
+			}
+
+			if uri := got.URL.RequestURI(); uri != tc.path {
+				t.Errorf("expected upstream request URI %q; got %q", tc.path, uri)
+			}
+
+			b, err := ioutil.ReadAll(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != body {
+				t.Errorf("expected body %q; got %q", body, string(b))
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected content type %q; got %q", "application/json", ct)
+			}
+		})
+	}
+}
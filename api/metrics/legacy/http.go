@@ -1,9 +1,7 @@
 package legacy
 
 import (
-	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"time"
 
@@ -20,9 +18,10 @@ const (
 
 type handlerConfiguration struct {
 	logger          log.Logger
-	registry        *prometheus.Registry
+	registry        prometheus.Registerer
 	instrument      handlerInstrumenter
 	readMiddlewares []func(http.Handler) http.Handler
+	proxyOptions    []proxy.Option
 }
 
 type HandlerOption func(h *handlerConfiguration)
@@ -33,7 +32,7 @@ func Logger(logger log.Logger) HandlerOption {
 	}
 }
 
-func Registry(r *prometheus.Registry) HandlerOption {
+func Registry(r prometheus.Registerer) HandlerOption {
 	return func(h *handlerConfiguration) {
 		h.registry = r
 	}
@@ -52,6 +51,13 @@ func ReadMiddleware(m func(http.Handler) http.Handler) HandlerOption {
 	}
 }
 
+// ProxyOptions adds options for all proxies forwarding requests to the upstreams.
+func ProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.proxyOptions = append(h.proxyOptions, opts...)
+	}
+}
+
 type handlerInstrumenter interface {
 	NewHandler(labels prometheus.Labels, handler http.Handler) http.HandlerFunc
 }
@@ -83,15 +89,7 @@ func NewHandler(url *url.URL, opts ...HandlerOption) http.Handler {
 			proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "metricslegacy-read"}),
 		)
 
-		legacyProxy = &httputil.ReverseProxy{
-			Director: middlewares,
-			ErrorLog: proxy.Logger(c.logger),
-			Transport: &http.Transport{
-				DialContext: (&net.Dialer{
-					Timeout: readTimeout,
-				}).DialContext,
-			},
-		}
+		legacyProxy = c.newProxy(middlewares, readTimeout)
 	}
 
 	r.Use(c.readMiddlewares...)
@@ -103,6 +101,14 @@ func NewHandler(url *url.URL, opts ...HandlerOption) http.Handler {
 		prometheus.Labels{"group": "metricslegacy", "handler": "query_range"},
 		legacyProxy,
 	))
+	r.Handle("/api/v1/rules", c.instrument.NewHandler(
+		prometheus.Labels{"group": "metricslegacy", "handler": "rules"},
+		legacyProxy,
+	))
+	r.Handle("/api/v1/alerts", c.instrument.NewHandler(
+		prometheus.Labels{"group": "metricslegacy", "handler": "alerts"},
+		legacyProxy,
+	))
 
 	r.HandleFunc("/graph", func(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = "/api/metrics/v1/graph"
@@ -111,3 +117,14 @@ func NewHandler(url *url.URL, opts ...HandlerOption) http.Handler {
 
 	return r
 }
+
+// newProxy creates a proxy with the given dial timeout that is further configured by the user-provided proxy options.
+func (h *handlerConfiguration) newProxy(director func(r *http.Request), dialTimeout time.Duration) http.Handler {
+	opts := append([]proxy.Option{
+		proxy.WithLogger(h.logger),
+		proxy.WithRegistry(h.registry),
+		proxy.WithDialTimeout(dialTimeout),
+	}, h.proxyOptions...)
+
+	return proxy.New(director, opts...)
+}
@@ -0,0 +1,15 @@
+package legacy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/observatorium/observatorium/api/metrics/internal/metricstest"
+)
+
+func TestNewHandlerRulesAndAlerts(t *testing.T) {
+	metricstest.RulesAndAlerts(t, func(read *url.URL) http.Handler {
+		return NewHandler(read)
+	})
+}
@@ -1,14 +1,13 @@
 package v1
 
 import (
-	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/observatorium/observatorium/proxy"
@@ -21,10 +20,17 @@ const (
 
 type handlerConfiguration struct {
 	logger           log.Logger
-	registry         *prometheus.Registry
+	registry         prometheus.Registerer
 	instrument       handlerInstrumenter
 	readMiddlewares  []func(http.Handler) http.Handler
 	writeMiddlewares []func(http.Handler) http.Handler
+	proxyOptions     []proxy.Option
+
+	readProxyOptions  []proxy.Option
+	writeProxyOptions []proxy.Option
+
+	queryFallback            *url.URL
+	queryFallbackStatusCodes []int
 }
 
 // HandlerOption modifies the handler's configuration
@@ -38,7 +44,7 @@ func Logger(logger log.Logger) HandlerOption {
 }
 
 // Registry adds a custom Prometheus registry for the handler to use.
-func Registry(r *prometheus.Registry) HandlerOption {
+func Registry(r prometheus.Registerer) HandlerOption {
 	return func(h *handlerConfiguration) {
 		h.registry = r
 	}
@@ -65,6 +71,39 @@ func WriteMiddleware(m func(http.Handler) http.Handler) HandlerOption {
 	}
 }
 
+// ProxyOptions adds options for all proxies forwarding requests to the upstreams.
+func ProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.proxyOptions = append(h.proxyOptions, opts...)
+	}
+}
+
+// ReadProxyOptions adds options for the proxies forwarding read requests to the upstreams.
+// They are applied after the options for all proxies.
+func ReadProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.readProxyOptions = append(h.readProxyOptions, opts...)
+	}
+}
+
+// WriteProxyOptions adds options for the proxies forwarding write requests to the upstreams.
+// They are applied after the options for all proxies.
+func WriteProxyOptions(opts ...proxy.Option) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.writeProxyOptions = append(h.writeProxyOptions, opts...)
+	}
+}
+
+// QueryFallback sends queries that the read endpoint answers with one of the given status codes,
+// e.g. 422 for queries too complex for it, to the given endpoint once and returns its response.
+// Only instant and range queries fall back, other read requests are always answered by the read endpoint.
+func QueryFallback(endpoint *url.URL, statusCodes ...int) HandlerOption {
+	return func(h *handlerConfiguration) {
+		h.queryFallback = endpoint
+		h.queryFallbackStatusCodes = statusCodes
+	}
+}
+
 type handlerInstrumenter interface {
 	NewHandler(labels prometheus.Labels, handler http.Handler) http.HandlerFunc
 }
@@ -89,6 +128,21 @@ func NewHandler(read, write *url.URL, opts ...HandlerOption) http.Handler {
 
 	r := chi.NewRouter()
 
+	// Deployments serving reads and writes on one endpoint get a single connection pool for both.
+	// It is configured by the options for all proxies only, so options of a single route configuring connections,
+	// e.g. proxy.WithDSCP, do not apply to it. Its connections use the shorter dial timeout of writes.
+	if read != nil && write != nil && read.String() == write.String() {
+		t := proxy.NewTransport(c.newProxyOptions(writeTimeout)...)
+		c.readProxyOptions = append(c.readProxyOptions, proxy.WithTransport(t))
+		c.writeProxyOptions = append(c.writeProxyOptions, proxy.WithTransport(t))
+
+		level.Info(c.logger).Log(
+			"msg", "read and write endpoints are identical, sharing one transport configured for all routes",
+			"host", read.Host,
+			"dial_timeout", writeTimeout,
+		)
+	}
+
 	if read != nil {
 		var proxyRead http.Handler
 		{
@@ -98,24 +152,39 @@ func NewHandler(read, write *url.URL, opts ...HandlerOption) http.Handler {
 				proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "metricsv1-read"}),
 			)
 
-			proxyRead = &httputil.ReverseProxy{
-				Director: middlewares,
-				ErrorLog: proxy.Logger(c.logger),
-				Transport: &http.Transport{
-					DialContext: (&net.Dialer{
-						Timeout: readTimeout,
-					}).DialContext,
-				},
-			}
+			proxyRead = c.newProxy(middlewares, readTimeout, c.readProxyOptions...)
+		}
+
+		proxyQuery := proxyRead
+		if c.queryFallback != nil {
+			middlewares := proxy.Middlewares(
+				proxy.MiddlewareSetUpstream(c.queryFallback),
+				proxy.MiddlewareLogger(c.logger),
+				proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "metricsv1-query-fallback"}),
+			)
+
+			proxyQuery = proxy.NewFallback(proxyRead,
+				c.newProxy(middlewares, readTimeout, c.readProxyOptions...),
+				c.registry,
+				c.queryFallbackStatusCodes...,
+			)
 		}
 		r.Group(func(r chi.Router) {
 			r.Use(c.readMiddlewares...)
 			r.Handle("/api/v1/query", c.instrument.NewHandler(
 				prometheus.Labels{"group": "metricsv1", "handler": "query"},
-				proxyRead,
+				proxyQuery,
 			))
 			r.Handle("/api/v1/query_range", c.instrument.NewHandler(
 				prometheus.Labels{"group": "metricsv1", "handler": "query_range"},
+				proxyQuery,
+			))
+			r.Handle("/api/v1/rules", c.instrument.NewHandler(
+				prometheus.Labels{"group": "metricsv1", "handler": "rules"},
+				proxyRead,
+			))
+			r.Handle("/api/v1/alerts", c.instrument.NewHandler(
+				prometheus.Labels{"group": "metricsv1", "handler": "alerts"},
 				proxyRead,
 			))
 
@@ -127,9 +196,7 @@ func NewHandler(read, write *url.URL, opts ...HandlerOption) http.Handler {
 					proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "metricsv1-ui"}),
 				)
 
-				uiProxy = &httputil.ReverseProxy{
-					Director: middlewares,
-				}
+				uiProxy = c.newProxy(middlewares, readTimeout, c.readProxyOptions...)
 			}
 			r.Mount("/", c.instrument.NewHandler(
 				prometheus.Labels{"group": "metricsv1", "handler": "ui"},
@@ -147,15 +214,7 @@ func NewHandler(read, write *url.URL, opts ...HandlerOption) http.Handler {
 				proxy.MiddlewareMetrics(c.registry, prometheus.Labels{"proxy": "metricsv1-write"}),
 			)
 
-			proxyWrite = &httputil.ReverseProxy{
-				Director: middlewares,
-				ErrorLog: proxy.Logger(c.logger),
-				Transport: &http.Transport{
-					DialContext: (&net.Dialer{
-						Timeout: writeTimeout,
-					}).DialContext,
-				},
-			}
+			proxyWrite = c.newProxy(middlewares, writeTimeout, c.writeProxyOptions...)
 		}
 		r.Group(func(r chi.Router) {
 			r.Use(c.writeMiddlewares...)
@@ -168,3 +227,21 @@ func NewHandler(read, write *url.URL, opts ...HandlerOption) http.Handler {
 
 	return r
 }
+
+// newProxy creates a proxy with the given dial timeout that is further configured by the user-provided proxy options
+// and the given route-specific options.
+func (h *handlerConfiguration) newProxy(director func(r *http.Request), dialTimeout time.Duration, routeOpts ...proxy.Option) http.Handler {
+	return proxy.New(director, h.newProxyOptions(dialTimeout, routeOpts...)...)
+}
+
+// newProxyOptions returns the options of a proxy with the given dial timeout,
+// followed by the user-provided proxy options and the given route-specific options.
+func (h *handlerConfiguration) newProxyOptions(dialTimeout time.Duration, routeOpts ...proxy.Option) []proxy.Option {
+	opts := append([]proxy.Option{
+		proxy.WithLogger(h.logger),
+		proxy.WithRegistry(h.registry),
+		proxy.WithDialTimeout(dialTimeout),
+	}, h.proxyOptions...)
+
+	return append(opts, routeOpts...)
+}
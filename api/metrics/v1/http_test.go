@@ -0,0 +1,86 @@
+package v1
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/observatorium/observatorium/api/metrics/internal/metricstest"
+)
+
+func TestNewHandlerRulesAndAlerts(t *testing.T) {
+	metricstest.RulesAndAlerts(t, func(read *url.URL) http.Handler {
+		return NewHandler(read, nil)
+	})
+}
+
+func TestNewHandlerSharedTransport(t *testing.T) {
+	var conns int64
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	read, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same upstream under a different URL is not recognized as identical.
+	other := *read
+	other.Path = "/"
+
+	for _, tc := range []struct {
+		name  string
+		write *url.URL
+		conns int64
+	}{
+		{
+			name:  "identical endpoints",
+			write: read,
+			conns: 1,
+		},
+		{
+			name:  "different endpoints",
+			write: &other,
+			conns: 2,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt64(&conns, 0)
+
+			h := NewHandler(read, tc.write)
+
+			for _, r := range []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil),
+				httptest.NewRequest(http.MethodPost, "/api/v1/receive", strings.NewReader("write")),
+				httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil),
+			} {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected status code %d; got %d", http.StatusOK, rec.Code)
+				}
+			}
+
+			if got := atomic.LoadInt64(&conns); got != tc.conns {
+				t.Errorf("expected %d connections to the upstream; got %d", tc.conns, got)
+			}
+		})
+	}
+}
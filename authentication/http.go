@@ -2,6 +2,7 @@ package authentication
 
 import (
 	"context"
+	"crypto/x509"
 	"net/http"
 
 	"github.com/go-chi/chi"
@@ -17,6 +18,10 @@ func (c contextKey) String() string {
 }
 
 const (
+	// certificateKey is the key that holds the verified client certificate in a request context.
+	certificateKey contextKey = "certificate"
+	// claimsKey is the key that holds the claims of a verified token in a request context.
+	claimsKey contextKey = "claims"
 	// groupsKey is the key that holds the groups in a request context.
 	groupsKey contextKey = "groups"
 	// subjectKey is the key that holds the subject in a request context.
@@ -70,6 +75,22 @@ func GetGroups(ctx context.Context) ([]string, bool) {
 	return groups, ok
 }
 
+// GetClaims extracts the claims of the token the request was authenticated with from provided context.
+func GetClaims(ctx context.Context) (map[string]interface{}, bool) {
+	value := ctx.Value(claimsKey)
+	claims, ok := value.(map[string]interface{})
+
+	return claims, ok
+}
+
+// GetClientCertificate extracts the client certificate the request was authenticated with via mTLS from provided context.
+func GetClientCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	value := ctx.Value(certificateKey)
+	cert, ok := value.(*x509.Certificate)
+
+	return cert, ok
+}
+
 // WithTenantMiddlewares creates a single Middleware for all
 // provided tenant-middleware sets.
 func WithTenantMiddlewares(middlewareSets ...map[string]Middleware) Middleware {
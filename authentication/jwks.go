@@ -0,0 +1,194 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// DefaultJWKSRefreshInterval is the default interval after which cached JWKS keys are refreshed.
+	DefaultJWKSRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval limits how often the keys are refreshed, e.g. triggered by tokens with unknown key IDs
+	// or retried after a failed refresh.
+	jwksMinRefreshInterval = 10 * time.Second
+	// jwksFetchTimeout bounds a single request to the JWKS endpoint.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// jwksKeySet is an oidc.KeySet that caches the keys of a JWKS endpoint.
+// The keys are refreshed once they are older than the refresh interval
+// and whenever a token is signed with an unknown key, e.g. after the issuer rotated its keys.
+// Refreshes happen in the background, one at a time; tokens signed with a cached key are verified without waiting for them.
+type jwksKeySet struct {
+	logger          log.Logger
+	client          *http.Client
+	url             string
+	refreshInterval time.Duration
+
+	mu   sync.Mutex
+	keys []jose.JSONWebKey
+	// fetched is the time the keys were last fetched successfully, refreshed the time a refresh was last started.
+	fetched   time.Time
+	refreshed time.Time
+	// refreshing is closed once the refresh in progress, if any, finished.
+	refreshing chan struct{}
+	// err is the error of the last refresh.
+	err error
+}
+
+func newJWKSKeySet(logger log.Logger, client *http.Client, url string, refreshInterval time.Duration) *jwksKeySet {
+	return &jwksKeySet{
+		logger:          logger,
+		client:          client,
+		url:             url,
+		refreshInterval: refreshInterval,
+	}
+}
+
+// VerifySignature implements the oidc.KeySet interface.
+func (s *jwksKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %w", err)
+	}
+
+	// Tokens signed with multiple signatures are not supported.
+	var keyID string
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+
+	keys, err := s.keysFor(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		if payload, err := jws.Verify(&keys[i]); err == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// keysFor returns the cached keys matching the key ID. The cache is refreshed if it is too old or no key matches,
+// at most once per jwksMinRefreshInterval. If no key matches, keysFor waits for the refresh to finish.
+func (s *jwksKeySet) keysFor(ctx context.Context, keyID string) ([]jose.JSONWebKey, error) {
+	s.mu.Lock()
+
+	now := time.Now()
+	keys := matchingKeys(s.keys, keyID)
+
+	if (len(keys) == 0 || now.Sub(s.fetched) > s.refreshInterval) &&
+		s.refreshing == nil && now.Sub(s.refreshed) >= jwksMinRefreshInterval {
+		if len(keys) == 0 && len(s.keys) > 0 {
+			level.Debug(s.logger).Log("msg", "refreshing JWKS keys for unknown key ID", "kid", keyID)
+		}
+
+		s.refreshed = now
+		s.refreshing = make(chan struct{})
+
+		go s.refresh(s.refreshing)
+	}
+
+	refreshing := s.refreshing
+	s.mu.Unlock()
+
+	if len(keys) == 0 && refreshing != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-refreshing:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.keys) == 0 && s.err != nil {
+		return nil, s.err
+	}
+
+	return matchingKeys(s.keys, keyID), nil
+}
+
+// refresh fetches the keys from the JWKS endpoint and closes done once it finished.
+// It is detached from the requests triggering it, so that canceled requests do not abort it.
+func (s *jwksKeySet) refresh(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(done)
+
+	s.refreshing = nil
+	s.err = err
+
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "failed to refresh JWKS keys", "url", s.url, "err", err)
+		return
+	}
+
+	s.keys = keys
+	s.fetched = time.Now()
+}
+
+func (s *jwksKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create JWKS request: %w", err)
+	}
+
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("get JWKS keys: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read JWKS response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get JWKS keys: %s", res.Status)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("decode JWKS keys: %w", err)
+	}
+
+	return keySet.Keys, nil
+}
+
+func matchingKeys(keys []jose.JSONWebKey, keyID string) []jose.JSONWebKey {
+	if keyID == "" {
+		return keys
+	}
+
+	var matching []jose.JSONWebKey
+
+	for _, k := range keys {
+		if k.KeyID == keyID {
+			matching = append(matching, k)
+		}
+	}
+
+	return matching
+}
@@ -0,0 +1,237 @@
+package authentication
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// jwksServer serves the public keys of its signing keys and counts the requests to it.
+type jwksServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     map[string]*ecdsa.PrivateKey
+	served   []string
+	failing  bool
+	blocking chan struct{}
+	requests int64
+}
+
+func newJWKSServer(t *testing.T, keyIDs ...string) *jwksServer {
+	s := &jwksServer{keys: map[string]*ecdsa.PrivateKey{}}
+
+	for _, id := range keyIDs {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.keys[id] = key
+	}
+
+	s.served = keyIDs
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+
+		s.mu.Lock()
+		failing, blocking := s.failing, s.blocking
+
+		var keySet jose.JSONWebKeySet
+		for _, id := range s.served {
+			keySet.Keys = append(keySet.Keys, jose.JSONWebKey{Key: &s.keys[id].PublicKey, KeyID: id, Algorithm: string(jose.ES256)})
+		}
+		s.mu.Unlock()
+
+		if blocking != nil {
+			<-blocking
+		}
+
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(keySet)
+	}))
+
+	return s
+}
+
+func (s *jwksServer) sign(t *testing.T, keyID string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: s.keys[keyID]},
+		(&jose.SignerOptions{}).WithHeader("kid", keyID),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign([]byte(`{"sub":"user"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func (s *jwksServer) update(fn func(s *jwksServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s)
+}
+
+// waitForRefresh waits until no refresh of the key set is in progress.
+func waitForRefresh(ks *jwksKeySet) {
+	ks.mu.Lock()
+	refreshing := ks.refreshing
+	ks.mu.Unlock()
+
+	if refreshing != nil {
+		<-refreshing
+	}
+}
+
+// backdate moves the times the keys were fetched and refreshed by d into the past.
+func backdate(ks *jwksKeySet, d time.Duration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.fetched = ks.fetched.Add(-d)
+	ks.refreshed = ks.refreshed.Add(-d)
+}
+
+func TestJWKSKeySetRotation(t *testing.T) {
+	s := newJWKSServer(t, "a", "b")
+	defer s.Close()
+
+	s.update(func(s *jwksServer) { s.served = []string{"a"} })
+
+	ks := newJWKSKeySet(log.NewNopLogger(), s.Client(), s.URL, time.Hour)
+
+	if _, err := ks.VerifySignature(context.Background(), s.sign(t, "a")); err != nil {
+		t.Fatalf("expected token signed with known key to be verified; got %v", err)
+	}
+
+	// Tokens signed with unknown keys trigger a refresh at most once per jwksMinRefreshInterval.
+	s.update(func(s *jwksServer) { s.served = []string{"a", "b"} })
+
+	if _, err := ks.VerifySignature(context.Background(), s.sign(t, "b")); err == nil {
+		t.Fatal("expected token signed with unknown key not to be verified right after a refresh")
+	}
+
+	backdate(ks, jwksMinRefreshInterval)
+
+	if _, err := ks.VerifySignature(context.Background(), s.sign(t, "b")); err != nil {
+		t.Fatalf("expected token signed with rotated key to be verified; got %v", err)
+	}
+
+	if got := atomic.LoadInt64(&s.requests); got != 2 {
+		t.Errorf("expected 2 requests to the JWKS endpoint; got %d", got)
+	}
+}
+
+func TestJWKSKeySetFailedRefresh(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	defer s.Close()
+
+	ks := newJWKSKeySet(log.NewNopLogger(), s.Client(), s.URL, time.Minute)
+
+	if _, err := ks.VerifySignature(context.Background(), s.sign(t, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired keys keep being used while the endpoint fails, and refreshes back off.
+	s.update(func(s *jwksServer) { s.failing = true })
+	backdate(ks, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if _, err := ks.VerifySignature(context.Background(), s.sign(t, "a")); err != nil {
+			t.Fatalf("expected token to be verified with expired keys; got %v", err)
+		}
+
+		waitForRefresh(ks)
+	}
+
+	if got := atomic.LoadInt64(&s.requests); got != 2 {
+		t.Errorf("expected 2 requests to the JWKS endpoint; got %d", got)
+	}
+
+	// Without any keys, the error of the refresh is returned until the next refresh is due.
+	empty := newJWKSKeySet(log.NewNopLogger(), s.Client(), s.URL, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if _, err := empty.VerifySignature(context.Background(), s.sign(t, "a")); err == nil {
+			t.Fatal("expected verification to fail without keys")
+		}
+	}
+
+	if got := atomic.LoadInt64(&s.requests); got != 3 {
+		t.Errorf("expected 3 requests to the JWKS endpoint; got %d", got)
+	}
+}
+
+func TestJWKSKeySetSlowRefresh(t *testing.T) {
+	s := newJWKSServer(t, "a", "b")
+	defer s.Close()
+
+	s.update(func(s *jwksServer) { s.served = []string{"a"} })
+
+	ks := newJWKSKeySet(log.NewNopLogger(), s.Client(), s.URL, time.Minute)
+
+	if _, err := ks.VerifySignature(context.Background(), s.sign(t, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	s.update(func(s *jwksServer) {
+		s.served = []string{"a", "b"}
+		s.blocking = release
+	})
+	backdate(ks, time.Hour)
+
+	// Tokens signed with cached keys are verified while the refresh is in progress.
+	for i := 0; i < 3; i++ {
+		if _, err := ks.VerifySignature(context.Background(), s.sign(t, "a")); err != nil {
+			t.Fatalf("expected token to be verified during a refresh; got %v", err)
+		}
+	}
+
+	// Canceled requests waiting for the refresh do not abort it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := ks.VerifySignature(ctx, s.sign(t, "b")); err != context.Canceled {
+		t.Fatalf("expected canceled verification to fail with %v; got %v", context.Canceled, err)
+	}
+
+	close(release)
+	waitForRefresh(ks)
+
+	if _, err := ks.VerifySignature(context.Background(), s.sign(t, "b")); err != nil {
+		t.Fatalf("expected token signed with refreshed key to be verified; got %v", err)
+	}
+
+	if got := atomic.LoadInt64(&s.requests); got != 2 {
+		t.Errorf("expected 2 requests to the JWKS endpoint; got %d", got)
+	}
+}
@@ -61,6 +61,7 @@ func NewMTLS(configs []MTLSConfig) map[string]Middleware {
 					return
 				}
 				ctx := context.WithValue(r.Context(), subjectKey, sub)
+				ctx = context.WithValue(ctx, certificateKey, r.TLS.PeerCertificates[0])
 
 				// Add organizational units as groups.
 				ctx = context.WithValue(ctx, groupsKey, r.TLS.PeerCertificates[0].Subject.OrganizationalUnit)
@@ -38,6 +38,9 @@ type OIDCConfig struct {
 	GroupClaim    string
 	RedirectURL   string
 	UsernameClaim string
+	// JWKSRefreshInterval is the interval after which the cached keys of the issuer are refreshed.
+	// Defaults to DefaultJWKSRefreshInterval.
+	JWKSRefreshInterval time.Duration
 }
 
 // Middleware is a convenience type for functions that wrap http.Handlers.
@@ -144,7 +147,20 @@ func NewProvider(ctx context.Context, logger log.Logger, cookieName, redirectURL
 		Scopes:       []string{"openid", "profile", "email", "groups"},
 	}
 
-	verifier := provider.Verifier(&oidc.Config{ClientID: config.ClientID})
+	var discovery struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, fmt.Errorf("read provider discovery document: %w", err)
+	}
+
+	refreshInterval := config.JWKSRefreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = DefaultJWKSRefreshInterval
+	}
+
+	keySet := newJWKSKeySet(logger, client, discovery.JWKSURL, refreshInterval)
+	verifier := oidc.NewVerifier(config.IssuerURL, keySet, &oidc.Config{ClientID: config.ClientID})
 
 	return &OIDCProvider{
 		logger:       logger,
@@ -209,15 +225,16 @@ func (p *OIDCProvider) Middleware() Middleware {
 				return
 			}
 
+			claims := map[string]interface{}{}
+			if err := idToken.Claims(&claims); err != nil {
+				const msg = "failed to read claims"
+				level.Warn(p.logger).Log("msg", msg, "err", err)
+				http.Error(w, msg, http.StatusInternalServerError)
+				return
+			}
+
 			sub := idToken.Subject
 			if p.config.UsernameClaim != "" {
-				claims := map[string]interface{}{}
-				if err := idToken.Claims(&claims); err != nil {
-					const msg = "failed to read claims"
-					level.Warn(p.logger).Log("msg", msg, "err", err)
-					http.Error(w, msg, http.StatusInternalServerError)
-					return
-				}
 				rawUsername, ok := claims[p.config.UsernameClaim]
 				if !ok {
 					const msg = "username cannot be empty"
@@ -235,16 +252,10 @@ func (p *OIDCProvider) Middleware() Middleware {
 				sub = username
 			}
 			ctx := context.WithValue(r.Context(), subjectKey, sub)
+			ctx = context.WithValue(ctx, claimsKey, claims)
 
 			if p.config.GroupClaim != "" {
 				var groups []string
-				claims := map[string]interface{}{}
-				if err := idToken.Claims(&claims); err != nil {
-					const msg = "failed to read claims"
-					level.Warn(p.logger).Log("msg", msg, "err", err)
-					http.Error(w, msg, http.StatusInternalServerError)
-					return
-				}
 				rawGroup, ok := claims[p.config.GroupClaim]
 				if !ok {
 					const msg = "group cannot be empty"
@@ -0,0 +1,117 @@
+package authentication
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-oidc"
+	"github.com/go-kit/kit/log"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const testIssuer = "https://issuer.example.com"
+
+// staticKeySet verifies tokens against a single public key.
+type staticKeySet struct {
+	key *ecdsa.PublicKey
+}
+
+func (s staticKeySet) VerifySignature(_ context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, err
+	}
+
+	return jws.Verify(s.key)
+}
+
+func signClaims(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestOIDCProviderMiddlewareClaims(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &OIDCProvider{
+		logger: log.NewNopLogger(),
+		client: http.DefaultClient,
+		config: OIDCConfig{ClientID: "observatorium", GroupClaim: "groups"},
+		verifier: oidc.NewVerifier(testIssuer, staticKeySet{key: &key.PublicKey}, &oidc.Config{
+			ClientID:             "observatorium",
+			SupportedSigningAlgs: []string{oidc.ES256},
+			SkipExpiryCheck:      true,
+		}),
+	}
+
+	var (
+		claims  map[string]interface{}
+		subject string
+		groups  []string
+	)
+
+	h := p.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ = GetClaims(r.Context())
+		subject, _ = GetSubject(r.Context())
+		groups, _ = GetGroups(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/metrics/v1/test/api/v1/query", nil)
+	r.Header.Set("Authorization", "Bearer "+signClaims(t, key, map[string]interface{}{
+		"iss":    testIssuer,
+		"aud":    "observatorium",
+		"sub":    "user",
+		"groups": []string{"team-a", "team-b"},
+		"email":  "user@example.com",
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if subject != "user" {
+		t.Errorf("expected subject %q; got %q", "user", subject)
+	}
+
+	if expected := []string{"team-a", "team-b"}; !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v; got %v", expected, groups)
+	}
+
+	if claims["email"] != "user@example.com" {
+		t.Errorf("expected the email claim in the request context; got claims %v", claims)
+	}
+}
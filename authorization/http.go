@@ -1,6 +1,7 @@
 package authorization
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/observatorium/observatorium/authentication"
@@ -40,3 +41,26 @@ func WithAuthorizers(authorizers map[string]rbac.Authorizer, permission rbac.Per
 		})
 	}
 }
+
+// Authorizer decides whether an authenticated request may be served,
+// e.g. by checking claims of the request's token against a policy for the requested path.
+type Authorizer interface {
+	// Authorize returns an error describing why the request is denied, or nil if it is allowed.
+	Authorize(ctx context.Context, r *http.Request) error
+}
+
+// AuthorizerFunc is an adapter to use an ordinary function as an Authorizer.
+type AuthorizerFunc func(ctx context.Context, r *http.Request) error
+
+// Authorize implements the Authorizer interface.
+func (f AuthorizerFunc) Authorize(ctx context.Context, r *http.Request) error {
+	return f(ctx, r)
+}
+
+// NopAuthorizer is an Authorizer allowing all requests. It is the default of server.WithAuthorizer.
+type NopAuthorizer struct{}
+
+// Authorize implements the Authorizer interface.
+func (NopAuthorizer) Authorize(context.Context, *http.Request) error {
+	return nil
+}
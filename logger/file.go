@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"os"
+	"sync"
+)
+
+// rotatingFile is an io.Writer that writes to a file and rotates it once it exceeds a maximum size.
+// On rotation the current file is renamed by appending ".1" to its name, replacing any previous rotation.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+
+	return nil
+}
+
+// Write implements the io.Writer interface.
+// If rotating fails, p is still written to the current file and the error of rotating is returned.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		rotateErr = r.rotate()
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, rotateErr
+}
+
+// rotate renames the current file and continues in a new one at the path.
+// The current file is only closed once the new one is open, so that logging continues in it if rotating fails.
+func (r *rotatingFile) rotate() error {
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	return old.Close()
+}
@@ -0,0 +1,118 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// setup prepares the directory before writing.
+		setup   func(t *testing.T, path string)
+		current string
+		rotated string
+		fail    bool
+	}{
+		{
+			name:    "rotation",
+			setup:   func(*testing.T, string) {},
+			current: "second\n",
+			rotated: "first\n",
+		},
+		{
+			name: "failed rotation",
+			// A non-empty directory cannot be replaced by renaming the file.
+			setup: func(t *testing.T, path string) {
+				if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0o750); err != nil {
+					t.Fatal(err)
+				}
+			},
+			current: "first\nsecond\n",
+			fail:    true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "logger")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "observatorium.log")
+			tc.setup(t, path)
+
+			f, err := newRotatingFile(path, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := f.Write([]byte("first\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := f.Write([]byte("second\n"))
+			if (err != nil) != tc.fail {
+				t.Errorf("expected rotation to fail: %t; got %v", tc.fail, err)
+			}
+
+			if n != len("second\n") {
+				t.Errorf("expected the line to be written; got %d bytes", n)
+			}
+
+			if got := readFile(t, path); got != tc.current {
+				t.Errorf("expected current file %q; got %q", tc.current, got)
+			}
+
+			if tc.rotated != "" {
+				if got := readFile(t, path+".1"); got != tc.rotated {
+					t.Errorf("expected rotated file %q; got %q", tc.rotated, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewLoggerFileFallback(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stderr := os.Stderr
+	os.Stderr = w
+
+	defer func() { os.Stderr = stderr }()
+
+	l := NewLogger("info", LogFormatLogfmt, "", WithFile("/nonexistent/observatorium.log", 0))
+	_ = l.Log("msg", "still logging")
+
+	os.Stderr = stderr
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"failed to open log file", "still logging"} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("expected stderr to contain %q; got %q", expected, out)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	"os"
 
 	"github.com/go-kit/kit/log"
@@ -12,12 +13,43 @@ const (
 	LogFormatJSON   = "json"
 )
 
-func NewLogger(logLevel, logFormat, debugName string) log.Logger {
+type config struct {
+	filePath        string
+	fileMaxSizeByte int64
+	fieldNames      map[string]string
+}
+
+// Option modifies the configuration of a logger.
+type Option func(c *config)
+
+// WithFile makes the logger write to the given file in addition to stderr.
+// The file is rotated once it grows beyond maxSizeMB megabytes; a size of zero disables rotation.
+func WithFile(path string, maxSizeMB int) Option {
+	return func(c *config) {
+		c.filePath = path
+		c.fileMaxSizeByte = int64(maxSizeMB) * 1024 * 1024
+	}
+}
+
+// WithFieldNames renames the keys of log lines, e.g. {"level": "severity", "msg": "message"},
+// so that logs match the field names expected by a log pipeline.
+func WithFieldNames(names map[string]string) Option {
+	return func(c *config) {
+		c.fieldNames = names
+	}
+}
+
+func NewLogger(logLevel, logFormat, debugName string, opts ...Option) log.Logger {
 	var (
 		logger log.Logger
 		lvl    level.Option
+		c      config
 	)
 
+	for _, o := range opts {
+		o(&c)
+	}
+
 	switch logLevel {
 	case "error":
 		lvl = level.AllowError()
@@ -31,9 +63,27 @@ func NewLogger(logLevel, logFormat, debugName string) log.Logger {
 		panic("unexpected log level")
 	}
 
-	logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	var (
+		w       io.Writer = os.Stderr
+		fileErr error
+	)
+
+	if c.filePath != "" {
+		f, err := newRotatingFile(c.filePath, c.fileMaxSizeByte)
+		if err != nil {
+			fileErr = err
+		} else {
+			w = io.MultiWriter(os.Stderr, f)
+		}
+	}
+
+	logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
 	if logFormat == LogFormatJSON {
-		logger = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	}
+
+	if len(c.fieldNames) > 0 {
+		logger = &renamingLogger{next: logger, names: c.fieldNames}
 	}
 
 	logger = level.NewFilter(logger, lvl)
@@ -42,5 +92,33 @@ func NewLogger(logLevel, logFormat, debugName string) log.Logger {
 		logger = log.With(logger, "name", debugName)
 	}
 
-	return log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+
+	if fileErr != nil {
+		level.Warn(logger).Log("msg", "failed to open log file, logging to stderr only", "file", c.filePath, "err", fileErr)
+	}
+
+	return logger
+}
+
+// renamingLogger renames the keys of log lines before passing them on.
+type renamingLogger struct {
+	next  log.Logger
+	names map[string]string
+}
+
+// Log implements the log.Logger interface.
+func (l *renamingLogger) Log(keyvals ...interface{}) error {
+	renamed := make([]interface{}, len(keyvals))
+	copy(renamed, keyvals)
+
+	for i := 0; i < len(renamed); i += 2 {
+		if k, ok := renamed[i].(string); ok {
+			if name, ok := l.names[k]; ok {
+				renamed[i] = name
+			}
+		}
+	}
+
+	return l.next.Log(renamed...)
 }
@@ -9,12 +9,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	stdlog "log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -27,9 +29,9 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/metalmatze/signal/healthcheck"
 	"github.com/metalmatze/signal/internalserver"
-	"github.com/metalmatze/signal/server/signalhttp"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
 	"go.uber.org/automaxprocs/maxprocs"
 
@@ -40,14 +42,22 @@ import (
 	"github.com/observatorium/observatorium/authorization"
 	"github.com/observatorium/observatorium/logger"
 	"github.com/observatorium/observatorium/opa"
+	"github.com/observatorium/observatorium/proxy"
 	"github.com/observatorium/observatorium/rbac"
 	"github.com/observatorium/observatorium/server"
 	"github.com/observatorium/observatorium/tls"
 )
 
 type config struct {
-	logLevel  string
-	logFormat string
+	logLevel         string
+	logFormat        string
+	logFile          string
+	logFileMaxSizeMB int
+	logSampleRate    float64
+	sampleRate       float64
+	logLevelKey      string
+	logMessageKey    string
+	logTimeKey       string
 
 	rbacConfigPath    string
 	tenantsConfigPath string
@@ -55,6 +65,9 @@ type config struct {
 	debug   debugConfig
 	server  serverConfig
 	tls     tlsConfig
+	proxy   proxyConfig
+	oidc    oidcConfig
+	startup startupConfig
 	metrics metricsConfig
 	logs    logsConfig
 }
@@ -63,12 +76,64 @@ type debugConfig struct {
 	mutexProfileFraction int
 	blockProfileRate     int
 	name                 string
+	metrics              bool
+	profileTokenFile     string
+	requestHeader        string
+	requestTokenFile     string
 }
 
 type serverConfig struct {
 	listen         string
+	listenNetwork  string
+	listenBacklog  int
 	listenInternal string
+	grpcListen     string
 	healthcheckURL string
+	warmup         time.Duration
+
+	connReadBufferBytes  int
+	connWriteBufferBytes int
+
+	http2MaxConcurrentStreams uint
+	http2MaxReadFrameSize     uint
+
+	maxInflightRequests   int
+	loadSheddingThreshold float64
+	admissionQueueLength  int
+	admissionQueueMaxWait time.Duration
+	tenantMaxInflight     int
+	tenantQueueLength     int
+	tenantQueueMaxWait    time.Duration
+	heapSheddingThreshold uint64
+	exemptPaths           []string
+	retryAfter            time.Duration
+	retryAfterCauses      map[string]time.Duration
+	activeTenantsWindow   time.Duration
+
+	writeBodyReadTimeout time.Duration
+	writeMaxBodyBytes    int64
+	maxURILength         int
+
+	writeMaxDecompressedBytes int64
+
+	writeIdempotencyHeader string
+	writeIdempotencyTTL    time.Duration
+
+	shutdownRequestTimeout time.Duration
+	shutdownStreamTimeout  time.Duration
+	idleExit               time.Duration
+	serverTiming           bool
+	middlewareTiming       bool
+
+	statusRemap map[int]int
+
+	clientTimeoutHeader string
+	clientTimeoutMax    time.Duration
+
+	metricsLabelHeader string
+	metricsLabelName   string
+	metricsLabelValues []string
+	metricsSizeBuckets []float64
 }
 
 type tlsConfig struct {
@@ -79,14 +144,93 @@ type tlsConfig struct {
 	serverCertFile string
 	serverKeyFile  string
 
+	clientAllowedURISANs []string
+	clientTenantFrom     func(*x509.Certificate) (string, error)
+
 	healthchecksServerCAFile string
 	healthchecksServerName   string
+
+	metricsServerName string
+	logsServerName    string
+}
+
+type startupConfig struct {
+	requireUpstreams bool
+}
+
+type oidcConfig struct {
+	jwksRefreshInterval time.Duration
+}
+
+type proxyConfig struct {
+	bufferCount        int
+	claimHeaders       map[string]string
+	retries            int
+	retryStatusCodes   []int
+	retryNetworkErrors bool
+	retryMaxBodyBytes  int
+
+	responseHeaderAllowlist []string
+
+	readBufferBytes  int
+	writeBufferBytes int
+
+	stripHeaders             []string
+	singletonResponseHeaders []string
+
+	upstreamHeaders      map[string]string
+	queryUpstreamHeaders map[string]string
+	writeUpstreamHeaders map[string]string
+
+	dialTimeout            time.Duration
+	maxResponseHeaderBytes int64
+	maxConnAge             time.Duration
+	http2                  bool
+
+	errorLogWindow     time.Duration
+	errorLogSampleRate int
+
+	readDSCP  int
+	writeDSCP int
+
+	readResponseMode  proxy.ResponseMode
+	writeResponseMode proxy.ResponseMode
+
+	canaryHeader   string
+	canaryValue    string
+	canaryFraction float64
 }
 
 type metricsConfig struct {
+	namespace string
+
+	statsdAddress  string
+	statsdInterval time.Duration
+	statsdPrefix   string
+
 	readEndpoint  *url.URL
 	writeEndpoint *url.URL
 	tenantHeader  string
+
+	queryFallbackEndpoint    *url.URL
+	queryFallbackStatusCodes []int
+
+	defaultMaxSourceResolution time.Duration
+	serveStaleMaxStaleness     time.Duration
+	defaultLookbackDelta       time.Duration
+	maxLookbackDelta           time.Duration
+
+	queryMaxSelectors    int
+	queryMaxMatchers     int
+	queryMaxTimeout      time.Duration
+	queryUpstreamTimeout time.Duration
+	queryCoalescing      bool
+	queryValidation      bool
+	queryMaxResponse     int64
+
+	writeBufferMaxBytes   int
+	writeBufferDir        string
+	writeBufferFullPolicy string
 }
 
 type logsConfig struct {
@@ -105,6 +249,9 @@ const (
 	middlewareTimeout
 )
 
+// upstreamCheckTimeout bounds connecting to each upstream when checking them at startup.
+const upstreamCheckTimeout = 5 * time.Second
+
 //nolint:funlen,gocyclo,gocognit
 func main() {
 	cfg, err := parseFlags()
@@ -112,7 +259,24 @@ func main() {
 		stdlog.Fatalf("parse flag: %v", err)
 	}
 
-	logger := logger.NewLogger(cfg.logLevel, cfg.logFormat, cfg.debug.name)
+	var loggerOpts []logger.Option
+	if cfg.logFile != "" {
+		loggerOpts = append(loggerOpts, logger.WithFile(cfg.logFile, cfg.logFileMaxSizeMB))
+	}
+
+	fieldNames := map[string]string{}
+
+	for key, name := range map[string]string{"level": cfg.logLevelKey, "msg": cfg.logMessageKey, "ts": cfg.logTimeKey} {
+		if name != key {
+			fieldNames[key] = name
+		}
+	}
+
+	if len(fieldNames) > 0 {
+		loggerOpts = append(loggerOpts, logger.WithFieldNames(fieldNames))
+	}
+
+	logger := logger.NewLogger(cfg.logLevel, cfg.logFormat, cfg.debug.name, loggerOpts...)
 	defer level.Info(logger).Log("msg", "exiting")
 
 	type tenant struct {
@@ -140,6 +304,13 @@ func main() {
 			URL        string   `json:"url"`
 			authorizer rbac.Authorizer
 		} `json:"opa"`
+		Metrics *struct {
+			ReadEndpoint  string `json:"readEndpoint"`
+			WriteEndpoint string `json:"writeEndpoint"`
+			readEndpoint  *url.URL
+			writeEndpoint *url.URL
+		} `json:"metrics"`
+		MaxInflightRequests int `json:"maxInflightRequests"`
 	}
 
 	type tenantsConfig struct {
@@ -226,6 +397,29 @@ func main() {
 					t.OPA.authorizer = a
 				}
 			}
+			if t.Metrics != nil {
+				// Endpoints that are not set fall back to the global ones.
+				t.Metrics.readEndpoint = cfg.metrics.readEndpoint
+				if t.Metrics.ReadEndpoint != "" {
+					u, err := url.ParseRequestURI(t.Metrics.ReadEndpoint)
+					if err != nil {
+						skip.Log("tenant", t.Name, "err", fmt.Sprintf("failed to parse metrics read endpoint: %v", err))
+						tenantsCfg.Tenants[i] = nil
+						continue
+					}
+					t.Metrics.readEndpoint = u
+				}
+				t.Metrics.writeEndpoint = cfg.metrics.writeEndpoint
+				if t.Metrics.WriteEndpoint != "" {
+					u, err := url.ParseRequestURI(t.Metrics.WriteEndpoint)
+					if err != nil {
+						skip.Log("tenant", t.Name, "err", fmt.Sprintf("failed to parse metrics write endpoint: %v", err))
+						tenantsCfg.Tenants[i] = nil
+						continue
+					}
+					t.Metrics.writeEndpoint = u
+				}
+			}
 		}
 	}
 
@@ -241,14 +435,64 @@ func main() {
 		}
 	}
 
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(
+	if err := checkUpstreams(cfg, upstreamCheckTimeout); err != nil {
+		stdlog.Fatalf("required upstreams are not reachable: %v", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
 		version.NewCollector("observatorium"),
 		prometheus.NewGoCollector(),
 		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
 	)
 
-	healthchecks := healthcheck.NewMetricsHandler(healthcheck.NewHandler(), reg)
+	// The metrics of observatorium's own components share the namespace,
+	// the version, Go and process collectors above keep their established names.
+	var reg prometheus.Registerer = registry
+	if cfg.metrics.namespace != "" {
+		reg = prometheus.WrapRegistererWithPrefix(cfg.metrics.namespace+"_", registry)
+	}
+
+	healthchecks := server.WithWarmup(cfg.server.warmup)(
+		server.NewCheckAgeHandler(healthcheck.NewMetricsHandler(healthcheck.NewHandler(), reg), reg),
+	)
+
+	internalHandler := internalserver.NewHandler(
+		internalserver.WithName("Internal - Observatorium API"),
+		internalserver.WithHealthchecks(healthchecks),
+		internalserver.WithPProf(),
+	)
+
+	internalHandler.AddEndpoint("/-/healthy", "Exposes the liveness status and checks as JSON",
+		server.HealthHandler(healthchecks.LiveEndpoint),
+	)
+	internalHandler.AddEndpoint("/-/ready", "Exposes the readiness status and checks as JSON",
+		server.HealthHandler(healthchecks.ReadyEndpoint),
+	)
+
+	// Serve OpenMetrics, including exemplars, to scrapers asking for it
+	// and the classic text format to all others.
+	internalHandler.AddEndpoint("/metrics", "Exposes Prometheus metrics",
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP,
+	)
+
+	// internalServerHandler serves the internal endpoints, with the pprof endpoints gated by a token if one is configured.
+	var internalServerHandler http.Handler = internalHandler
+	// profileToken also gates administrative endpoints of the internal server, e.g. flushing the stale cache.
+	var profileToken string
+	if cfg.debug.profileTokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.debug.profileTokenFile)
+		if err != nil {
+			stdlog.Fatalf("failed to read profiling token: %v", err)
+		}
+
+		profileToken = strings.TrimSpace(string(token))
+		if profileToken == "" {
+			stdlog.Fatalf("profiling token file %q is empty", cfg.debug.profileTokenFile)
+		}
+
+		internalServerHandler = server.WithProfileAuth(profileToken)(internalHandler)
+	}
 
 	debug := os.Getenv("DEBUG") != ""
 	if debug {
@@ -275,13 +519,31 @@ func main() {
 		sig := make(chan os.Signal, 1)
 		g.Add(func() error {
 			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-			<-sig
-			level.Info(logger).Log("msg", "caught interrupt")
+			// The channel is closed if another actor stops the group first.
+			if _, ok := <-sig; ok {
+				level.Info(logger).Log("msg", "caught interrupt")
+			}
 			return nil
 		}, func(_ error) {
 			close(sig)
 		})
 	}
+
+	// idle is closed if the server did not receive requests for --web.idle-exit.
+	idle := make(chan struct{})
+	if cfg.server.idleExit > 0 {
+		done := make(chan struct{})
+		g.Add(func() error {
+			select {
+			case <-idle:
+				level.Info(logger).Log("msg", "exiting after receiving no requests", "idle", cfg.server.idleExit)
+			case <-done:
+			}
+			return nil
+		}, func(_ error) {
+			close(done)
+		})
+	}
 	{
 		if cfg.server.healthcheckURL != "" {
 			t := (http.DefaultTransport).(*http.Transport).Clone()
@@ -310,15 +572,214 @@ func main() {
 			)
 		}
 
+		var writeBuffer *server.WriteBuffer
+		if cfg.metrics.writeBufferMaxBytes > 0 {
+			writeBuffer, err = server.NewWriteBuffer(
+				log.With(logger, "component", "write-buffer"),
+				reg,
+				cfg.metrics.writeBufferMaxBytes,
+				cfg.metrics.writeBufferDir,
+				server.WithWriteBufferFullPolicy(cfg.metrics.writeBufferFullPolicy),
+			)
+			if err != nil {
+				stdlog.Fatalf("failed to initialize write buffer: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				return writeBuffer.Run(ctx)
+			}, func(error) {
+				cancel()
+			})
+		}
+
+		var staleCache *server.StaleCache
+		if cfg.metrics.serveStaleMaxStaleness > 0 {
+			staleCache = server.NewStaleCache(
+				log.With(logger, "component", "stale-cache"),
+				reg,
+				cfg.metrics.serveStaleMaxStaleness,
+			)
+
+			var flush http.Handler = http.HandlerFunc(staleCache.FlushHandler)
+			if profileToken != "" {
+				flush = server.WithTokenAuth(profileToken, "cache")(flush)
+			}
+
+			internalHandler.AddEndpoint("/-/cache/flush",
+				"Flushes the stale query cache on POST requests, optionally only queries matching the match parameter",
+				flush.ServeHTTP,
+			)
+		}
+
 		r := chi.NewRouter()
 		r.Use(middleware.RequestID)
+		r.Use(server.WithSampling(cfg.sampleRate))
 		r.Use(middleware.RealIP)
 		r.Use(middleware.Recoverer)
 		r.Use(middleware.StripSlashes)
+
+		// skipExempt applies a middleware of the authentication, limit or access logging chains
+		// to all requests except the ones to the exempt paths.
+		skipExempt := func(m func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+			if len(cfg.server.exemptPaths) == 0 {
+				return m
+			}
+
+			return server.SkipExempt(m)
+		}
+
+		if len(cfg.server.exemptPaths) > 0 {
+			r.Use(server.WithExemptPaths(cfg.server.exemptPaths))
+		}
+
 		r.Use(middleware.Timeout(middlewareTimeout)) // best set per handler
-		r.Use(server.Logger(logger))
+		r.Use(skipExempt(server.Logger(logger)))
+		r.Use(server.WithServerTiming(cfg.server.serverTiming))
+		r.Use(server.WithMiddlewareTiming(reg, cfg.server.middlewareTiming))
+
+		debugRequests := cfg.debug.requestHeader != ""
+		if debugRequests {
+			token, err := ioutil.ReadFile(cfg.debug.requestTokenFile)
+			if err != nil {
+				stdlog.Fatalf("failed to read debug request token: %v", err)
+			}
+
+			r.Use(server.WithDebugHeader(logger, cfg.debug.requestHeader, strings.TrimSpace(string(token))))
+		}
+
+		// timeStage wraps a middleware as a stage timed by the middleware timing, if enabled.
+		timeStage := func(name string, m func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+			if !cfg.server.middlewareTiming && !debugRequests {
+				return m
+			}
+
+			return server.TimeStage(name, m)
+		}
+
+		drainer := server.NewDrainer(logger)
+		r.Use(drainer.Middleware)
+
+		if cfg.server.idleExit > 0 {
+			r.Use(server.WithIdleExit(cfg.server.idleExit, func() { close(idle) }))
+		}
+		r.Use(server.WithRetryAfter(cfg.server.retryAfter, cfg.server.retryAfterCauses))
+
+		if cfg.server.clientTimeoutHeader != "" {
+			r.Use(server.WithClientTimeoutHeader(cfg.server.clientTimeoutHeader, cfg.server.clientTimeoutMax))
+		}
+
+		if len(cfg.server.statusRemap) > 0 {
+			r.Use(server.WithStatusRemap(logger, cfg.server.statusRemap))
+		}
+
+		if cfg.server.maxURILength > 0 {
+			r.Use(server.WithMaxURILength(reg, cfg.server.maxURILength))
+		}
+
+		if cfg.server.heapSheddingThreshold > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				<-ctx.Done()
+				return nil
+			}, func(error) {
+				cancel()
+			})
+
+			r.Use(skipExempt(timeStage("memory_shedding",
+				server.WithMemoryPressureShedding(ctx, reg, cfg.server.heapSheddingThreshold),
+			)))
+		}
+
+		if cfg.server.maxInflightRequests > 0 {
+			r.Use(skipExempt(timeStage("concurrency_limit", server.WithConcurrencyLimit(reg, cfg.server.maxInflightRequests,
+				server.WithLoadShedding(cfg.server.loadSheddingThreshold),
+				server.WithAdmissionQueue(cfg.server.admissionQueueLength, cfg.server.admissionQueueMaxWait),
+			))))
+		}
+
+		var insOpts []server.InstrumenterOption
+		if len(cfg.server.metricsSizeBuckets) > 0 {
+			insOpts = append(insOpts, server.WithSizeBuckets(cfg.server.metricsSizeBuckets))
+		}
+		if cfg.server.metricsLabelHeader != "" {
+			insOpts = append(insOpts, server.WithMetricLabelFromHeader(
+				cfg.server.metricsLabelName,
+				cfg.server.metricsLabelHeader,
+				cfg.server.metricsLabelValues,
+			))
+		}
+
+		ins := server.NewHandlerInstrumenter(reg, []string{"group", "handler"}, insOpts...)
+
+		activeTenants := server.WithActiveTenants(reg, cfg.server.activeTenantsWindow)
+		uploadProgress := server.WithUploadProgress(reg, cfg.server.writeMaxBodyBytes)
 
-		ins := signalhttp.NewHandlerInstrumenter(reg, []string{"group", "handler"})
+		var canary func(http.Handler) http.Handler
+		if cfg.proxy.canaryHeader != "" {
+			canary = server.WithCanaryHeader(reg, cfg.proxy.canaryHeader, cfg.proxy.canaryValue, cfg.proxy.canaryFraction)
+		}
+
+		tenantLimits := map[string]int{}
+		for _, t := range tenantsCfg.Tenants {
+			if t != nil && t.MaxInflightRequests > 0 {
+				tenantLimits[t.Name] = t.MaxInflightRequests
+			}
+		}
+
+		tenantConcurrency := func(next http.Handler) http.Handler { return next }
+		if len(tenantLimits) > 0 || cfg.server.tenantMaxInflight > 0 {
+			tenantConcurrency = skipExempt(timeStage("tenant_concurrency_limit",
+				server.WithTenantConcurrency(reg, tenantLimits, cfg.server.tenantMaxInflight,
+					server.WithAdmissionQueue(cfg.server.tenantQueueLength, cfg.server.tenantQueueMaxWait),
+				),
+			))
+		}
+
+		// High-cardinality metrics are kept out of the main registry and exposed separately for rare, deep-dive scrapes.
+		tenantMetrics := func(next http.Handler) http.Handler { return next }
+		if cfg.debug.metrics {
+			debugRegistry := prometheus.NewRegistry()
+			tenantMetrics = server.WithTenantRequestMetrics(debugRegistry)
+
+			internalHandler.AddEndpoint("/debug/metrics", "Exposes high-cardinality debug metrics, e.g. per tenant",
+				promhttp.HandlerFor(debugRegistry, promhttp.HandlerOpts{}).ServeHTTP,
+			)
+		}
+
+		proxyOpts := []proxy.Option{
+			proxy.WithBufferCount(cfg.proxy.bufferCount),
+			proxy.WithTransportBufferSizes(cfg.proxy.readBufferBytes, cfg.proxy.writeBufferBytes),
+			proxy.WithRetry(cfg.proxy.retries, cfg.proxy.retryStatusCodes...),
+			proxy.WithRetryMaxBodyBytes(int64(cfg.proxy.retryMaxBodyBytes)),
+			proxy.WithRetryOnNetworkErrors(cfg.proxy.retryNetworkErrors),
+			proxy.WithErrorLogSampling(cfg.proxy.errorLogWindow, cfg.proxy.errorLogSampleRate),
+			proxy.WithHTTP2(cfg.proxy.http2),
+		}
+
+		if cfg.proxy.maxResponseHeaderBytes > 0 {
+			proxyOpts = append(proxyOpts, proxy.WithMaxResponseHeaderBytes(cfg.proxy.maxResponseHeaderBytes))
+		}
+
+		if cfg.proxy.maxConnAge > 0 {
+			proxyOpts = append(proxyOpts, proxy.WithMaxConnAge(cfg.proxy.maxConnAge))
+		}
+
+		if cfg.proxy.dialTimeout > 0 {
+			proxyOpts = append(proxyOpts, proxy.WithDialTimeout(cfg.proxy.dialTimeout))
+		}
+
+		if len(cfg.proxy.stripHeaders) > 0 {
+			proxyOpts = append(proxyOpts, proxy.WithStripOutboundHeaders(cfg.proxy.stripHeaders))
+		}
+
+		if len(cfg.proxy.singletonResponseHeaders) > 0 {
+			proxyOpts = append(proxyOpts, proxy.WithSingletonResponseHeaders(cfg.proxy.singletonResponseHeaders))
+		}
+
+		if len(cfg.proxy.responseHeaderAllowlist) > 0 {
+			proxyOpts = append(proxyOpts, proxy.WithResponseHeaderAllowlist(cfg.proxy.responseHeaderAllowlist))
+		}
 
 		r.Group(func(r chi.Router) {
 			r.Use(authentication.WithTenant)
@@ -327,6 +788,9 @@ func main() {
 			var oidcs []authentication.TenantOIDCConfig
 			var mTLSs []authentication.MTLSConfig
 			authorizers := map[string]rbac.Authorizer{}
+			// The request authorizer is an extension point for policies beyond RBAC;
+			// builds of Observatorium may replace it, by default all authenticated requests are allowed.
+			var requestAuthorizer authorization.Authorizer = authorization.NopAuthorizer{}
 			for _, t := range tenantsCfg.Tenants {
 				if t == nil {
 					continue
@@ -345,6 +809,8 @@ func main() {
 							IssuerURL:     t.OIDC.IssuerURL,
 							RedirectURL:   t.OIDC.RedirectURL,
 							UsernameClaim: t.OIDC.UsernameClaim,
+
+							JWKSRefreshInterval: cfg.oidc.jwksRefreshInterval,
 						},
 					})
 				case t.MTLS != nil:
@@ -370,8 +836,16 @@ func main() {
 
 			// Metrics
 			r.Group(func(r chi.Router) {
-				r.Use(authentication.WithTenantMiddlewares(oidcTenantMiddlewares, authentication.NewMTLS(mTLSs)))
+				r.Use(skipExempt(timeStage("authentication", authentication.WithTenantMiddlewares(oidcTenantMiddlewares, authentication.NewMTLS(mTLSs)))))
 				r.Use(authentication.WithTenantHeader(cfg.metrics.tenantHeader, tenantIDs))
+				if cfg.tls.clientTenantFrom != nil {
+					r.Use(skipExempt(server.WithTenantFromCert(cfg.metrics.tenantHeader, tenantIDs, cfg.tls.clientTenantFrom)))
+				}
+				r.Use(server.WithClaimHeaders(cfg.proxy.claimHeaders))
+				r.Use(skipExempt(server.WithAuthorizer(requestAuthorizer)))
+				r.Use(activeTenants)
+				r.Use(tenantMetrics)
+				r.Use(tenantConcurrency)
 
 				r.HandleFunc("/{tenant}", func(w http.ResponseWriter, r *http.Request) {
 					tenant, ok := authentication.GetTenant(r.Context())
@@ -383,26 +857,186 @@ func main() {
 					http.Redirect(w, r, path.Join("/api/metrics/v1/", tenant, "graph"), http.StatusMovedPermanently)
 				})
 
+				var metricsReadMiddlewares, metricsWriteMiddlewares []func(http.Handler) http.Handler
+				// The headers of write requests to the upstream are set after the write buffer,
+				// which does not keep credentials, so that they are set again when buffered writes are replayed.
+				var metricsWriteUpstreamMiddlewares []func(http.Handler) http.Handler
+				// Headers for all upstreams are set first, so that the ones per route take precedence.
+				if len(cfg.proxy.upstreamHeaders) > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithUpstreamHeaders(cfg.proxy.upstreamHeaders))
+					metricsWriteUpstreamMiddlewares = append(metricsWriteUpstreamMiddlewares, server.WithUpstreamHeaders(cfg.proxy.upstreamHeaders))
+				}
+				if len(cfg.proxy.queryUpstreamHeaders) > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithQueryUpstreamHeaders(cfg.proxy.queryUpstreamHeaders))
+				}
+				if len(cfg.proxy.writeUpstreamHeaders) > 0 {
+					metricsWriteUpstreamMiddlewares = append(metricsWriteUpstreamMiddlewares,
+						server.WithWriteUpstreamHeaders(cfg.proxy.writeUpstreamHeaders),
+					)
+				}
+				if canary != nil {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, canary)
+					metricsWriteUpstreamMiddlewares = append(metricsWriteUpstreamMiddlewares, canary)
+				}
+				if cfg.metrics.defaultMaxSourceResolution > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares,
+						server.WithDefaultMaxSourceResolution(cfg.metrics.defaultMaxSourceResolution),
+					)
+				}
+				if cfg.metrics.defaultLookbackDelta > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithDefaultLookbackDelta(cfg.metrics.defaultLookbackDelta))
+				}
+				if cfg.metrics.maxLookbackDelta > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithMaxLookbackDelta(cfg.metrics.maxLookbackDelta))
+				}
+				if cfg.metrics.queryValidation {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, timeStage("validation", server.WithQueryParamValidation()))
+				}
+				if cfg.metrics.queryMaxResponse > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithMaxQueryResponseBytes(reg, cfg.metrics.queryMaxResponse))
+				}
+				if cfg.metrics.queryMaxTimeout > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithMaxUpstreamTimeout(cfg.metrics.queryMaxTimeout))
+				}
+				if cfg.metrics.queryUpstreamTimeout > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithUpstreamQueryTimeout(cfg.metrics.queryUpstreamTimeout))
+				}
+				if cfg.metrics.queryMaxSelectors > 0 || cfg.metrics.queryMaxMatchers > 0 {
+					metricsReadMiddlewares = append(metricsReadMiddlewares,
+						timeStage("complexity_limit", server.WithQueryComplexityLimits(cfg.metrics.queryMaxSelectors, cfg.metrics.queryMaxMatchers)),
+					)
+				}
+				if staleCache != nil {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, staleCache.Middleware)
+				}
+				if cfg.metrics.queryCoalescing {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.WithRequestCoalescing())
+				}
+				if cfg.server.serverTiming || debugRequests {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.TimePhase("upstream"))
+				}
+				// The upstream stage is innermost, so that it times the proxy only; for writes it follows the write buffer.
+				if cfg.server.middlewareTiming {
+					metricsReadMiddlewares = append(metricsReadMiddlewares, server.TimeHandler("upstream"))
+					metricsWriteUpstreamMiddlewares = append(metricsWriteUpstreamMiddlewares, server.TimeHandler("upstream"))
+				}
+
+				if cfg.server.writeIdempotencyHeader != "" {
+					metricsWriteMiddlewares = append(metricsWriteMiddlewares,
+						server.WithWriteIdempotency(cfg.server.writeIdempotencyHeader, cfg.server.writeIdempotencyTTL),
+					)
+				}
+				metricsWriteMiddlewares = append(metricsWriteMiddlewares, uploadProgress)
+				if cfg.server.writeMaxBodyBytes > 0 {
+					metricsWriteMiddlewares = append(metricsWriteMiddlewares, server.WithMaxBodySize(cfg.server.writeMaxBodyBytes))
+				}
+				if cfg.server.writeMaxDecompressedBytes > 0 {
+					metricsWriteMiddlewares = append(metricsWriteMiddlewares,
+						server.WithMaxDecompressedBytes(cfg.server.writeMaxDecompressedBytes),
+					)
+				}
+				if cfg.server.writeBodyReadTimeout > 0 {
+					metricsWriteMiddlewares = append(metricsWriteMiddlewares,
+						server.WithWriteBodyReadTimeout(cfg.server.writeBodyReadTimeout),
+					)
+				}
+
+				legacyOpts := []metricslegacy.HandlerOption{
+					metricslegacy.Logger(logger),
+					metricslegacy.Registry(reg),
+					metricslegacy.HandlerInstrumenter(ins),
+					metricslegacy.ProxyOptions(proxyOpts...),
+					metricslegacy.ProxyOptions(proxy.WithUpstreamServerName(cfg.tls.metricsServerName)),
+					metricslegacy.ProxyOptions(proxy.WithDSCP(cfg.proxy.readDSCP)),
+					metricslegacy.ProxyOptions(proxy.WithResponseMode(cfg.proxy.readResponseMode)),
+					metricslegacy.ReadMiddleware(skipExempt(timeStage("authorization", authorization.WithAuthorizers(authorizers, rbac.Read, "metrics")))),
+				}
+				for _, m := range metricsReadMiddlewares {
+					legacyOpts = append(legacyOpts, metricslegacy.ReadMiddleware(m))
+				}
+
+				// Tenants with their own upstreams get their own handlers.
+				// These do not use the write buffer, which replays to the default upstream only.
+				legacyTenantHandlers := map[string]http.Handler{}
+				metricsTenantHandlers := map[string]http.Handler{}
+
+				for _, t := range tenantsCfg.Tenants {
+					if t == nil || t.Metrics == nil {
+						continue
+					}
+
+					legacyTenantHandlers[t.Name] = metricslegacy.NewHandler(t.Metrics.readEndpoint, legacyOpts...)
+				}
+
 				r.Mount("/api/v1/{tenant}",
-					metricslegacy.NewHandler(
-						cfg.metrics.readEndpoint,
-						metricslegacy.Logger(logger),
-						metricslegacy.Registry(reg),
-						metricslegacy.HandlerInstrumenter(ins),
-						metricslegacy.ReadMiddleware(authorization.WithAuthorizers(authorizers, rbac.Read, "metrics")),
+					server.WithTenantUpstreams(legacyTenantHandlers)(
+						metricslegacy.NewHandler(
+							cfg.metrics.readEndpoint,
+							legacyOpts...,
+						),
 					),
 				)
 
+				metricsOpts := []metricsv1.HandlerOption{
+					metricsv1.Logger(logger),
+					metricsv1.Registry(reg),
+					metricsv1.HandlerInstrumenter(ins),
+					metricsv1.ProxyOptions(proxyOpts...),
+					metricsv1.ProxyOptions(proxy.WithUpstreamServerName(cfg.tls.metricsServerName)),
+					metricsv1.ReadProxyOptions(proxy.WithResponseMode(cfg.proxy.readResponseMode)),
+					metricsv1.WriteProxyOptions(proxy.WithResponseMode(cfg.proxy.writeResponseMode)),
+					metricsv1.ReadMiddleware(skipExempt(timeStage("authorization", authorization.WithAuthorizers(authorizers, rbac.Read, "metrics")))),
+					metricsv1.WriteMiddleware(skipExempt(timeStage("authorization", authorization.WithAuthorizers(authorizers, rbac.Write, "metrics")))),
+				}
+				// A DSCP value for both routes applies to the transport they share if their endpoints are identical.
+				if cfg.proxy.readDSCP == cfg.proxy.writeDSCP {
+					metricsOpts = append(metricsOpts, metricsv1.ProxyOptions(proxy.WithDSCP(cfg.proxy.readDSCP)))
+				} else {
+					metricsOpts = append(metricsOpts,
+						metricsv1.ReadProxyOptions(proxy.WithDSCP(cfg.proxy.readDSCP)),
+						metricsv1.WriteProxyOptions(proxy.WithDSCP(cfg.proxy.writeDSCP)),
+					)
+				}
+				if cfg.metrics.queryFallbackEndpoint != nil {
+					metricsOpts = append(metricsOpts,
+						metricsv1.QueryFallback(cfg.metrics.queryFallbackEndpoint, cfg.metrics.queryFallbackStatusCodes...),
+					)
+				}
+				for _, m := range metricsReadMiddlewares {
+					metricsOpts = append(metricsOpts, metricsv1.ReadMiddleware(m))
+				}
+				for _, m := range metricsWriteMiddlewares {
+					metricsOpts = append(metricsOpts, metricsv1.WriteMiddleware(m))
+				}
+
+				metricsUpstreamOpts := make([]metricsv1.HandlerOption, 0, len(metricsWriteUpstreamMiddlewares))
+				for _, m := range metricsWriteUpstreamMiddlewares {
+					metricsUpstreamOpts = append(metricsUpstreamOpts, metricsv1.WriteMiddleware(m))
+				}
+
+				for _, t := range tenantsCfg.Tenants {
+					if t == nil || t.Metrics == nil {
+						continue
+					}
+
+					metricsTenantHandlers[t.Name] = metricsv1.NewHandler(t.Metrics.readEndpoint, t.Metrics.writeEndpoint,
+						append(metricsOpts[:len(metricsOpts):len(metricsOpts)], metricsUpstreamOpts...)...,
+					)
+				}
+
+				if writeBuffer != nil {
+					metricsOpts = append(metricsOpts, metricsv1.WriteMiddleware(writeBuffer.Middleware))
+				}
+				metricsOpts = append(metricsOpts, metricsUpstreamOpts...)
+
 				r.Mount("/api/metrics/v1/{tenant}",
 					stripTenantPrefix("/api/metrics/v1",
-						metricsv1.NewHandler(
-							cfg.metrics.readEndpoint,
-							cfg.metrics.writeEndpoint,
-							metricsv1.Logger(logger),
-							metricsv1.Registry(reg),
-							metricsv1.HandlerInstrumenter(ins),
-							metricsv1.ReadMiddleware(authorization.WithAuthorizers(authorizers, rbac.Read, "metrics")),
-							metricsv1.WriteMiddleware(authorization.WithAuthorizers(authorizers, rbac.Write, "metrics")),
+						server.WithTenantUpstreams(metricsTenantHandlers)(
+							metricsv1.NewHandler(
+								cfg.metrics.readEndpoint,
+								cfg.metrics.writeEndpoint,
+								metricsOpts...,
+							),
 						),
 					),
 				)
@@ -411,8 +1045,73 @@ func main() {
 			// Logs
 			if cfg.logs.enabled {
 				r.Group(func(r chi.Router) {
-					r.Use(authentication.WithTenantMiddlewares(oidcTenantMiddlewares, authentication.NewMTLS(mTLSs)))
+					r.Use(skipExempt(timeStage("authentication", authentication.WithTenantMiddlewares(oidcTenantMiddlewares, authentication.NewMTLS(mTLSs)))))
 					r.Use(authentication.WithTenantHeader(cfg.logs.tenantHeader, tenantIDs))
+					if cfg.tls.clientTenantFrom != nil {
+						r.Use(skipExempt(server.WithTenantFromCert(cfg.logs.tenantHeader, tenantIDs, cfg.tls.clientTenantFrom)))
+					}
+					r.Use(server.WithClaimHeaders(cfg.proxy.claimHeaders))
+					r.Use(skipExempt(server.WithAuthorizer(requestAuthorizer)))
+					r.Use(activeTenants)
+					r.Use(tenantMetrics)
+					r.Use(tenantConcurrency)
+
+					logsOpts := []logsv1.HandlerOption{
+						logsv1.Logger(logger),
+						logsv1.Registry(reg),
+						logsv1.HandlerInstrumenter(ins),
+						logsv1.ProxyOptions(proxyOpts...),
+						logsv1.ProxyOptions(proxy.WithUpstreamServerName(cfg.tls.logsServerName)),
+						logsv1.ReadProxyOptions(proxy.WithDSCP(cfg.proxy.readDSCP)),
+						logsv1.WriteProxyOptions(proxy.WithDSCP(cfg.proxy.writeDSCP)),
+						logsv1.ReadProxyOptions(proxy.WithResponseMode(cfg.proxy.readResponseMode)),
+						logsv1.WriteProxyOptions(proxy.WithResponseMode(cfg.proxy.writeResponseMode)),
+						logsv1.ReadMiddleware(skipExempt(timeStage("authorization", authorization.WithAuthorizers(authorizers, rbac.Read, "logs")))),
+						logsv1.WriteMiddleware(skipExempt(timeStage("authorization", authorization.WithAuthorizers(authorizers, rbac.Write, "logs")))),
+					}
+					if len(cfg.proxy.upstreamHeaders) > 0 {
+						logsOpts = append(logsOpts,
+							logsv1.ReadMiddleware(server.WithUpstreamHeaders(cfg.proxy.upstreamHeaders)),
+							logsv1.WriteMiddleware(server.WithUpstreamHeaders(cfg.proxy.upstreamHeaders)),
+						)
+					}
+					if len(cfg.proxy.queryUpstreamHeaders) > 0 {
+						logsOpts = append(logsOpts, logsv1.ReadMiddleware(server.WithQueryUpstreamHeaders(cfg.proxy.queryUpstreamHeaders)))
+					}
+					if len(cfg.proxy.writeUpstreamHeaders) > 0 {
+						logsOpts = append(logsOpts, logsv1.WriteMiddleware(server.WithWriteUpstreamHeaders(cfg.proxy.writeUpstreamHeaders)))
+					}
+					if canary != nil {
+						logsOpts = append(logsOpts, logsv1.ReadMiddleware(canary), logsv1.WriteMiddleware(canary))
+					}
+					if cfg.server.serverTiming || debugRequests {
+						logsOpts = append(logsOpts, logsv1.ReadMiddleware(server.TimePhase("upstream")))
+					}
+					if cfg.server.writeIdempotencyHeader != "" {
+						logsOpts = append(logsOpts, logsv1.WriteMiddleware(
+							server.WithWriteIdempotency(cfg.server.writeIdempotencyHeader, cfg.server.writeIdempotencyTTL),
+						))
+					}
+					logsOpts = append(logsOpts, logsv1.WriteMiddleware(uploadProgress))
+					if cfg.server.writeMaxBodyBytes > 0 {
+						logsOpts = append(logsOpts, logsv1.WriteMiddleware(server.WithMaxBodySize(cfg.server.writeMaxBodyBytes)))
+					}
+					if cfg.server.writeMaxDecompressedBytes > 0 {
+						logsOpts = append(logsOpts,
+							logsv1.WriteMiddleware(server.WithMaxDecompressedBytes(cfg.server.writeMaxDecompressedBytes)),
+						)
+					}
+					if cfg.server.writeBodyReadTimeout > 0 {
+						logsOpts = append(logsOpts,
+							logsv1.WriteMiddleware(server.WithWriteBodyReadTimeout(cfg.server.writeBodyReadTimeout)),
+						)
+					}
+					if cfg.server.middlewareTiming {
+						logsOpts = append(logsOpts,
+							logsv1.ReadMiddleware(server.TimeHandler("upstream")),
+							logsv1.WriteMiddleware(server.TimeHandler("upstream")),
+						)
+					}
 
 					r.Mount("/api/logs/v1/{tenant}",
 						stripTenantPrefix("/api/logs/v1",
@@ -420,11 +1119,7 @@ func main() {
 								cfg.logs.readEndpoint,
 								cfg.logs.tailEndpoint,
 								cfg.logs.writeEndpoint,
-								logsv1.Logger(logger),
-								logsv1.Registry(reg),
-								logsv1.HandlerInstrumenter(ins),
-								logsv1.ReadMiddleware(authorization.WithAuthorizers(authorizers, rbac.Read, "logs")),
-								logsv1.WriteMiddleware(authorization.WithAuthorizers(authorizers, rbac.Write, "logs")),
+								logsOpts...,
 							),
 						),
 					)
@@ -455,6 +1150,10 @@ func main() {
 
 			tlsConfig.GetCertificate = r.GetCertificate
 
+			if len(cfg.tls.clientAllowedURISANs) > 0 {
+				server.ConfigureTLS(tlsConfig, server.WithClientCertVerifier(server.AllowURISANs(cfg.tls.clientAllowedURISANs)))
+			}
+
 			ctx, cancel := context.WithCancel(context.Background())
 			g.Add(func() error {
 				return r.Watch(ctx)
@@ -471,60 +1170,149 @@ func main() {
 			WriteTimeout: writeTimeout, // best set per handler
 		}
 
+		if tlsConfig != nil {
+			if err := server.ConfigureHTTP2(&s,
+				server.WithHTTP2MaxConcurrentStreams(uint32(cfg.server.http2MaxConcurrentStreams)),
+				server.WithHTTP2MaxReadFrameSize(uint32(cfg.server.http2MaxReadFrameSize)),
+			); err != nil {
+				stdlog.Fatalf("failed to configure HTTP/2: %v", err)
+			}
+		}
+
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting the HTTP server", "address", cfg.server.listen)
 
+			l, err := server.Listen(cfg.server.listen,
+				server.WithListenNetwork(cfg.server.listenNetwork),
+				server.WithListenBacklog(cfg.server.listenBacklog),
+				server.WithListenLogger(logger),
+				server.WithConnBufferSizes(cfg.server.connReadBufferBytes, cfg.server.connWriteBufferBytes),
+			)
+			if err != nil {
+				return fmt.Errorf("listen on %q: %w", cfg.server.listen, err)
+			}
+
 			if tlsConfig != nil {
 				// serverCertFile and serverKeyFile passed in TLSConfig at initialization.
-				return s.ListenAndServeTLS("", "")
+				return s.ServeTLS(l, "", "")
 			}
 
-			return s.ListenAndServe()
+			return s.Serve(l)
 		}, func(err error) {
-			// gracePeriod is duration the server gracefully shuts down.
-			const gracePeriod = gracePeriod
-
-			ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
-			defer cancel()
+			// The whole shutdown, including draining the write buffer, is bounded by the stream timeout.
+			deadline := time.Now().Add(cfg.server.shutdownStreamTimeout)
 
 			level.Info(logger).Log("msg", "shutting down the HTTP server")
-			_ = s.Shutdown(ctx)
+			drainer.Shutdown(&s, cfg.server.shutdownRequestTimeout, cfg.server.shutdownStreamTimeout)
+
+			// Once no more writes are accepted, replay what is left in the write buffer
+			// within the remainder of the shutdown.
+			if writeBuffer != nil {
+				ctx, cancel := context.WithDeadline(context.Background(), deadline)
+				defer cancel()
+
+				level.Info(logger).Log("msg", "draining the write buffer", "timeout", time.Until(deadline))
+				writeBuffer.Drain(ctx)
+			}
 		})
+
+		if cfg.server.grpcListen != "" {
+			gs := server.NewGRPCServer(log.With(logger, "component", "grpc"), r,
+				server.WithGRPCListen(cfg.server.grpcListen),
+				server.WithGRPCTLS(tlsConfig),
+			)
+
+			g.Add(gs.ListenAndServe, func(error) {
+				level.Info(logger).Log("msg", "shutting down the gRPC server")
+				gs.Shutdown()
+			})
+		}
 	}
 	{
-		h := internalserver.NewHandler(
-			internalserver.WithName("Internal - Observatorium API"),
-			internalserver.WithHealthchecks(healthchecks),
-			internalserver.WithPrometheusRegistry(reg),
-			internalserver.WithPProf(),
-		)
-
 		s := http.Server{
 			Addr:    cfg.server.listenInternal,
-			Handler: h,
+			Handler: internalServerHandler,
 		}
 
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting internal HTTP server", "address", s.Addr)
-			return s.ListenAndServe()
+
+			l, err := server.Listen(s.Addr, server.WithListenNetwork(cfg.server.listenNetwork))
+			if err != nil {
+				return fmt.Errorf("listen on %q: %w", s.Addr, err)
+			}
+
+			return s.Serve(l)
 		}, func(err error) {
 			_ = s.Shutdown(context.Background())
 		})
 	}
 
+	if cfg.metrics.statsdAddress != "" {
+		exporter := server.NewStatsDExporter(log.With(logger, "component", "statsd"), registry,
+			cfg.metrics.statsdAddress, cfg.metrics.statsdInterval,
+			server.WithStatsDPrefix(cfg.metrics.statsdPrefix),
+			server.WithStatsDNamespace(cfg.metrics.namespace),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "pushing metrics to StatsD", "address", cfg.metrics.statsdAddress)
+			return exporter.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	if err := g.Run(); err != nil {
 		stdlog.Fatal(err)
 	}
 }
 
+// checkUpstreams returns an error if upstreams are required at startup and any of the configured ones
+// cannot be connected to within the timeout.
+func checkUpstreams(cfg config, timeout time.Duration) error {
+	if !cfg.startup.requireUpstreams {
+		return nil
+	}
+
+	return server.CheckUpstreams(timeout,
+		cfg.metrics.readEndpoint,
+		cfg.metrics.writeEndpoint,
+		cfg.logs.readEndpoint,
+		cfg.logs.tailEndpoint,
+		cfg.logs.writeEndpoint,
+	)
+}
+
 func parseFlags() (config, error) {
 	var (
-		rawTLSCipherSuites      string
-		rawMetricsReadEndpoint  string
-		rawMetricsWriteEndpoint string
-		rawLogsReadEndpoint     string
-		rawLogsTailEndpoint     string
-		rawLogsWriteEndpoint    string
+		rawTLSCipherSuites              string
+		rawTLSClientAllowedURISANs      string
+		rawTLSClientTenantFrom          string
+		rawProxyReadResponseMode        string
+		rawProxyWriteResponseMode       string
+		rawProxyClaimHeaders            string
+		rawProxyRetryStatusCodes        string
+		rawProxyResponseHeaderAllowlist string
+		rawProxyStripHeaders            string
+		rawProxySingletonHeaders        string
+		rawProxyUpstreamHeaders         string
+		rawProxyQueryUpstreamHeaders    string
+		rawProxyWriteUpstreamHeaders    string
+		rawProxyCanaryHeader            string
+		rawStatusRemap                  string
+		rawMetricsLabelValues           string
+		rawExemptPaths                  string
+		rawMetricsSizeBuckets           string
+		rawRetryAfterCauses             string
+		rawMetricsReadEndpoint          string
+		rawMetricsWriteEndpoint         string
+		rawMetricsQueryFallbackEndpoint string
+		rawMetricsQueryFallbackCodes    string
+		rawLogsReadEndpoint             string
+		rawLogsTailEndpoint             string
+		rawLogsWriteEndpoint            string
 	)
 
 	cfg := config{}
@@ -535,6 +1323,16 @@ func parseFlags() (config, error) {
 		"Path to the tenants file.")
 	flag.StringVar(&cfg.debug.name, "debug.name", "observatorium",
 		"A name to add as a prefix to log lines.")
+	flag.BoolVar(&cfg.debug.metrics, "debug.metrics", false,
+		"Expose high-cardinality debug metrics, e.g. requests per tenant, on the internal server at /debug/metrics.")
+	flag.StringVar(&cfg.debug.profileTokenFile, "debug.profile-token-file", "",
+		"Path to a file containing a token that requests to the pprof endpoints under /debug/pprof/ and to /-/cache/flush must send as a bearer token. "+
+			"Requests without it are rejected with 401 Unauthorized. The file must not be empty. If omitted, these endpoints are not protected.")
+	flag.StringVar(&cfg.debug.requestHeader, "debug.request-header", "",
+		"The name of a request header, e.g. X-Debug, in which clients can send the token of --debug.request-token-file "+
+			"to have single requests logged in detail, with their parameters, upstreams and timings. Leave blank to disable.")
+	flag.StringVar(&cfg.debug.requestTokenFile, "debug.request-token-file", "",
+		"Path to a file containing the token that requests must send in --debug.request-header to be logged in detail.")
 	flag.IntVar(&cfg.debug.mutexProfileFraction, "debug.mutex-profile-fraction", 10,
 		"The percentage of mutex contention events that are reported in the mutex profile.")
 	flag.IntVar(&cfg.debug.blockProfileRate, "debug.block-profile-rate", 10,
@@ -543,12 +1341,132 @@ func parseFlags() (config, error) {
 		"The log filtering level. Options: 'error', 'warn', 'info', 'debug'.")
 	flag.StringVar(&cfg.logFormat, "log.format", logger.LogFormatLogfmt,
 		"The log format to use. Options: 'logfmt', 'json'.")
+	flag.StringVar(&cfg.logFile, "log.file", "",
+		"A file to write logs to in addition to stderr. If the file cannot be opened, logs are only written to stderr.")
+	flag.IntVar(&cfg.logFileMaxSizeMB, "log.file-max-size-mb", 100,
+		"The size in megabytes after which the log file is rotated. Set to 0 to disable rotation.")
+	flag.StringVar(&cfg.logLevelKey, "log.field.level-key", "level",
+		"The name of the field holding the level of log lines, e.g. severity.")
+	flag.StringVar(&cfg.logMessageKey, "log.field.message-key", "msg",
+		"The name of the field holding the message of log lines, e.g. message.")
+	flag.StringVar(&cfg.logTimeKey, "log.field.time-key", "ts",
+		"The name of the field holding the timestamp of log lines, e.g. time.")
+	flag.Float64Var(&cfg.logSampleRate, "log.access.sample-rate", 1,
+		"Deprecated: use --sampling.rate, which takes precedence if it is set."+
+			" The fraction, between 0 and 1, of successful requests to log.")
+	flag.Float64Var(&cfg.sampleRate, "sampling.rate", 1,
+		"The fraction, between 0 and 1, of requests to sample. Sampled requests are logged in the access log"+
+			" and their request ID is attached as an exemplar to the request duration metrics."+
+			" Failed and slow requests are always logged.")
 	flag.StringVar(&cfg.server.listen, "web.listen", ":8080",
 		"The address on which the public server listens.")
+	flag.StringVar(&cfg.server.listenNetwork, "web.listen-network", "tcp",
+		"The network the public and internal servers listen on: tcp for both IPv4 and IPv6, tcp4 for IPv4 only or tcp6 for IPv6 only.")
+	flag.IntVar(&cfg.server.listenBacklog, "web.listen-backlog", 0,
+		"The size of the accept backlog of the public server's socket. The value is a hint that the kernel may cap,"+
+			" e.g. to net.core.somaxconn on Linux. It is ignored with a warning on platforms that cannot set it, e.g. Windows. If omitted, the system default is used.")
+	flag.IntVar(&cfg.server.connReadBufferBytes, "web.conn-read-buffer-bytes", 0,
+		"The size of the kernel's receive buffer of connections to the public server. If omitted, the system default is used.")
+	flag.IntVar(&cfg.server.connWriteBufferBytes, "web.conn-write-buffer-bytes", 0,
+		"The size of the kernel's send buffer of connections to the public server. If omitted, the system default is used.")
+	flag.UintVar(&cfg.server.http2MaxConcurrentStreams, "web.http2.max-concurrent-streams", server.DefaultHTTP2MaxConcurrentStreams,
+		"The maximum number of streams an HTTP/2 client may open concurrently on one connection to the public server.")
+	flag.UintVar(&cfg.server.http2MaxReadFrameSize, "web.http2.max-read-frame-size", server.DefaultHTTP2MaxReadFrameSize,
+		"The size in bytes of the largest HTTP/2 frame the public server reads, between 16KiB and 16MiB.")
+	flag.StringVar(&cfg.server.grpcListen, "grpc.listen", "",
+		"The address on which to serve the metrics query API over gRPC, as the observatorium.v1.Query service."+
+			" Queries are authenticated and limited like HTTP queries. Leave empty to disable the gRPC server.")
 	flag.StringVar(&cfg.server.listenInternal, "web.internal.listen", ":8081",
 		"The address on which the internal server listens.")
+	flag.StringVar(&rawExemptPaths, "web.exempt-paths", "",
+		"A comma-separated list of paths of the public API that skip authentication, authorization, rate limiting and access logging, "+
+			"e.g. /api/metrics/v1/public/api/v1/rules. Requests to them are served by their routes without credentials. Paths must match exactly.")
 	flag.StringVar(&cfg.server.healthcheckURL, "web.healthchecks.url", "http://localhost:8080",
 		"The URL against which to run healthchecks.")
+	flag.DurationVar(&cfg.server.retryAfter, "web.retry-after", 5*time.Second,
+		"The time clients are asked to wait in the Retry-After header of 503 Service Unavailable responses.")
+	flag.StringVar(&rawRetryAfterCauses, "web.retry-after.causes", "",
+		"A comma-separated list of cause=duration pairs overriding --web.retry-after per cause of 503 responses,"+
+			" e.g. memory=30s. Causes are limit, shed, memory, buffer and upstream.")
+	flag.IntVar(&cfg.server.maxInflightRequests, "web.max-inflight-requests", 0,
+		"The maximum number of requests the public server serves concurrently."+
+			" Further requests are rejected with 503 Service Unavailable. Set to 0 to disable the limit.")
+	flag.IntVar(&cfg.server.tenantMaxInflight, "web.tenant-max-inflight-requests", 0,
+		"The maximum number of requests of a single tenant served concurrently, unless the tenants configuration sets"+
+			" maxInflightRequests for the tenant. Further requests are rejected with 429 Too Many Requests. Set to 0 to disable the limit.")
+	flag.Float64Var(&cfg.server.loadSheddingThreshold, "web.load-shedding.threshold", 0,
+		"The share of --web.max-inflight-requests, between 0 and 1, above which low priority requests are shed,"+
+			" e.g. range queries over long ranges. Set to 0 to disable load shedding.")
+	flag.IntVar(&cfg.server.admissionQueueLength, "web.admission-queue.max-length", 0,
+		"The maximum number of requests beyond --web.max-inflight-requests that wait in a FIFO queue to be served,"+
+			" so that brief bursts are not rejected. Further requests are rejected with 503 Service Unavailable. Set to 0 to disable the queue.")
+	flag.DurationVar(&cfg.server.admissionQueueMaxWait, "web.admission-queue.max-wait", time.Second,
+		"The maximum time requests wait in the admission queue, after which they are rejected with 503 Service Unavailable.")
+	flag.IntVar(&cfg.server.tenantQueueLength, "web.tenant-admission-queue.max-length", 0,
+		"The maximum number of requests of each tenant beyond its concurrency limit, see --web.tenant-max-inflight-requests,"+
+			" that wait in a FIFO queue to be served. Further requests are rejected with 429 Too Many Requests. Set to 0 to disable the queue.")
+	flag.DurationVar(&cfg.server.tenantQueueMaxWait, "web.tenant-admission-queue.max-wait", time.Second,
+		"The maximum time requests wait in the admission queue of their tenant, after which they are rejected with 429 Too Many Requests.")
+	flag.Uint64Var(&cfg.server.heapSheddingThreshold, "web.load-shedding.heap-threshold-bytes", 0,
+		"The heap usage in bytes, read after every garbage collection, above which all requests are rejected with 503 Service Unavailable until it drops again."+
+			" Set to 0 to disable shedding on memory pressure.")
+	flag.StringVar(&cfg.server.clientTimeoutHeader, "web.client-timeout-header", "",
+		"The name of a request header, e.g. X-Query-Timeout, in which clients can set the timeout of their requests. "+
+			"The timeout is passed to upstreams as the timeout parameter of queries. Disabled if empty.")
+	flag.DurationVar(&cfg.server.clientTimeoutMax, "web.client-timeout-max", 2*time.Minute,
+		"The maximum timeout clients can set with --web.client-timeout-header. Larger timeouts are capped.")
+	flag.StringVar(&cfg.server.metricsLabelHeader, "web.metrics-label.header", "",
+		"The name of a request header, e.g. X-Team, whose value is added as a label to the HTTP request metrics. Disabled if empty.")
+	flag.StringVar(&cfg.server.metricsLabelName, "web.metrics-label.name", "team",
+		"The name of the label set from --web.metrics-label.header.")
+	flag.StringVar(&rawMetricsLabelValues, "web.metrics-label.values", "",
+		"A comma-separated list of allowed values of --web.metrics-label.header. Other values are recorded as \"other\".")
+	flag.StringVar(&rawMetricsSizeBuckets, "web.metrics.size-buckets", "",
+		"A comma-separated list of bucket boundaries in bytes of the request and response size histograms,"+
+			" e.g. exponential buckets from 256B to 64MiB for remote write payloads."+
+			" Setting it records the request size as a histogram instead of a summary."+
+			" If omitted, the request size is a summary and the response size histogram has buckets from 100B to 1GB.")
+	flag.StringVar(&rawStatusRemap, "web.status-remap", "",
+		"A comma-separated list of from=to pairs of status codes. Responses with a listed status code are sent with the "+
+			"status code it maps to instead, e.g. 422=400. The response bodies are not modified.")
+	flag.DurationVar(&cfg.server.shutdownRequestTimeout, "web.shutdown.request-timeout", gracePeriod,
+		"The time active requests are given to complete when shutting down.")
+	flag.DurationVar(&cfg.server.shutdownStreamTimeout, "web.shutdown.stream-timeout", gracePeriod,
+		"The time, from the start of the shutdown, long-running streams like log tails are given to complete. "+
+			"Buffered writes, see --metrics.write.buffer.max-bytes, are replayed within what is left of it. "+
+			"Must not be shorter than --web.shutdown.request-timeout.")
+	flag.BoolVar(&cfg.server.serverTiming, "web.server-timing", false,
+		"Report the duration of the request to the upstream, of stale cache lookups and the total duration of read requests "+
+			"in the Server-Timing response header, e.g. for the network panel of browsers. "+
+			"Requests sending the token of --debug.request-header get the durations of the middleware stages reported too.")
+	flag.BoolVar(&cfg.server.middlewareTiming, "web.middleware-timing", false,
+		"Observe the time requests spend in each middleware stage, e.g. authentication, authorization, the concurrency limit or the proxy to the upstream, "+
+			"in a histogram labeled by stage to find where latency is introduced. This has overhead, so it is meant for diagnosing latency.")
+	flag.DurationVar(&cfg.server.idleExit, "web.idle-exit", 0,
+		"Gracefully shut down if no request was received for the given duration, e.g. for ephemeral task runners. "+
+			"Requests to the internal server do not count. Set to 0 to never exit when idle.")
+	flag.DurationVar(&cfg.server.activeTenantsWindow, "web.active-tenants-window", time.Hour,
+		"The window within which tenants that sent requests count as active in the http_active_tenants metric.")
+	flag.IntVar(&cfg.server.maxURILength, "web.max-uri-length", 0,
+		"The maximum length in bytes of the request URI, i.e. path and query string, of requests. "+
+			"Longer requests are rejected with 414 URI Too Long before they are proxied. Set to 0 to disable the limit.")
+	flag.Int64Var(&cfg.server.writeMaxBodyBytes, "web.write-max-body-bytes", 0,
+		"The maximum size in bytes of the bodies of write requests. Larger requests are rejected before their body is read,"+
+			" with 417 Expectation Failed if they expect 100 Continue. Set to 0 to disable the limit.")
+	flag.Int64Var(&cfg.server.writeMaxDecompressedBytes, "web.write-max-decompressed-bytes", 0,
+		"The maximum size in bytes that the snappy-compressed bodies of write requests may decompress to."+
+			" Larger requests are rejected with 400 without being decompressed. Set to 0 to disable the limit.")
+	flag.DurationVar(&cfg.server.writeBodyReadTimeout, "web.write-body-read-timeout", 0,
+		"The maximum duration for reading the request body of write requests before they fail with 408. 0 disables the timeout.")
+	flag.StringVar(&cfg.server.writeIdempotencyHeader, "web.write-idempotency.header", "",
+		"The name of the header carrying a client-provided idempotency key of write requests, e.g. Idempotency-Key."+
+			" Requests repeating the key of a successful request within the TTL get its response without being written again."+
+			" Leave empty to disable deduplication.")
+	flag.DurationVar(&cfg.server.writeIdempotencyTTL, "web.write-idempotency.ttl", 5*time.Minute,
+		"The duration for which the responses to write requests with an idempotency key are replayed to duplicates.")
+	flag.DurationVar(&cfg.server.warmup, "web.healthchecks.warmup", 0,
+		"The period after startup during which the readiness check fails, giving upstream connections time to warm up."+
+			" Set to 0 to report readiness immediately.")
 	flag.StringVar(&rawLogsTailEndpoint, "logs.tail.endpoint", "",
 		"The endpoint against which to make tail read requests for logs.")
 	flag.StringVar(&rawLogsReadEndpoint, "logs.read.endpoint", "",
@@ -561,8 +1479,138 @@ func parseFlags() (config, error) {
 		"The endpoint against which to send read requests for metrics. It used as a fallback to 'query.endpoint' and 'query-range.endpoint'.")
 	flag.StringVar(&rawMetricsWriteEndpoint, "metrics.write.endpoint", "",
 		"The endpoint against which to make write requests for metrics.")
+	flag.StringVar(&rawMetricsQueryFallbackEndpoint, "metrics.query.fallback-endpoint", "",
+		"The endpoint against which to send metrics queries again once if the read endpoint answers them with one of"+
+			" the status codes in --metrics.query.fallback-status-codes, e.g. a more powerful querier. Leave empty to disable the fallback.")
+	flag.StringVar(&rawMetricsQueryFallbackCodes, "metrics.query.fallback-status-codes", "422",
+		"Comma-separated list of status codes of the read endpoint for which metrics queries are sent to the fallback endpoint.")
 	flag.StringVar(&cfg.metrics.tenantHeader, "metrics.tenant-header", "THANOS-TENANT",
 		"The name of the HTTP header containing the tenant ID to forward to the metrics upstreams.")
+	flag.DurationVar(&cfg.metrics.defaultMaxSourceResolution, "metrics.default-max-source-resolution", 0,
+		"The max_source_resolution parameter to add to metrics queries that do not specify one,"+
+			" so that queries over long ranges use downsampled data. Set to 0 to leave queries unmodified.")
+	flag.DurationVar(&cfg.metrics.defaultLookbackDelta, "metrics.default-lookback-delta", 0,
+		"The lookback_delta parameter to add to metrics queries that do not specify one. Set to 0 to leave queries unmodified.")
+	flag.DurationVar(&cfg.metrics.maxLookbackDelta, "metrics.query.max-lookback-delta", 0,
+		"The maximum lookback_delta metrics queries may ask for. Larger values are capped and answered with a Warning header. "+
+			"Set to 0 to not limit the lookback delta.")
+	flag.DurationVar(&cfg.metrics.queryMaxTimeout, "metrics.query.max-timeout", 0,
+		"The maximum timeout metrics queries may ask for in their timeout parameter, which also bounds the request to the upstream. "+
+			"Larger timeouts are capped. 0 leaves the timeout parameter to the upstream.")
+	flag.DurationVar(&cfg.metrics.queryUpstreamTimeout, "metrics.query.upstream-timeout", 0,
+		"The timeout parameter always sent with metrics queries, so that the upstream bounds their evaluation itself. "+
+			"Shorter timeouts asked for by clients are kept. It does not change how long observatorium waits for the upstream. 0 disables it.")
+	flag.StringVar(&cfg.metrics.statsdAddress, "metrics.statsd.address", "",
+		"The host:port of a StatsD endpoint to which the number of requests and errors and latency percentiles are pushed over UDP, "+
+			"in addition to being exposed to Prometheus. Leave blank to disable.")
+	flag.DurationVar(&cfg.metrics.statsdInterval, "metrics.statsd.interval", 10*time.Second,
+		"The interval at which metrics are pushed to --metrics.statsd.address.")
+	flag.StringVar(&cfg.metrics.statsdPrefix, "metrics.statsd.prefix", "observatorium",
+		"The prefix of the names of the metrics pushed to --metrics.statsd.address.")
+	flag.StringVar(&cfg.metrics.namespace, "metrics.namespace", "",
+		"A namespace prefixed to the names of observatorium's own metrics, e.g. myorg_observatorium. "+
+			"The Go, process and version metrics keep their names.")
+	flag.IntVar(&cfg.metrics.queryMaxSelectors, "metrics.query.max-selectors", 0,
+		"The maximum number of vector selectors in a metrics query. Queries with more are rejected. 0 disables the limit.")
+	flag.IntVar(&cfg.metrics.queryMaxMatchers, "metrics.query.max-matchers", 0,
+		"The maximum number of label matchers, including metric names, in a metrics query. Queries with more are rejected. "+
+			"0 disables the limit.")
+	flag.BoolVar(&cfg.metrics.queryValidation, "metrics.query.validate-params", false,
+		"Reject metrics queries missing required parameters, e.g. query, with 400 Bad Request instead of passing them to the upstream.")
+	flag.Int64Var(&cfg.metrics.queryMaxResponse, "metrics.query.max-response-bytes", 0,
+		"The maximum size in bytes of metrics query responses. Larger responses are aborted and fail with 413. 0 disables the limit.")
+	flag.BoolVar(&cfg.metrics.queryCoalescing, "metrics.query.coalesce", false,
+		"Send only one of identical metrics queries in flight at the same time to the upstream and share its successful response.")
+	flag.DurationVar(&cfg.metrics.serveStaleMaxStaleness, "metrics.serve-stale.max-staleness", 0,
+		"The maximum age of the last successful response to a metrics query that is served, with a Warning header, "+
+			"when the upstream fails. 0 disables serving stale responses.")
+	flag.IntVar(&cfg.metrics.writeBufferMaxBytes, "metrics.write.buffer.max-bytes", 0,
+		"The maximum size in bytes of write requests buffered while the metrics write upstream is unavailable."+
+			" Buffered requests are answered with 202 Accepted and replayed once the upstream recovers."+
+			" What happens when the buffer is full is set by --metrics.write.buffer.full-policy. Set to 0 to disable buffering.")
+	flag.StringVar(&cfg.metrics.writeBufferFullPolicy, "metrics.write.buffer.full-policy", server.WriteBufferFullDropOldest,
+		"What happens to write requests that do not fit into the full write buffer: "+
+			"reject answers them with 503 Service Unavailable, drop-oldest drops the oldest buffered requests to make room.")
+	flag.StringVar(&cfg.metrics.writeBufferDir, "metrics.write.buffer.dir", "",
+		"Directory in which to persist buffered write requests, so that they survive restarts."+
+			" If omitted, buffered write requests are kept in memory only. Client credentials of the requests are not persisted.")
+	flag.BoolVar(&cfg.startup.requireUpstreams, "startup.require-upstreams", false,
+		"Exit with an error at startup if any of the configured upstream endpoints cannot be connected to.")
+	flag.DurationVar(&cfg.oidc.jwksRefreshInterval, "oidc.jwks-refresh-interval", authentication.DefaultJWKSRefreshInterval,
+		"The interval after which the cached signing keys of OIDC issuers are refreshed. "+
+			"Tokens signed with an unknown key trigger a refresh before they are rejected.")
+	flag.IntVar(&cfg.proxy.bufferCount, "proxy.buffer-count", proxy.DefaultBufferCount,
+		"The number of buffers each upstream proxy pre-allocates for copying response bodies."+
+			" Set to 0 to disable pooling and allocate a buffer per request, trading CPU for a lower baseline memory usage.")
+	flag.DurationVar(&cfg.proxy.dialTimeout, "proxy.dial-timeout", 0,
+		"The maximum time to wait for a connection to an upstream, including resolving its host, after which requests fail "+
+			"with 502 Bad Gateway. It does not limit how long upstreams may take to answer. If omitted, the read and write timeouts are used.")
+	flag.Int64Var(&cfg.proxy.maxResponseHeaderBytes, "proxy.max-response-header-bytes", 0,
+		"The maximum size of the response headers accepted from upstreams. Responses with larger headers are answered with "+
+			"502 Bad Gateway. If omitted, the default of 10MiB is used.")
+	flag.BoolVar(&cfg.proxy.http2, "proxy.http2", false,
+		"Proxy requests to upstreams over HTTP/2 to multiplex them on fewer connections. Upstreams with https URLs are spoken to "+
+			"with h2, falling back to HTTP/1.1, and upstreams with http URLs with h2c, which they must support.")
+	flag.DurationVar(&cfg.proxy.maxConnAge, "proxy.max-conn-age", 0,
+		"The maximum age of connections to upstreams, after which they are closed once their next response was read, "+
+			"so that connections are rebalanced across upstream instances, e.g. after a rollout. 0 keeps connections while they are usable.")
+	flag.IntVar(&cfg.proxy.retries, "proxy.retries", 0,
+		"The number of times requests are retried if the connection to the upstream fails or it answers with a retryable status code.")
+	flag.StringVar(&rawProxyRetryStatusCodes, "proxy.retry-status-codes", "502,503,504",
+		"A comma-separated list of upstream status codes that are retried if --proxy.retries is set.")
+	flag.IntVar(&cfg.proxy.retryMaxBodyBytes, "proxy.retry-max-body-bytes", proxy.DefaultRetryMaxBodyBytes,
+		"The size up to which request bodies are buffered in memory to be retried if --proxy.retries is set. "+
+			"Requests with larger bodies are not retried.")
+	flag.BoolVar(&cfg.proxy.retryNetworkErrors, "proxy.retry-on-network-errors", false,
+		"Retry requests if --proxy.retries is set only if the connection to the upstream was refused or reset, e.g. by a load balancer, "+
+			"rather than on any failure to connect. Timeouts are never retried. Requests whose connection was reset may reach the upstream twice.")
+	flag.StringVar(&rawProxyResponseHeaderAllowlist, "proxy.response-header-allowlist", "",
+		"A comma-separated list of upstream response headers forwarded to clients, all others are removed. "+
+			"Standard headers such as Content-Type and Content-Encoding are always forwarded. If omitted, all headers are forwarded.")
+	flag.IntVar(&cfg.proxy.readBufferBytes, "proxy.read-buffer-bytes", 0,
+		"The size of the buffer used to read from upstream connections. Set to 0 to use the default of 4KiB.")
+	flag.IntVar(&cfg.proxy.writeBufferBytes, "proxy.write-buffer-bytes", 0,
+		"The size of the buffer used to write to upstream connections. Set to 0 to use the default of 4KiB.")
+	flag.StringVar(&rawProxyStripHeaders, "proxy.strip-headers", "",
+		"A comma-separated list of request headers removed before requests are forwarded to the upstreams, e.g. Authorization,Cookie.")
+	flag.StringVar(&rawProxySingletonHeaders, "proxy.singleton-response-headers", strings.Join(proxy.DefaultSingletonResponseHeaders, ","),
+		"A comma-separated list of upstream response headers that may occur at most once."+
+			" Duplicates are collapsed to their first value and logged as a warning. Set to an empty string to forward duplicates as they are.")
+	flag.DurationVar(&cfg.proxy.errorLogWindow, "proxy.error-log.window", 0,
+		"The window in which identical errors proxying requests to the upstreams are collapsed in the logs. "+
+			"The first occurrence is logged and the number of suppressed repetitions once the window has passed. Set to 0 to log every error.")
+	flag.IntVar(&cfg.proxy.errorLogSampleRate, "proxy.error-log.sample-rate", 0,
+		"Additionally log every n-th repetition of an error within --proxy.error-log.window. Set to 0 to only log the first occurrence.")
+	flag.IntVar(&cfg.proxy.readDSCP, "proxy.read-dscp", 0,
+		"The DSCP value, between 0 and 63, marking the packets of connections to the read upstreams, e.g. 46 to prioritize queries. "+
+			"Supported on Linux, macOS and the BSDs only, on other platforms setting it fails at startup. Set to 0 to keep the system default.")
+	flag.IntVar(&cfg.proxy.writeDSCP, "proxy.write-dscp", 0,
+		"The DSCP value, between 0 and 63, marking the packets of connections to the write upstreams, e.g. 8 for bulk writes. "+
+			"Supported on Linux, macOS and the BSDs only, on other platforms setting it fails at startup. Set to 0 to keep the system default. "+
+			"Must equal --proxy.read-dscp if --metrics.read.endpoint and --metrics.write.endpoint are identical.")
+	flag.StringVar(&rawProxyReadResponseMode, "proxy.read-response-mode", "default",
+		"How responses of the read upstreams are passed on to clients: default, buffered to read them fully into memory "+
+			"before sending them, or streamed to flush every chunk as it arrives.")
+	flag.StringVar(&rawProxyWriteResponseMode, "proxy.write-response-mode", "default",
+		"How responses of the write upstreams are passed on to clients: default, buffered or streamed. See --proxy.read-response-mode.")
+	flag.StringVar(&rawProxyUpstreamHeaders, "proxy.upstream-headers", "",
+		"A comma-separated list of name=value pairs of headers set on all requests forwarded to the upstreams, "+
+			"e.g. X-Scope=all. Values must not contain commas.")
+	flag.StringVar(&rawProxyQueryUpstreamHeaders, "proxy.query-upstream-headers", "",
+		"A comma-separated list of name=value pairs of headers set on requests forwarded to the read upstreams. "+
+			"They take precedence over --proxy.upstream-headers.")
+	flag.StringVar(&rawProxyWriteUpstreamHeaders, "proxy.write-upstream-headers", "",
+		"A comma-separated list of name=value pairs of headers set on requests forwarded to the write upstreams. "+
+			"They take precedence over --proxy.upstream-headers.")
+	flag.StringVar(&rawProxyCanaryHeader, "proxy.canary-header", "",
+		"A name=value pair of a header set on the share --proxy.canary-fraction of requests forwarded to the upstreams,"+
+			" e.g. X-Canary=true, for upstreams to route them to experimental code paths. Leave empty to disable it.")
+	flag.Float64Var(&cfg.proxy.canaryFraction, "proxy.canary-fraction", 0,
+		"The share of requests, between 0 and 1, on which the header of --proxy.canary-header is set."+
+			" Requests are selected by their request ID, so that retries with the same X-Request-Id are selected consistently.")
+	flag.StringVar(&rawProxyClaimHeaders, "proxy.claim-headers", "",
+		"A comma-separated list of claim=header pairs. The claims of authenticated OIDC tokens are forwarded to the upstreams "+
+			"in the given headers, e.g. sub=X-Auth-Subject. Client-provided values of these headers are removed.")
 	flag.StringVar(&cfg.tls.serverCertFile, "tls.server.cert-file", "",
 		"File containing the default x509 Certificate for HTTPS. Leave blank to disable TLS.")
 	flag.StringVar(&cfg.tls.serverKeyFile, "tls.server.key-file", "",
@@ -573,8 +1621,15 @@ func parseFlags() (config, error) {
 	flag.StringVar(&cfg.tls.healthchecksServerName, "tls.healthchecks.server-name", "",
 		"Server name is used to verify the hostname of the certificates returned by the server."+
 			" If no server name is specified, the server name will be inferred from the healthcheck URL.")
+	flag.StringVar(&cfg.tls.metricsServerName, "tls.metrics.server-name", "",
+		"Server name sent via SNI to and verified against the certificates of the metrics upstreams."+
+			" If no server name is specified, it is inferred from the upstream URLs.")
+	flag.StringVar(&cfg.tls.logsServerName, "tls.logs.server-name", "",
+		"Server name sent via SNI to and verified against the certificates of the logs upstreams."+
+			" If no server name is specified, it is inferred from the upstream URLs.")
 	flag.StringVar(&cfg.tls.minVersion, "tls.min-version", "VersionTLS13",
-		"Minimum TLS version supported. Value must match version names from https://golang.org/pkg/crypto/tls/#pkg-constants.")
+		"Minimum TLS version supported. Value must match version names from https://golang.org/pkg/crypto/tls/#pkg-constants,"+
+			" e.g. 'VersionTLS12', or their short form, e.g. 'TLS1.2'.")
 	flag.StringVar(&rawTLSCipherSuites, "tls.cipher-suites", "",
 		"Comma-separated list of cipher suites for the server."+
 			" Values are from tls package constants (https://golang.org/pkg/crypto/tls/#pkg-constants)."+
@@ -582,7 +1637,22 @@ func parseFlags() (config, error) {
 			" Note that TLS 1.3 ciphersuites are not configurable.")
 	flag.DurationVar(&cfg.tls.reloadInterval, "tls.reload-interval", time.Minute,
 		"The interval at which to watch for TLS certificate changes.")
-	flag.Parse()
+	flag.StringVar(&rawTLSClientAllowedURISANs, "tls.client.allowed-uri-sans", "",
+		"Comma-separated list of URI SANs, e.g. SPIFFE IDs, of which client certificates must contain at least one."+
+			" Other client certificates are rejected during the TLS handshake. Clients presenting no certificate are not affected."+
+			" Leave blank to accept any client certificate.")
+	flag.StringVar(&rawTLSClientTenantFrom, "tls.client.tenant-from", "",
+		"Set the tenant header sent to upstreams to the common-name or the first uri-san of the client certificate requests "+
+			"were authenticated with via mTLS, instead of the ID of the tenant. Other requests are rejected with 401 Unauthorized."+
+			" Requests whose certificate names neither the name nor the ID of their tenant are rejected with 403 Forbidden.")
+
+	args, err := expandArgsFiles(os.Args[1:])
+	if err != nil {
+		return cfg, err
+	}
+
+	// flag.CommandLine exits on errors, like flag.Parse.
+	_ = flag.CommandLine.Parse(args)
 
 	metricsReadEndpoint, err := url.ParseRequestURI(rawMetricsReadEndpoint)
 	if err != nil {
@@ -598,6 +1668,30 @@ func parseFlags() (config, error) {
 
 	cfg.metrics.writeEndpoint = metricsWriteEndpoint
 
+	if rawMetricsQueryFallbackEndpoint != "" {
+		cfg.metrics.queryFallbackEndpoint, err = url.ParseRequestURI(rawMetricsQueryFallbackEndpoint)
+		if err != nil {
+			return cfg, fmt.Errorf("--metrics.query.fallback-endpoint %q is invalid: %w", rawMetricsQueryFallbackEndpoint, err)
+		}
+
+		for _, raw := range strings.Split(rawMetricsQueryFallbackCodes, ",") {
+			if raw = strings.TrimSpace(raw); raw == "" {
+				continue
+			}
+
+			code, err := strconv.Atoi(raw)
+			if err != nil || code < 100 || code > 599 {
+				return cfg, fmt.Errorf("--metrics.query.fallback-status-codes has an invalid status code: %q", raw)
+			}
+
+			cfg.metrics.queryFallbackStatusCodes = append(cfg.metrics.queryFallbackStatusCodes, code)
+		}
+
+		if len(cfg.metrics.queryFallbackStatusCodes) == 0 {
+			return cfg, fmt.Errorf("--metrics.query.fallback-status-codes must not be empty if a fallback endpoint is set")
+		}
+	}
+
 	if rawLogsReadEndpoint != "" {
 		cfg.logs.enabled = true
 
@@ -631,13 +1725,311 @@ func parseFlags() (config, error) {
 		cfg.logs.writeEndpoint = logsWriteEndpoint
 	}
 
+	if cfg.metrics.statsdAddress != "" && cfg.metrics.statsdInterval <= 0 {
+		return cfg, fmt.Errorf("--metrics.statsd.interval %s must be positive", cfg.metrics.statsdInterval)
+	}
+
+	if cfg.debug.requestHeader != "" && cfg.debug.requestTokenFile == "" {
+		return cfg, fmt.Errorf("--debug.request-header requires --debug.request-token-file")
+	}
+
+	if cfg.server.shutdownStreamTimeout < cfg.server.shutdownRequestTimeout {
+		return cfg, fmt.Errorf("--web.shutdown.stream-timeout %s must not be shorter than --web.shutdown.request-timeout %s",
+			cfg.server.shutdownStreamTimeout, cfg.server.shutdownRequestTimeout)
+	}
+
+	if cfg.logSampleRate < 0 || cfg.logSampleRate > 1 {
+		return cfg, fmt.Errorf("--log.access.sample-rate %v must be between 0 and 1", cfg.logSampleRate)
+	}
+
+	if cfg.sampleRate < 0 || cfg.sampleRate > 1 {
+		return cfg, fmt.Errorf("--sampling.rate %v must be between 0 and 1", cfg.sampleRate)
+	}
+
+	// The deprecated access log sample rate applies unless the sampling rate is set explicitly, even to 1.
+	sampleRateSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "sampling.rate" {
+			sampleRateSet = true
+		}
+	})
+
+	if !sampleRateSet {
+		cfg.sampleRate = cfg.logSampleRate
+	}
+
+	if cfg.server.admissionQueueLength > 0 && cfg.server.admissionQueueMaxWait <= 0 {
+		return cfg, fmt.Errorf("--web.admission-queue.max-wait %s must be positive", cfg.server.admissionQueueMaxWait)
+	}
+
+	if cfg.server.tenantQueueLength > 0 && cfg.server.tenantQueueMaxWait <= 0 {
+		return cfg, fmt.Errorf("--web.tenant-admission-queue.max-wait %s must be positive", cfg.server.tenantQueueMaxWait)
+	}
+
+	if cfg.server.writeIdempotencyHeader != "" && cfg.server.writeIdempotencyTTL <= 0 {
+		return cfg, fmt.Errorf("--web.write-idempotency.ttl %s must be positive", cfg.server.writeIdempotencyTTL)
+	}
+
+	if cfg.server.loadSheddingThreshold < 0 || cfg.server.loadSheddingThreshold > 1 {
+		return cfg, fmt.Errorf("--web.load-shedding.threshold %v must be between 0 and 1", cfg.server.loadSheddingThreshold)
+	}
+
 	if rawTLSCipherSuites != "" {
 		cfg.tls.cipherSuites = strings.Split(rawTLSCipherSuites, ",")
 	}
 
+	switch rawTLSClientTenantFrom {
+	case "":
+	case "common-name":
+		cfg.tls.clientTenantFrom = server.TenantFromCommonName
+	case "uri-san":
+		cfg.tls.clientTenantFrom = server.TenantFromURISAN
+	default:
+		return cfg, fmt.Errorf("--tls.client.tenant-from %q must be common-name or uri-san", rawTLSClientTenantFrom)
+	}
+
+	if rawTLSClientAllowedURISANs != "" {
+		cfg.tls.clientAllowedURISANs = strings.Split(rawTLSClientAllowedURISANs, ",")
+	}
+
+	if cfg.server.http2MaxConcurrentStreams > math.MaxUint32 {
+		return cfg, fmt.Errorf("--web.http2.max-concurrent-streams %d is too large", cfg.server.http2MaxConcurrentStreams)
+	}
+
+	if cfg.server.http2MaxReadFrameSize < 16<<10 || cfg.server.http2MaxReadFrameSize > 16<<20-1 {
+		return cfg, fmt.Errorf("--web.http2.max-read-frame-size %d must be between 16KiB and 16MiB", cfg.server.http2MaxReadFrameSize)
+	}
+
+	if cfg.metrics.maxLookbackDelta > 0 && cfg.metrics.defaultLookbackDelta > cfg.metrics.maxLookbackDelta {
+		return cfg, fmt.Errorf("--metrics.default-lookback-delta %s must not be larger than --metrics.query.max-lookback-delta %s",
+			cfg.metrics.defaultLookbackDelta, cfg.metrics.maxLookbackDelta)
+	}
+
+	if cfg.proxy.readDSCP < 0 || cfg.proxy.readDSCP > 63 {
+		return cfg, fmt.Errorf("--proxy.read-dscp %d must be between 0 and 63", cfg.proxy.readDSCP)
+	}
+
+	if cfg.proxy.writeDSCP < 0 || cfg.proxy.writeDSCP > 63 {
+		return cfg, fmt.Errorf("--proxy.write-dscp %d must be between 0 and 63", cfg.proxy.writeDSCP)
+	}
+
+	if (cfg.proxy.readDSCP > 0 || cfg.proxy.writeDSCP > 0) && !proxy.DSCPSupported {
+		return cfg, fmt.Errorf("--proxy.read-dscp and --proxy.write-dscp are not supported on %s", runtime.GOOS)
+	}
+
+	// The metrics read and write proxies share one transport if their endpoints are identical, see metricsv1.NewHandler.
+	if cfg.proxy.readDSCP != cfg.proxy.writeDSCP && cfg.metrics.readEndpoint.String() == cfg.metrics.writeEndpoint.String() {
+		return cfg, fmt.Errorf("--proxy.read-dscp %d and --proxy.write-dscp %d must be equal "+
+			"as --metrics.read.endpoint and --metrics.write.endpoint are identical and share connections",
+			cfg.proxy.readDSCP, cfg.proxy.writeDSCP)
+	}
+
+	for _, m := range []struct {
+		flag  string
+		value string
+		mode  *proxy.ResponseMode
+	}{
+		{flag: "proxy.read-response-mode", value: rawProxyReadResponseMode, mode: &cfg.proxy.readResponseMode},
+		{flag: "proxy.write-response-mode", value: rawProxyWriteResponseMode, mode: &cfg.proxy.writeResponseMode},
+	} {
+		switch m.value {
+		case "default":
+			*m.mode = proxy.ResponseModeDefault
+		case "buffered":
+			*m.mode = proxy.ResponseModeBuffered
+		case "streamed":
+			*m.mode = proxy.ResponseModeStreamed
+		default:
+			return cfg, fmt.Errorf("--%s %q must be default, buffered or streamed", m.flag, m.value)
+		}
+	}
+
+	cfg.server.retryAfterCauses = map[string]time.Duration{}
+
+	if rawRetryAfterCauses != "" {
+		for _, pair := range strings.Split(rawRetryAfterCauses, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return cfg, fmt.Errorf("--web.retry-after.causes is invalid, expected cause=duration pairs: %q", pair)
+			}
+
+			switch parts[0] {
+			case server.UnavailableCauseLimit, server.UnavailableCauseShed, server.UnavailableCauseMemory,
+				server.UnavailableCauseBuffer, server.UnavailableCauseUpstream:
+			default:
+				return cfg, fmt.Errorf("--web.retry-after.causes has an unknown cause: %q", parts[0])
+			}
+
+			d, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return cfg, fmt.Errorf("--web.retry-after.causes has an invalid duration: %q", parts[1])
+			}
+
+			cfg.server.retryAfterCauses[parts[0]] = d
+		}
+	}
+
+	if rawExemptPaths != "" {
+		cfg.server.exemptPaths = strings.Split(rawExemptPaths, ",")
+	}
+
+	if rawMetricsLabelValues != "" {
+		cfg.server.metricsLabelValues = strings.Split(rawMetricsLabelValues, ",")
+	}
+
+	if rawMetricsSizeBuckets != "" {
+		for _, raw := range strings.Split(rawMetricsSizeBuckets, ",") {
+			b, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+			if err != nil {
+				return cfg, fmt.Errorf("--web.metrics.size-buckets has an invalid bucket: %q", raw)
+			}
+
+			if n := len(cfg.server.metricsSizeBuckets); n > 0 && b <= cfg.server.metricsSizeBuckets[n-1] {
+				return cfg, fmt.Errorf("--web.metrics.size-buckets must be in increasing order: %q", raw)
+			}
+
+			cfg.server.metricsSizeBuckets = append(cfg.server.metricsSizeBuckets, b)
+		}
+	}
+
+	cfg.server.statusRemap = map[int]int{}
+
+	if rawStatusRemap != "" {
+		for _, pair := range strings.Split(rawStatusRemap, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return cfg, fmt.Errorf("--web.status-remap is invalid, expected from=to pairs: %q", pair)
+			}
+
+			from, err := strconv.Atoi(parts[0])
+			if err != nil || from < 100 || from > 599 {
+				return cfg, fmt.Errorf("--web.status-remap has an invalid status code: %q", parts[0])
+			}
+
+			to, err := strconv.Atoi(parts[1])
+			if err != nil || to < 100 || to > 599 {
+				return cfg, fmt.Errorf("--web.status-remap has an invalid status code: %q", parts[1])
+			}
+
+			cfg.server.statusRemap[from] = to
+		}
+	}
+
+	for _, raw := range strings.Split(rawProxyRetryStatusCodes, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+
+		code, err := strconv.Atoi(raw)
+		if err != nil || code < 100 || code > 599 {
+			return cfg, fmt.Errorf("--proxy.retry-status-codes has an invalid status code: %q", raw)
+		}
+
+		cfg.proxy.retryStatusCodes = append(cfg.proxy.retryStatusCodes, code)
+	}
+
+	for _, h := range strings.Split(rawProxyStripHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			cfg.proxy.stripHeaders = append(cfg.proxy.stripHeaders, h)
+		}
+	}
+
+	for _, h := range strings.Split(rawProxySingletonHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			cfg.proxy.singletonResponseHeaders = append(cfg.proxy.singletonResponseHeaders, h)
+		}
+	}
+
+	for _, h := range strings.Split(rawProxyResponseHeaderAllowlist, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			cfg.proxy.responseHeaderAllowlist = append(cfg.proxy.responseHeaderAllowlist, h)
+		}
+	}
+
+	cfg.proxy.claimHeaders = map[string]string{}
+
+	if rawProxyClaimHeaders != "" {
+		for _, pair := range strings.Split(rawProxyClaimHeaders, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return cfg, fmt.Errorf("--proxy.claim-headers is invalid, expected claim=header pairs: %q", pair)
+			}
+
+			cfg.proxy.claimHeaders[parts[0]] = parts[1]
+		}
+	}
+
+	for _, h := range []struct {
+		flag string
+		raw  string
+		dst  *map[string]string
+	}{
+		{flag: "proxy.upstream-headers", raw: rawProxyUpstreamHeaders, dst: &cfg.proxy.upstreamHeaders},
+		{flag: "proxy.query-upstream-headers", raw: rawProxyQueryUpstreamHeaders, dst: &cfg.proxy.queryUpstreamHeaders},
+		{flag: "proxy.write-upstream-headers", raw: rawProxyWriteUpstreamHeaders, dst: &cfg.proxy.writeUpstreamHeaders},
+	} {
+		*h.dst = map[string]string{}
+
+		if h.raw == "" {
+			continue
+		}
+
+		for _, pair := range strings.Split(h.raw, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				// The pair is not part of the error, as header values may be secrets.
+				return cfg, fmt.Errorf("--%s is invalid, expected name=value pairs", h.flag)
+			}
+
+			(*h.dst)[strings.TrimSpace(parts[0])] = parts[1]
+		}
+	}
+
+	if rawProxyCanaryHeader != "" {
+		parts := strings.SplitN(rawProxyCanaryHeader, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return cfg, fmt.Errorf("--proxy.canary-header is invalid, expected a name=value pair: %q", rawProxyCanaryHeader)
+		}
+
+		cfg.proxy.canaryHeader, cfg.proxy.canaryValue = strings.TrimSpace(parts[0]), parts[1]
+	}
+
+	if cfg.proxy.canaryFraction < 0 || cfg.proxy.canaryFraction > 1 {
+		return cfg, fmt.Errorf("--proxy.canary-fraction %v must be between 0 and 1", cfg.proxy.canaryFraction)
+	}
+
 	return cfg, nil
 }
 
+// expandArgsFiles replaces arguments of the form @filename with the arguments read from the file, one per line.
+// Blank lines and lines starting with # are ignored.
+func expandArgsFiles(args []string) ([]string, error) {
+	expanded := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		f, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			return nil, fmt.Errorf("read arguments file: %w", err)
+		}
+
+		for _, line := range strings.Split(string(f), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			expanded = append(expanded, line)
+		}
+	}
+
+	return expanded, nil
+}
+
 func stripTenantPrefix(prefix string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tenant, ok := authentication.GetTenant(r.Context())
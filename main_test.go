@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckUpstreams(t *testing.T) {
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	parse := func(raw string) *url.URL {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return u
+	}
+
+	for _, tc := range []struct {
+		name     string
+		require  bool
+		read     string
+		write    string
+		expected bool
+	}{
+		{
+			name:    "reachable",
+			require: true,
+			read:    up.URL,
+			write:   up.URL,
+		},
+		{
+			name:     "unreachable",
+			require:  true,
+			read:     up.URL,
+			write:    down.URL,
+			expected: true,
+		},
+		{
+			name:  "unreachable but not required",
+			read:  up.URL,
+			write: down.URL,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg config
+			cfg.startup.requireUpstreams = tc.require
+			cfg.metrics.readEndpoint = parse(tc.read)
+			cfg.metrics.writeEndpoint = parse(tc.write)
+
+			err := checkUpstreams(cfg, time.Second)
+			if tc.expected && err == nil {
+				t.Error("expected an error for an unreachable upstream")
+			}
+
+			if !tc.expected && err != nil {
+				t.Errorf("expected no error; got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithMaxConnAge retires connections to the upstream once they are older than d, so that connections are
+// periodically re-established and rebalanced across upstream instances, e.g. after a rollout.
+// Instead of being cut off, an expired connection serves one more request, sent with Connection: close,
+// and is closed once its response was read. A value of zero keeps connections for as long as they are usable.
+func WithMaxConnAge(d time.Duration) Option {
+	return func(c *config) {
+		c.maxConnAge = d
+	}
+}
+
+// conns records when the connections to upstreams of proxies with a maximum connection age were established.
+// They are identified by their local and remote addresses, which are also known for TLS connections wrapping them.
+var conns = &connAges{created: map[string]time.Time{}}
+
+type connAges struct {
+	mtx     sync.Mutex
+	created map[string]time.Time
+}
+
+func connKey(c net.Conn) string {
+	return c.LocalAddr().String() + "->" + c.RemoteAddr().String()
+}
+
+// dial wraps the dial function to record when connections were established.
+func (a *connAges) dial(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &agedConn{Conn: conn, key: connKey(conn), ages: a}
+
+		a.mtx.Lock()
+		a.created[c.key] = time.Now()
+		a.mtx.Unlock()
+
+		return c, nil
+	}
+}
+
+// age returns the age of the connection or false if its establishment was not recorded.
+func (a *connAges) age(conn net.Conn) (time.Duration, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	created, ok := a.created[connKey(conn)]
+	if !ok {
+		return 0, false
+	}
+
+	return time.Since(created), true
+}
+
+// agedConn is a net.Conn forgetting when it was established once it is closed.
+type agedConn struct {
+	net.Conn
+	key  string
+	ages *connAges
+	once sync.Once
+}
+
+func (c *agedConn) Close() error {
+	c.once.Do(func() {
+		c.ages.mtx.Lock()
+		delete(c.ages.created, c.key)
+		c.ages.mtx.Unlock()
+	})
+
+	return c.Conn.Close()
+}
+
+// maxAgeTransport is a http.RoundTripper closing connections older than the maximum age after their next request.
+type maxAgeTransport struct {
+	next    http.RoundTripper
+	maxAge  time.Duration
+	retired prometheus.Counter
+}
+
+func newMaxAgeTransport(next http.RoundTripper, reg prometheus.Registerer, maxAge time.Duration) *maxAgeTransport {
+	retired := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_proxy_connections_retired_total",
+		Help: "Counter of connections to upstreams closed because they reached the maximum connection age.",
+	})
+
+	if reg != nil {
+		retired = registerOrGet(reg, retired).(prometheus.Counter)
+	}
+
+	return &maxAgeTransport{
+		next:    next,
+		maxAge:  maxAge,
+		retired: retired,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *maxAgeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// The request is copied, as round trippers must not modify it.
+	// The transport calls GotConn before sending it, so it is still sent with Connection: close.
+	var req *http.Request
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if age, ok := conns.age(info.Conn); ok && age >= t.maxAge && !req.Close {
+				req.Close = true
+				t.retired.Inc()
+			}
+		},
+	}
+
+	req = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+	return t.next.RoundTrip(req)
+}
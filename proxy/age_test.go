@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewMaxConnAge(t *testing.T) {
+	var conns, closing int64
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Close {
+			atomic.AddInt64(&closing, 1)
+		}
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(Middlewares(MiddlewareSetUpstream(u)), WithMaxConnAge(100*time.Millisecond))
+
+	send := func() {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	send()
+	send()
+
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Fatalf("expected connections younger than the maximum age to be reused; got %d connections", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	send()
+
+	if n := atomic.LoadInt64(&closing); n != 1 {
+		t.Errorf("expected the request on the expired connection to be sent with Connection: close; got %d such requests", n)
+	}
+
+	send()
+
+	if n := atomic.LoadInt64(&conns); n != 2 {
+		t.Errorf("expected the expired connection to be replaced; got %d connections", n)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dialer resolves upstream hosts itself so that DNS lookups can be instrumented separately from connecting.
+type dialer struct {
+	net.Dialer
+	resolver *net.Resolver
+
+	lookupDuration *prometheus.HistogramVec
+	lookupFailures *prometheus.CounterVec
+}
+
+func newDialer(reg prometheus.Registerer, base net.Dialer) *dialer {
+	d := &dialer{
+		Dialer:   base,
+		resolver: net.DefaultResolver,
+		lookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_proxy_dns_lookup_duration_seconds",
+			Help:    "Histogram of DNS lookup latencies for upstream hosts.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+		}, []string{"host"}),
+		lookupFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_proxy_dns_lookup_failures_total",
+			Help: "Counter of failed DNS lookups for upstream hosts.",
+		}, []string{"host"}),
+	}
+
+	// All proxies share the same collectors, the host label keeps them apart.
+	// Its cardinality is bounded by the number of configured upstreams.
+	d.lookupDuration = registerOrGet(reg, d.lookupDuration).(*prometheus.HistogramVec)
+	d.lookupFailures = registerOrGet(reg, d.lookupFailures).(*prometheus.CounterVec)
+
+	return d
+}
+
+// DialContext resolves the host of the address, recording the lookup's duration and failures,
+// and connects to the resolved addresses in turn until one succeeds.
+// The dialer's timeout covers both the lookup and connecting.
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+
+		defer cancel()
+	}
+
+	start := time.Now()
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	d.lookupDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		d.lookupFailures.WithLabelValues(host).Inc()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var firstErr error
+
+	for _, a := range addrs {
+		conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// registerOrGet registers the collector or returns the equal collector that is already registered.
+func registerOrGet(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+
+		panic(err)
+	}
+
+	return c
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDialerLookups(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	d := newDialer(reg, net.Dialer{})
+	// Names are resolved from the hosts file only, failing all lookups that need a DNS server.
+	d.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("no DNS server in tests")
+		},
+	}
+
+	for _, address := range []string{"localhost:" + port, l.Addr().String()} {
+		conn, err := d.DialContext(context.Background(), "tcp4", address)
+		if err != nil {
+			t.Fatalf("expected dialing %s to succeed; got %v", address, err)
+		}
+
+		conn.Close()
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp4", "upstream.invalid:80"); err == nil {
+		t.Fatal("expected dialing an unresolvable host to fail")
+	}
+
+	// IP addresses are not looked up.
+	if n := testutil.CollectAndCount(d.lookupDuration); n != 2 {
+		t.Errorf("expected lookups of 2 hosts to be recorded; got %d", n)
+	}
+
+	expected := `
+# HELP http_proxy_dns_lookup_failures_total Counter of failed DNS lookups for upstream hosts.
+# TYPE http_proxy_dns_lookup_failures_total counter
+http_proxy_dns_lookup_failures_total{host="upstream.invalid"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_proxy_dns_lookup_failures_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestNewDSCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, tc := range []struct {
+		name string
+		dscp int
+		tos  int
+	}{
+		{name: "default", dscp: 0, tos: 0},
+		{name: "expedited forwarding", dscp: 46, tos: 184},
+		{name: "bulk", dscp: 8, tos: 32},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := newTransport(&config{dscp: tc.dscp}).DialContext(context.Background(), "tcp4", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			rc, err := conn.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				tos  int
+				serr error
+			)
+			if err := rc.Control(func(fd uintptr) {
+				tos, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if serr != nil {
+				t.Fatal(serr)
+			}
+
+			if tos != tc.tos {
+				t.Errorf("expected type of service %d, got %d", tc.tos, tos)
+			}
+		})
+	}
+}
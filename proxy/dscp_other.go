@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DSCPSupported reports whether marking the packets of upstream connections via WithDSCP is supported on this platform.
+const DSCPSupported = false
+
+// dscpControl returns a dialer Control function failing every connection, as DSCP marking is not supported on this platform.
+// Callers are expected to check DSCPSupported before configuring a DSCP value.
+func dscpControl(_ int) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, _ syscall.RawConn) error {
+		return errors.New("setting the DSCP value of upstream connections is not supported on this platform")
+	}
+}
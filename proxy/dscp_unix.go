@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package proxy
+
+import (
+	"syscall"
+)
+
+// DSCPSupported reports whether marking the packets of upstream connections via WithDSCP is supported on this platform.
+const DSCPSupported = true
+
+// dscpControl returns a dialer Control function that marks the IP packets of connections with the DSCP value
+// by setting the IPv4 type of service or the IPv6 traffic class of the socket.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	// The DSCP value occupies the upper six bits of the field, the lower two are used for ECN.
+	tos := dscp << 2
+
+	return func(network, _ string, c syscall.RawConn) error {
+		var serr error
+
+		if err := c.Control(func(fd uintptr) {
+			if network == "tcp6" {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+				return
+			}
+
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}); err != nil {
+			return err
+		}
+
+		return serr
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+// Categories of errors proxying a request to the upstream.
+const (
+	ErrorCategoryTimeout           = "timeout"
+	ErrorCategoryConnectTimeout    = "connect_timeout"
+	ErrorCategoryDNS               = "dns"
+	ErrorCategoryConnectionRefused = "connection_refused"
+	ErrorCategoryCanceled          = "canceled"
+	ErrorCategoryHeadersTooLarge   = "response_headers_too_large"
+	ErrorCategoryOther             = "other"
+)
+
+// ErrorCategory returns the category of an error returned by the upstream transport.
+func ErrorCategory(err error) string {
+	var dnsErr *net.DNSError
+
+	var netErr net.Error
+
+	var opErr *net.OpError
+
+	var h2ConnErr http2.ConnectionError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorCategoryDNS
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return ErrorCategoryConnectTimeout
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorCategoryTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorCategoryConnectionRefused
+	case errors.Is(err, context.Canceled):
+		return ErrorCategoryCanceled
+	// The transports do not return typed errors for response headers exceeding their limit.
+	case strings.Contains(err.Error(), "server response headers exceeded"),
+		strings.Contains(err.Error(), "response header list larger than advertised limit"),
+		// Over HTTP/2, single header values beyond the limit fail decoding the headers instead.
+		errors.As(err, &h2ConnErr) && http2.ErrCode(h2ConnErr) == http2.ErrCodeCompression:
+		return ErrorCategoryHeadersTooLarge
+	default:
+		return ErrorCategoryOther
+	}
+}
+
+// StatusClientClosedRequest is the non-standard status code recorded for requests canceled by the client.
+// It keeps client disconnects apart from upstream failures in request metrics and logs.
+const StatusClientClosedRequest = 499
+
+// ErrorStatus returns the status code the client receives for the given error category.
+// Timeouts are answered with 504 Gateway Timeout, requests canceled by the client with 499
+// and all other errors, including timeouts connecting to the upstream, with 502 Bad Gateway.
+func ErrorStatus(category string) int {
+	switch category {
+	case ErrorCategoryTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorCategoryCanceled:
+		return StatusClientClosedRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// errorResponse is the body sent to clients if proxying fails,
+// it follows the format of the Prometheus HTTP API.
+type errorResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// newErrorHandler returns a ReverseProxy error handler that answers with a status code
+// and JSON body depending on the category of the error and counts errors by category.
+// If a sampler is given, repeated identical errors are collapsed in the logs.
+func newErrorHandler(logger log.Logger, reg prometheus.Registerer, sampler *errorLogSampler) func(http.ResponseWriter, *http.Request, error) {
+	errs := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_errors_total",
+		Help: "Counter of errors proxying requests to upstreams by category.",
+	}, []string{"category"})
+
+	if reg != nil {
+		errs = registerOrGet(reg, errs).(*prometheus.CounterVec)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		category := ErrorCategory(err)
+		errs.WithLabelValues(category).Inc()
+
+		l := level.Warn(logger)
+		if category == ErrorCategoryCanceled {
+			// Clients canceling their requests is common, e.g. for dashboards re-issuing queries.
+			l = level.Debug(logger)
+		}
+
+		logged, repeated := true, 0
+		if sampler != nil {
+			logged, repeated = sampler.sample(category+": "+err.Error(), func(suppressed int) {
+				l.Log(
+					"msg", "suppressed repeated errors proxying requests to upstream",
+					"category", category,
+					"err", err,
+					"suppressed", suppressed,
+					"window", sampler.window,
+				)
+			})
+		}
+
+		if logged {
+			keyvals := []interface{}{
+				"msg", "failed to proxy request to upstream",
+				"request", middleware.GetReqID(r.Context()),
+				"category", category,
+				"err", err,
+			}
+
+			if repeated > 0 {
+				keyvals = append(keyvals, "repeated", repeated)
+			}
+
+			l.Log(keyvals...)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(ErrorStatus(category))
+		_ = json.NewEncoder(w).Encode(errorResponse{
+			Status:    "error",
+			ErrorType: category,
+			Error:     "failed to proxy request to upstream: " + category,
+		})
+	}
+}
+
+// errorLogSampler collapses identical errors occurring within a window,
+// so that logs stay readable while an upstream is down.
+type errorLogSampler struct {
+	window time.Duration
+	rate   int
+
+	mtx    sync.Mutex
+	errors map[string]*sampledError
+}
+
+// sampledError tracks the occurrences of an error within the current window.
+type sampledError struct {
+	count      int
+	suppressed int
+}
+
+func newErrorLogSampler(window time.Duration, rate int) *errorLogSampler {
+	return &errorLogSampler{
+		window: window,
+		rate:   rate,
+		errors: map[string]*sampledError{},
+	}
+}
+
+// sample reports whether an occurrence of the error with the given key is logged
+// and how often the error occurred before within the window.
+// The first occurrence in a window is always logged and, if the rate is positive, every rate-th repetition as well.
+// Once the window has passed, summarize is called with the number of suppressed occurrences, if any.
+func (s *errorLogSampler) sample(key string, summarize func(suppressed int)) (bool, int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	e, ok := s.errors[key]
+	if !ok {
+		s.errors[key] = &sampledError{count: 1}
+
+		time.AfterFunc(s.window, func() {
+			s.mtx.Lock()
+			e := s.errors[key]
+			delete(s.errors, key)
+			s.mtx.Unlock()
+
+			if e.suppressed > 0 {
+				summarize(e.suppressed)
+			}
+		})
+
+		return true, 0
+	}
+
+	e.count++
+	repeated := e.count - 1
+
+	if s.rate > 0 && repeated%s.rate == 0 {
+		return true, repeated
+	}
+
+	e.suppressed++
+
+	return false, repeated
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorCategory(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		category string
+		status   int
+	}{
+		{
+			name:     "dns",
+			err:      &url.Error{Op: "Get", URL: "http://upstream", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "upstream"}}},
+			category: ErrorCategoryDNS,
+			status:   http.StatusBadGateway,
+		},
+		{
+			name:     "timeout",
+			err:      &url.Error{Op: "Get", URL: "http://upstream", Err: context.DeadlineExceeded},
+			category: ErrorCategoryTimeout,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			name:     "connect timeout",
+			err:      &url.Error{Op: "Get", URL: "http://upstream", Err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}},
+			category: ErrorCategoryConnectTimeout,
+			status:   http.StatusBadGateway,
+		},
+		{
+			name:     "read timeout",
+			err:      &url.Error{Op: "Get", URL: "http://upstream", Err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}},
+			category: ErrorCategoryTimeout,
+			status:   http.StatusGatewayTimeout,
+		},
+		{
+			name:     "connection refused",
+			err:      &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			category: ErrorCategoryConnectionRefused,
+			status:   http.StatusBadGateway,
+		},
+		{
+			name:     "other",
+			err:      errors.New("unexpected EOF"),
+			category: ErrorCategoryOther,
+			status:   http.StatusBadGateway,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			category := ErrorCategory(tc.err)
+			if category != tc.category {
+				t.Fatalf("expected category %q; got %q", tc.category, category)
+			}
+
+			if status := ErrorStatus(category); status != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestNewErrorResponse(t *testing.T) {
+	// A closed listener leaves an address that refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+
+	reg := prometheus.NewRegistry()
+	p := New(Middlewares(MiddlewareSetUpstream(u)), WithRegistry(reg))
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d; got %d", http.StatusBadGateway, rec.Code)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected content type %q; got %q", "application/json", ct)
+	}
+
+	var res errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Status != "error" || res.ErrorType != ErrorCategoryConnectionRefused {
+		t.Errorf("expected an error response of type %q; got %+v", ErrorCategoryConnectionRefused, res)
+	}
+
+	expected := `
+# HELP http_proxy_errors_total Counter of errors proxying requests to upstreams by category.
+# TYPE http_proxy_errors_total counter
+http_proxy_errors_total{category="connection_refused"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_proxy_errors_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestErrorLogSampler(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		rate       int
+		logged     []bool
+		suppressed int
+	}{
+		{
+			name:       "first occurrence only",
+			rate:       0,
+			logged:     []bool{true, false, false, false, false},
+			suppressed: 4,
+		},
+		{
+			name:       "every third repetition",
+			rate:       3,
+			logged:     []bool{true, false, false, true, false, false, true},
+			suppressed: 4,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := newErrorLogSampler(50*time.Millisecond, tc.rate)
+			summarized := make(chan int, 1)
+
+			for i, expected := range tc.logged {
+				logged, repeated := s.sample("connection_refused: dial tcp", func(suppressed int) {
+					summarized <- suppressed
+				})
+				if logged != expected {
+					t.Errorf("expected occurrence %d to be logged %t; got %t", i, expected, logged)
+				}
+
+				if repeated != i {
+					t.Errorf("expected occurrence %d to be reported as repeated %d times; got %d", i, i, repeated)
+				}
+			}
+
+			if logged, _ := s.sample("dns: no such host", func(int) {}); !logged {
+				t.Error("expected the first occurrence of another error to be logged")
+			}
+
+			select {
+			case suppressed := <-summarized:
+				if suppressed != tc.suppressed {
+					t.Errorf("expected %d suppressed occurrences; got %d", tc.suppressed, suppressed)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected the suppressed occurrences to be summarized after the window")
+			}
+
+			if logged, repeated := s.sample("connection_refused: dial tcp", func(int) {}); !logged || repeated != 0 {
+				t.Errorf("expected the error to be logged again in a new window; got logged %t and repeated %d", logged, repeated)
+			}
+		})
+	}
+}
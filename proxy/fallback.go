@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewFallback creates a handler that serves requests with the primary handler and, if it answers with one of the given
+// status codes, e.g. 422 for queries too complex for it, serves them again with the fallback handler, usually proxies
+// to different upstreams. The response of the fallback is returned as is, even if it has one of the status codes,
+// so requests are never passed on more than once. Request bodies are buffered in memory to be sent again.
+func NewFallback(primary, fallback http.Handler, reg prometheus.Registerer, statusCodes ...int) http.Handler {
+	fallbacks := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_fallbacks_total",
+		Help: "Counter of requests served by the fallback upstream by the status code of the primary upstream that triggered it.",
+	}, []string{"code"})
+
+	if reg != nil {
+		fallbacks = registerOrGet(reg, fallbacks).(*prometheus.CounterVec)
+	}
+
+	codes := map[int]struct{}{}
+	for _, code := range statusCodes {
+		codes[code] = struct{}{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+
+			body, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+
+			if err != nil {
+				http.Error(w, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		req := r.Clone(r.Context())
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		fw := &fallbackResponseWriter{ResponseWriter: w, header: http.Header{}, codes: codes}
+		primary.ServeHTTP(fw, req)
+
+		if fw.code == 0 {
+			return
+		}
+
+		fallbacks.WithLabelValues(strconv.Itoa(fw.code)).Inc()
+
+		req = r.Clone(r.Context())
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		fallback.ServeHTTP(w, req)
+	})
+}
+
+// fallbackResponseWriter holds back the header of a response until its status code is known,
+// and discards the response if the status code triggers the fallback.
+type fallbackResponseWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	codes       map[int]struct{}
+	wroteHeader bool
+	// code is the status code of a response that is discarded.
+	code int
+}
+
+func (w *fallbackResponseWriter) Header() http.Header {
+	if w.wroteHeader && w.code == 0 {
+		return w.ResponseWriter.Header()
+	}
+
+	return w.header
+}
+
+func (w *fallbackResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	// Informational responses, e.g. 103 Early Hints, are dropped, as the final response may come from the fallback.
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if _, ok := w.codes[code]; ok {
+		w.code = code
+		return
+	}
+
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *fallbackResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.code != 0 {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *fallbackResponseWriter) Flush() {
+	if !w.wroteHeader || w.code != 0 {
+		return
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *fallbackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+
+	return nil, nil, http.ErrNotSupported
+}
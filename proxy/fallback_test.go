@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		primaryCode   int
+		fallbackCode  int
+		code          int
+		body          string
+		fallbackCalls int
+		metrics       string
+	}{
+		{
+			name:        "primary succeeds",
+			primaryCode: http.StatusOK,
+			code:        http.StatusOK,
+			body:        "primary",
+		},
+		{
+			name:        "primary fails with other code",
+			primaryCode: http.StatusInternalServerError,
+			code:        http.StatusInternalServerError,
+			body:        "primary",
+		},
+		{
+			name:          "primary fails with fallback code",
+			primaryCode:   http.StatusUnprocessableEntity,
+			fallbackCode:  http.StatusOK,
+			code:          http.StatusOK,
+			body:          "fallback",
+			fallbackCalls: 1,
+			metrics: `
+# HELP http_proxy_fallbacks_total Counter of requests served by the fallback upstream by the status code of the primary upstream that triggered it.
+# TYPE http_proxy_fallbacks_total counter
+http_proxy_fallbacks_total{code="422"} 1
+`,
+		},
+		{
+			name:          "fallback fails with fallback code",
+			primaryCode:   http.StatusUnprocessableEntity,
+			fallbackCode:  http.StatusUnprocessableEntity,
+			code:          http.StatusUnprocessableEntity,
+			body:          "fallback",
+			fallbackCalls: 1,
+			metrics: `
+# HELP http_proxy_fallbacks_total Counter of requests served by the fallback upstream by the status code of the primary upstream that triggered it.
+# TYPE http_proxy_fallbacks_total counter
+http_proxy_fallbacks_total{code="422"} 1
+`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var primaryCalls, fallbackCalls int
+
+			// handler answers with the code and its name, and checks that the request body is passed on.
+			handler := func(name string, code int, calls *int) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					*calls++
+
+					body, err := ioutil.ReadAll(r.Body)
+					if err != nil || string(body) != "query=up" {
+						t.Errorf("expected %s to receive the request body; got %q: %v", name, body, err)
+					}
+
+					w.Header().Set("X-Upstream", name)
+					w.WriteHeader(code)
+					_, _ = w.Write([]byte(name))
+				})
+			}
+
+			reg := prometheus.NewRegistry()
+			h := NewFallback(
+				handler("primary", tc.primaryCode, &primaryCalls),
+				handler("fallback", tc.fallbackCode, &fallbackCalls),
+				reg,
+				http.StatusUnprocessableEntity, http.StatusNotImplemented,
+			)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("query=up")))
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if body := rec.Body.String(); body != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, body)
+			}
+
+			if upstream := rec.Header()["X-Upstream"]; len(upstream) != 1 || upstream[0] != tc.body {
+				t.Errorf("expected only the header of %s; got %v", tc.body, upstream)
+			}
+
+			if primaryCalls != 1 {
+				t.Errorf("expected the primary to be called once; got %d", primaryCalls)
+			}
+
+			if fallbackCalls != tc.fallbackCalls {
+				t.Errorf("expected the fallback to be called %d times; got %d", tc.fallbackCalls, fallbackCalls)
+			}
+
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(tc.metrics), "http_proxy_fallbacks_total"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// DefaultSingletonResponseHeaders are response headers that may occur at most once, see RFC 7230 section 3.2.2.
+// Duplicate Content-Length headers are not listed, as the transport already rejects responses with conflicting ones.
+var DefaultSingletonResponseHeaders = []string{
+	"Content-Encoding",
+	"Content-Location",
+	"Content-Range",
+	"Content-Type",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Location",
+	"Retry-After",
+}
+
+// WithSingletonResponseHeaders collapses duplicates of the given upstream response headers, e.g. DefaultSingletonResponseHeaders,
+// to their first value and logs a warning, so that clients are not confused by upstreams violating the HTTP specification.
+func WithSingletonResponseHeaders(headers []string) Option {
+	return func(c *config) {
+		c.singletonResponseHeaders = nil
+
+		for _, h := range headers {
+			c.singletonResponseHeaders = append(c.singletonResponseHeaders, http.CanonicalHeaderKey(h))
+		}
+	}
+}
+
+// collapseDuplicateHeaders returns a response modifier keeping only the first value of each of the given headers.
+func collapseDuplicateHeaders(logger log.Logger, headers []string) func(res *http.Response) error {
+	return func(res *http.Response) error {
+		for _, h := range headers {
+			values := res.Header[h]
+			if len(values) < 2 {
+				continue
+			}
+
+			var upstream string
+			if res.Request != nil {
+				upstream = res.Request.URL.Host
+			}
+
+			level.Warn(logger).Log("msg", "collapsing duplicate response header of upstream",
+				"header", h, "values", len(values), "upstream", upstream)
+
+			res.Header[h] = values[:1]
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNewSingletonResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = []string{"application/json", "text/plain"}
+		w.Header()["Etag"] = []string{`"a"`, `"a"`}
+		w.Header()["Set-Cookie"] = []string{"a=1", "b=2"}
+		w.Header()["Date"] = []string{"Thu, 15 Oct 2026 07:00:00 GMT"}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		headers  []string
+		expected http.Header
+	}{
+		{
+			name: "not normalized",
+			expected: http.Header{
+				"Content-Type": {"application/json", "text/plain"},
+				"Etag":         {`"a"`, `"a"`},
+				"Set-Cookie":   {"a=1", "b=2"},
+				"Date":         {"Thu, 15 Oct 2026 07:00:00 GMT"},
+			},
+		},
+		{
+			name:    "default headers",
+			headers: DefaultSingletonResponseHeaders,
+			expected: http.Header{
+				"Content-Type": {"application/json"},
+				"Etag":         {`"a"`},
+				"Set-Cookie":   {"a=1", "b=2"},
+				"Date":         {"Thu, 15 Oct 2026 07:00:00 GMT"},
+			},
+		},
+		{
+			name:    "configured headers",
+			headers: []string{"set-cookie"},
+			expected: http.Header{
+				"Content-Type": {"application/json", "text/plain"},
+				"Etag":         {`"a"`, `"a"`},
+				"Set-Cookie":   {"a=1"},
+				"Date":         {"Thu, 15 Oct 2026 07:00:00 GMT"},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []Option
+			if tc.headers != nil {
+				opts = append(opts, WithSingletonResponseHeaders(tc.headers))
+			}
+
+			p := New(Middlewares(MiddlewareSetUpstream(u)), opts...)
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+			}
+
+			for h, expected := range tc.expected {
+				if got := rec.Header()[h]; !reflect.DeepEqual(got, expected) {
+					t.Errorf("expected %s header %q; got %q", h, expected, got)
+				}
+			}
+		})
+	}
+}
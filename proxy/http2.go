@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// WithHTTP2 proxies requests to the upstream over HTTP/2, multiplexing them on fewer connections,
+// which benefits workloads of many small queries. Upstreams are spoken to with h2 over TLS for https URLs,
+// falling back to HTTP/1.1 if they do not negotiate HTTP/2, and with h2c, HTTP/2 without TLS, for http URLs.
+// Upgrades, e.g. to WebSockets, are not supported over HTTP/2.
+func WithHTTP2(enabled bool) Option {
+	return func(c *config) {
+		c.http2 = enabled
+	}
+}
+
+// h2Transport is a http.RoundTripper sending requests with h2 or h2c depending on the scheme of the upstream.
+type h2Transport struct {
+	h2  *http.Transport
+	h2c *http2.Transport
+}
+
+// newH2Transport creates a h2Transport sending h2 requests with t, which must attempt HTTP/2,
+// and h2c requests over connections dialed like the ones of t, accepting response headers as large as t does
+// and closing connections idle for as long as t does.
+func newH2Transport(t *http.Transport) *h2Transport {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		// Connections are dialed by the pool, which has the request's context, unlike this hook.
+		DialTLS: func(string, string, *tls.Config) (net.Conn, error) {
+			return nil, errors.New("h2c connections are dialed by the connection pool")
+		},
+	}
+
+	if t.MaxResponseHeaderBytes > 0 && t.MaxResponseHeaderBytes <= math.MaxUint32 {
+		h2c.MaxHeaderListSize = uint32(t.MaxResponseHeaderBytes)
+	}
+
+	h2c.ConnPool = &h2cConnPool{t: h2c, dial: dial, idleTimeout: t.IdleConnTimeout, conns: map[string][]*h2cConn{}}
+
+	return &h2Transport{h2: t, h2c: h2c}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *h2Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(r)
+	}
+
+	return t.h2.RoundTrip(r)
+}
+
+// h2cConnPool is a http2.ClientConnPool of h2c connections, which are plain TCP connections.
+// New connections are dialed with the context of the request needing them, so that dialing stops once it is canceled.
+// Connections that cannot take new requests, e.g. after a GOAWAY from the upstream, are dropped from the pool,
+// and connections not handed out for the idle timeout, if any, are shut down gracefully.
+type h2cConnPool struct {
+	t           *http2.Transport
+	dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string][]*h2cConn
+}
+
+// h2cConn is a pooled connection with the time it was last handed out.
+type h2cConn struct {
+	cc       *http2.ClientConn
+	lastUsed time.Time
+	idle     *time.Timer
+}
+
+// GetClientConn implements the http2.ClientConnPool interface.
+func (p *h2cConnPool) GetClientConn(r *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	for _, c := range p.conns[addr] {
+		if cc := c.cc; !cc.CanTakeNewRequest() {
+			p.removeLocked(cc)
+			// Requests still in flight on the connection complete before it is closed.
+			go func() { _ = cc.Shutdown(context.Background()) }()
+
+			continue
+		}
+
+		c.lastUsed = time.Now()
+		p.mu.Unlock()
+
+		return c.cc, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial(r.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := p.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &h2cConn{cc: cc, lastUsed: time.Now()}
+	if p.idleTimeout > 0 {
+		c.idle = time.AfterFunc(p.idleTimeout, func() { p.closeIdle(c) })
+	}
+
+	p.mu.Lock()
+	p.conns[addr] = append(p.conns[addr], c)
+	p.mu.Unlock()
+
+	return cc, nil
+}
+
+// closeIdle shuts the connection down if it has not been handed out for the idle timeout,
+// otherwise it checks again once the timeout has passed since it was last handed out.
+func (p *h2cConnPool) closeIdle(c *h2cConn) {
+	p.mu.Lock()
+	if d := p.idleTimeout - time.Since(c.lastUsed); d > 0 {
+		c.idle.Reset(d)
+		p.mu.Unlock()
+
+		return
+	}
+
+	removed := p.removeLocked(c.cc)
+	p.mu.Unlock()
+
+	if removed {
+		_ = c.cc.Shutdown(context.Background())
+	}
+}
+
+// MarkDead implements the http2.ClientConnPool interface.
+func (p *h2cConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeLocked(cc)
+}
+
+// removeLocked removes the connection from the pool and reports whether it was pooled.
+// It must be called with the mutex held.
+func (p *h2cConnPool) removeLocked(cc *http2.ClientConn) bool {
+	for addr, conns := range p.conns {
+		for i, c := range conns {
+			if c.cc != cc {
+				continue
+			}
+
+			if c.idle != nil {
+				c.idle.Stop()
+			}
+
+			if len(conns) == 1 {
+				delete(p.conns, addr)
+				return true
+			}
+
+			p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestNewHTTP2Cleartext(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Warning", strings.Repeat("a", 8<<10))
+		case "/many":
+			for i := 0; i < 16; i++ {
+				w.Header().Add("Warning", strings.Repeat("a", 512))
+			}
+		}
+		_, _ = w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type ctxKey struct{}
+
+	var dialed []interface{}
+
+	reg := prometheus.NewRegistry()
+	p := New(Middlewares(MiddlewareSetUpstream(u)),
+		WithRegistry(reg),
+		WithHTTP2(true),
+		WithTransport(&http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, ctx.Value(ctxKey{}))
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+			MaxResponseHeaderBytes: 4 << 10,
+		}),
+	)
+
+	for _, tc := range []struct {
+		name string
+		path string
+		code int
+		body string
+	}{
+		{
+			name: "h2c",
+			path: "/",
+			code: http.StatusOK,
+			body: "HTTP/2.0",
+		},
+		{
+			name: "header too large",
+			path: "/large",
+			code: http.StatusBadGateway,
+		},
+		{
+			name: "headers too large",
+			path: "/many",
+			code: http.StatusBadGateway,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, tc.name))
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, rec.Body.String())
+			}
+		})
+	}
+
+	if len(dialed) == 0 || dialed[0] != "h2c" {
+		t.Errorf("expected the connection to be dialed with the context of the first request; got %v", dialed)
+	}
+
+	expected := `
+# HELP http_proxy_errors_total Counter of errors proxying requests to upstreams by category.
+# TYPE http_proxy_errors_total counter
+http_proxy_errors_total{category="response_headers_too_large"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_proxy_errors_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestH2cConnPool(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), &http2.Server{}))
+	defer upstream.Close()
+
+	addr := upstream.Listener.Addr().String()
+	r := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+
+	t.Run("reuse and eviction", func(t *testing.T) {
+		p := newH2Transport(&http.Transport{}).h2c.ConnPool.(*h2cConnPool)
+
+		first, err := p.GetClientConn(r, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cc, err := p.GetClientConn(r, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cc != first {
+			t.Error("expected the pooled connection to be reused")
+		}
+
+		if err := first.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		cc, err = p.GetClientConn(r, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cc == first {
+			t.Error("expected a closed connection not to be reused")
+		}
+
+		if n := len(p.conns[addr]); n != 1 {
+			t.Errorf("expected the closed connection to be dropped from the pool; got %d connections", n)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		p := newH2Transport(&http.Transport{IdleConnTimeout: 50 * time.Millisecond}).h2c.ConnPool.(*h2cConnPool)
+
+		cc, err := p.GetClientConn(r, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100 && cc.CanTakeNewRequest(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if cc.CanTakeNewRequest() {
+			t.Fatal("expected the idle connection to be shut down")
+		}
+
+		p.mu.Lock()
+		n := len(p.conns[addr])
+		p.mu.Unlock()
+
+		if n != 0 {
+			t.Errorf("expected the idle connection to be dropped from the pool; got %d connections", n)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResponseMode determines how a proxy passes the responses of the upstream on to clients.
+type ResponseMode int
+
+const (
+	// ResponseModeDefault copies responses using the proxy's buffer pool,
+	// flushing streamed responses, e.g. Server-Sent Events, as they arrive.
+	ResponseModeDefault ResponseMode = iota
+	// ResponseModeBuffered reads responses fully into memory before sending them to the client with a Content-Length,
+	// which releases the upstream connection as early as possible but holds whole responses in memory.
+	// Protocol upgrades and Server-Sent Events are never buffered.
+	ResponseModeBuffered
+	// ResponseModeStreamed flushes every chunk of a response to the client as soon as it arrives,
+	// e.g. for long-lived streams such as log tails.
+	ResponseModeStreamed
+)
+
+// WithResponseMode sets how the proxy passes the responses of the upstream on to clients,
+// e.g. buffering responses to cacheable queries and streaming tails.
+func WithResponseMode(m ResponseMode) Option {
+	return func(c *config) {
+		c.responseMode = m
+	}
+}
+
+// bufferResponse reads the body of the response into memory, unless it is an upgrade or a stream of events.
+func bufferResponse(res *http.Response) error {
+	if res.StatusCode == http.StatusSwitchingProtocols || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if err != nil {
+		return err
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
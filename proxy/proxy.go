@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"crypto/tls"
 	stdlog "log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-kit/kit/log"
@@ -12,6 +17,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	// DefaultBufferCount is the default number of buffers kept in a proxy's buffer pool.
+	DefaultBufferCount = 16
+	// bufferSize is the size of the buffers used to copy response bodies,
+	// it matches the size httputil.ReverseProxy allocates when no buffer pool is configured.
+	bufferSize = 32 * 1024
+)
+
 type Middleware func(r *http.Request)
 
 func Middlewares(middlewares ...Middleware) func(r *http.Request) {
@@ -26,8 +39,24 @@ func MiddlewareSetUpstream(upstream *url.URL) Middleware {
 	return func(r *http.Request) {
 		r.URL.Scheme = upstream.Scheme
 		r.URL.Host = upstream.Host
-		r.URL.Path = path.Join(upstream.Path, r.URL.Path)
+		r.URL.Path = joinPath(upstream.Path, r.URL.Path)
+		r.URL.RawPath = ""
+	}
+}
+
+// joinPath joins the path elements like path.Join but keeps a trailing slash of the last element,
+// which is significant to some upstream APIs.
+func joinPath(elem ...string) string {
+	p := path.Join(elem...)
+	if p == "" {
+		return "/"
 	}
+
+	if last := elem[len(elem)-1]; strings.HasSuffix(last, "/") && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+
+	return p
 }
 
 func MiddlewareLogger(logger log.Logger) Middleware {
@@ -37,14 +66,15 @@ func MiddlewareLogger(logger log.Logger) Middleware {
 	}
 }
 
-func MiddlewareMetrics(registry *prometheus.Registry, constLabels prometheus.Labels) Middleware {
+func MiddlewareMetrics(registry prometheus.Registerer, constLabels prometheus.Labels) Middleware {
 	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name:        "http_proxy_requests_total",
 		Help:        "Counter of proxy HTTP requests.",
 		ConstLabels: constLabels,
 	}, []string{"method"})
 
-	registry.MustRegister(requests)
+	// Handlers for different upstreams of the same API share the counter.
+	requests = registerOrGet(registry, requests).(*prometheus.CounterVec)
 
 	return func(r *http.Request) {
 		requests.With(prometheus.Labels{"method": r.Method}).Inc()
@@ -54,3 +84,393 @@ func MiddlewareMetrics(registry *prometheus.Registry, constLabels prometheus.Lab
 func Logger(logger log.Logger) *stdlog.Logger {
 	return stdlog.New(log.NewStdlibAdapter(level.Warn(logger)), "", stdlog.Lshortfile)
 }
+
+type config struct {
+	logger       log.Logger
+	registry     prometheus.Registerer
+	dialTimeout  time.Duration
+	bufferCount  int
+	errorHandler func(http.ResponseWriter, *http.Request, error)
+	pathPrefix   string
+
+	retries            int
+	retryStatusCodes   map[int]struct{}
+	retryNetworkErrors bool
+	retryMaxBodyBytes  int64
+
+	responseHeaderAllowlist map[string]struct{}
+	serverName              string
+
+	singletonResponseHeaders []string
+
+	readBufferSize  int
+	writeBufferSize int
+
+	maxResponseHeaderBytes int64
+
+	stripHeaders []string
+
+	errorLogWindow     time.Duration
+	errorLogSampleRate int
+
+	dscp int
+
+	transport  *http.Transport
+	maxConnAge time.Duration
+
+	http2 bool
+
+	responseMode ResponseMode
+}
+
+// Option modifies the configuration of a reverse proxy.
+type Option func(c *config)
+
+// WithLogger sets a custom logger for the proxy to use.
+func WithLogger(logger log.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithRegistry sets a Prometheus registerer on which the proxy registers its metrics.
+// Proxies sharing a registerer share their metrics.
+func WithRegistry(r prometheus.Registerer) Option {
+	return func(c *config) {
+		c.registry = r
+	}
+}
+
+// WithDialTimeout sets the maximum amount of time to wait for a connection to the upstream, including resolving its host.
+// It is independent of how long the upstream may take to answer once connected,
+// so that unreachable upstreams fail fast with 502 Bad Gateway while long-running queries are not cut short.
+// A value of zero keeps the 30s of http.DefaultTransport.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.dialTimeout = d
+	}
+}
+
+// WithBufferCount sets the number of buffers pre-allocated for copying response bodies.
+// A count of zero disables pooling and a buffer is allocated per request instead.
+func WithBufferCount(n int) Option {
+	return func(c *config) {
+		c.bufferCount = n
+	}
+}
+
+// WithTransportBufferSizes sets the sizes of the buffers used to read from and write to upstream connections.
+// A size of zero uses the transport's default of 4KiB.
+func WithTransportBufferSizes(read, write int) Option {
+	return func(c *config) {
+		c.readBufferSize = read
+		c.writeBufferSize = write
+	}
+}
+
+// WithMaxResponseHeaderBytes limits the size of the response headers accepted from the upstream,
+// so that clients are not sent enormous headers, e.g. huge Warning headers, by a misbehaving upstream.
+// Responses with larger headers are answered with 502 Bad Gateway
+// and counted as errors of the response_headers_too_large category.
+// A value of zero uses the transport's default of 10MiB.
+func WithMaxResponseHeaderBytes(n int64) Option {
+	return func(c *config) {
+		c.maxResponseHeaderBytes = n
+	}
+}
+
+// WithErrorHandler sets the function handling errors proxying requests to the upstream.
+// By default errors are answered with a JSON body and a status code depending on the ErrorCategory.
+func WithErrorHandler(h func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(c *config) {
+		c.errorHandler = h
+	}
+}
+
+// WithErrorLogSampling collapses identical errors proxying requests that occur within the window in the logs.
+// The first occurrence is logged, followed by every rate-th repetition if the rate is positive,
+// and the number of suppressed repetitions is logged once the window has passed.
+// It has no effect if a custom error handler is set. A window of zero disables sampling.
+func WithErrorLogSampling(window time.Duration, rate int) Option {
+	return func(c *config) {
+		c.errorLogWindow = window
+		c.errorLogSampleRate = rate
+	}
+}
+
+// WithUpstreamPathPrefix prepends the prefix to the path of requests after the director rewrote them,
+// e.g. for upstreams serving their API under /prometheus.
+func WithUpstreamPathPrefix(prefix string) Option {
+	return func(c *config) {
+		c.pathPrefix = prefix
+	}
+}
+
+// WithStripOutboundHeaders removes the given request headers before requests are forwarded to the upstream,
+// e.g. Authorization and Cookie, so that client credentials already validated by observatorium do not leak to it.
+// Hop-by-hop headers as defined in RFC 7230 are always removed by the reverse proxy.
+func WithStripOutboundHeaders(headers []string) Option {
+	return func(c *config) {
+		c.stripHeaders = headers
+	}
+}
+
+// WithDSCP marks the packets of connections to the upstream with the given DSCP value, e.g. 46 for expedited forwarding,
+// so that networks prioritizing traffic by class can, e.g., prefer queries over bulk writes.
+// It is supported on Linux, macOS and the BSDs only, see DSCPSupported; on other platforms connecting to the upstream fails.
+// A value of zero keeps the system default.
+func WithDSCP(dscp int) Option {
+	return func(c *config) {
+		c.dscp = dscp
+	}
+}
+
+// WithUpstreamServerName sets the server name sent via SNI and verified against the certificate of TLS upstreams,
+// e.g. to select one of multiple upstreams served behind the same address.
+func WithUpstreamServerName(name string) Option {
+	return func(c *config) {
+		c.serverName = name
+	}
+}
+
+// WithTransport sets the transport connecting to the upstream, e.g. one created by NewTransport,
+// so that proxies of the same upstream can share a connection pool.
+// The options configuring the transport, e.g. WithDialTimeout or WithDSCP, then have no effect on the proxy.
+func WithTransport(t *http.Transport) Option {
+	return func(c *config) {
+		c.transport = t
+	}
+}
+
+// alwaysAllowedResponseHeaders are the response headers forwarded to clients regardless of the allowlist,
+// as they are needed to interpret the response.
+var alwaysAllowedResponseHeaders = []string{
+	"Cache-Control",
+	"Connection",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"Date",
+	"Retry-After",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Vary",
+	"Warning",
+}
+
+// WithResponseHeaderAllowlist only forwards the given upstream response headers to clients,
+// e.g. to keep internal headers of the upstream from leaking. Standard headers such as Content-Type and Content-Encoding
+// are always forwarded.
+func WithResponseHeaderAllowlist(headers []string) Option {
+	return func(c *config) {
+		c.responseHeaderAllowlist = map[string]struct{}{}
+
+		for _, h := range append(append([]string{}, alwaysAllowedResponseHeaders...), headers...) {
+			c.responseHeaderAllowlist[http.CanonicalHeaderKey(h)] = struct{}{}
+		}
+	}
+}
+
+// New creates a new reverse proxy that uses the director to rewrite requests before forwarding them.
+// Server-Sent Events are flushed to the client as they arrive and protocol upgrades, e.g. WebSockets,
+// are passed through by hijacking the client connection. Responses to HTTP/1.0 clients, which do not support
+// chunked encoding, are delimited by their Content-Length or, if it is unknown, by closing the connection.
+func New(director func(r *http.Request), opts ...Option) *httputil.ReverseProxy {
+	c := &config{
+		logger:            log.NewNopLogger(),
+		bufferCount:       DefaultBufferCount,
+		retryMaxBodyBytes: DefaultRetryMaxBodyBytes,
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	if c.pathPrefix != "" {
+		director = Middlewares(director, func(r *http.Request) {
+			r.URL.Path = joinPath("/", c.pathPrefix, r.URL.Path)
+			r.URL.RawPath = ""
+		})
+	}
+
+	if len(c.stripHeaders) > 0 {
+		director = Middlewares(director, func(r *http.Request) {
+			for _, h := range c.stripHeaders {
+				r.Header.Del(h)
+			}
+		})
+	}
+
+	if c.errorHandler == nil {
+		var sampler *errorLogSampler
+		if c.errorLogWindow > 0 {
+			sampler = newErrorLogSampler(c.errorLogWindow, c.errorLogSampleRate)
+		}
+
+		c.errorHandler = newErrorHandler(c.logger, c.registry, sampler)
+	}
+
+	if c.transport == nil {
+		c.transport = newTransport(c)
+	}
+
+	var transport http.RoundTripper = c.transport
+
+	if c.http2 {
+		transport = newH2Transport(c.transport)
+	}
+
+	if c.maxConnAge > 0 {
+		transport = newMaxAgeTransport(transport, c.registry, c.maxConnAge)
+	}
+
+	if c.retries > 0 {
+		transport = newRetryTransport(transport, c.registry, c.retries, c.retryStatusCodes, c.retryNetworkErrors, c.retryMaxBodyBytes)
+	}
+
+	p := &httputil.ReverseProxy{
+		Director:     director,
+		ErrorLog:     Logger(c.logger),
+		ErrorHandler: c.errorHandler,
+		Transport:    transport,
+	}
+
+	var modifiers []func(res *http.Response) error
+
+	if c.responseHeaderAllowlist != nil {
+		modifiers = append(modifiers, func(res *http.Response) error {
+			for h := range res.Header {
+				if _, ok := c.responseHeaderAllowlist[h]; !ok {
+					delete(res.Header, h)
+				}
+			}
+
+			return nil
+		})
+	}
+
+	if len(c.singletonResponseHeaders) > 0 {
+		modifiers = append(modifiers, collapseDuplicateHeaders(c.logger, c.singletonResponseHeaders))
+	}
+
+	if c.responseMode == ResponseModeBuffered {
+		modifiers = append(modifiers, bufferResponse)
+	}
+
+	if len(modifiers) > 0 {
+		p.ModifyResponse = func(res *http.Response) error {
+			for _, m := range modifiers {
+				if err := m(res); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+
+	if c.responseMode == ResponseModeStreamed {
+		// A negative interval flushes after every write.
+		p.FlushInterval = -1
+	}
+
+	// A nil BufferPool makes the reverse proxy allocate a new buffer per request.
+	// Streamed responses use the pool too; as it allocates buffers once all are in use, long-lived streams cannot exhaust it.
+	if c.bufferCount > 0 {
+		p.BufferPool = newBufferPool(c.bufferCount)
+	}
+
+	return p
+}
+
+// NewTransport creates the transport a proxy with the given options connects to the upstream with.
+// It can be passed to multiple proxies using WithTransport, so that they share a connection pool.
+// Only the options configuring the transport, e.g. WithDialTimeout or WithDSCP, are applied.
+func NewTransport(opts ...Option) *http.Transport {
+	c := &config{}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return newTransport(c)
+}
+
+// newTransport creates a transport with the defaults of http.DefaultTransport, e.g. its idle connection and
+// TLS handshake timeouts and honoring the proxy environment variables, overriding only the configured fields.
+func newTransport(c *config) *http.Transport {
+	// The dialer settings are the ones of http.DefaultTransport.
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if c.dialTimeout > 0 {
+		d.Timeout = c.dialTimeout
+	}
+
+	if c.dscp > 0 {
+		d.Control = dscpControl(c.dscp)
+	}
+
+	dial := d.DialContext
+	if c.registry != nil {
+		dial = newDialer(c.registry, *d).DialContext
+	}
+
+	if c.maxConnAge > 0 {
+		dial = conns.dial(dial)
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dial
+	// HTTP/2 is only spoken to upstreams if configured with WithHTTP2.
+	t.ForceAttemptHTTP2 = c.http2
+
+	if c.readBufferSize > 0 {
+		t.ReadBufferSize = c.readBufferSize
+	}
+
+	if c.writeBufferSize > 0 {
+		t.WriteBufferSize = c.writeBufferSize
+	}
+
+	if c.maxResponseHeaderBytes > 0 {
+		t.MaxResponseHeaderBytes = c.maxResponseHeaderBytes
+	}
+
+	if c.serverName != "" {
+		t.TLSClientConfig = &tls.Config{ServerName: c.serverName}
+	}
+
+	return t
+}
+
+// bufferPool is a httputil.BufferPool holding a fixed number of pre-allocated buffers.
+// If all buffers are in use, additional buffers are allocated and discarded after use.
+type bufferPool struct {
+	buffers chan []byte
+}
+
+func newBufferPool(count int) *bufferPool {
+	p := &bufferPool{buffers: make(chan []byte, count)}
+	for i := 0; i < count; i++ {
+		p.buffers <- make([]byte, bufferSize)
+	}
+
+	return p
+}
+
+// Get implements the httputil.BufferPool interface.
+func (p *bufferPool) Get() []byte {
+	select {
+	case b := <-p.buffers:
+		return b
+	default:
+		return make([]byte, bufferSize)
+	}
+}
+
+// Put implements the httputil.BufferPool interface.
+func (p *bufferPool) Put(b []byte) {
+	select {
+	case p.buffers <- b:
+	default:
+	}
+}
@@ -0,0 +1,797 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewBufferCount(t *testing.T) {
+	body := strings.Repeat("a", 3*bufferSize)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		count  int
+		mode   ResponseMode
+		pooled bool
+	}{
+		{
+			name:   "default",
+			count:  DefaultBufferCount,
+			pooled: true,
+		},
+		{
+			name:   "single buffer",
+			count:  1,
+			pooled: true,
+		},
+		{
+			name:   "no pooling",
+			count:  0,
+			pooled: false,
+		},
+		{
+			name:   "streamed",
+			count:  DefaultBufferCount,
+			mode:   ResponseModeStreamed,
+			pooled: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p := New(Middlewares(MiddlewareSetUpstream(u)), WithBufferCount(tc.count), WithResponseMode(tc.mode))
+
+			if pooled := p.BufferPool != nil; pooled != tc.pooled {
+				t.Fatalf("expected pooled %t; got %t", tc.pooled, pooled)
+			}
+
+			if tc.pooled {
+				if n := len(p.BufferPool.(*bufferPool).buffers); n != tc.count {
+					t.Errorf("expected %d pre-allocated buffers; got %d", tc.count, n)
+				}
+			}
+
+			// Run more requests than there are buffers to exercise allocation beyond the pool.
+			for i := 0; i < tc.count+2; i++ {
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+				res := rec.Result()
+				got, err := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("expected status %d; got %d", http.StatusOK, res.StatusCode)
+				}
+
+				if string(got) != body {
+					t.Fatalf("expected body of %d bytes; got %d bytes", len(body), len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestNewServerSentEvents(t *testing.T) {
+	done := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		for _, e := range []string{"first", "second"} {
+			_, _ = w.Write([]byte("data: " + e + "\n\n"))
+			w.(http.Flusher).Flush()
+		}
+
+		// Keep the stream open until the client has received the events,
+		// so they can only have arrived if the proxy did not buffer them.
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := httptest.NewServer(New(Middlewares(MiddlewareSetUpstream(u))))
+	defer p.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	res, err := client.Get(p.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected content type %q; got %q", "text/event-stream", ct)
+	}
+
+	r := bufio.NewReader(res.Body)
+
+	for _, e := range []string{"first", "second"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event %q: %v", e, err)
+		}
+
+		if expected := "data: " + e + "\n"; line != expected {
+			t.Fatalf("expected %q; got %q", expected, line)
+		}
+
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatalf("reading event %q: %v", e, err)
+		}
+	}
+}
+
+func TestNewUpstreamPathPrefix(t *testing.T) {
+	var got string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		prefix   string
+		path     string
+		expected string
+	}{
+		{
+			name:     "no prefix",
+			path:     "/api/v1/query",
+			expected: "/api/v1/query",
+		},
+		{
+			name:     "prefix",
+			prefix:   "/prometheus",
+			path:     "/api/v1/query",
+			expected: "/prometheus/api/v1/query",
+		},
+		{
+			name:     "prefix with trailing slash",
+			prefix:   "/prometheus/",
+			path:     "/api/v1/query",
+			expected: "/prometheus/api/v1/query",
+		},
+		{
+			name:     "prefix without leading slash",
+			prefix:   "prometheus",
+			path:     "/api/v1/query",
+			expected: "/prometheus/api/v1/query",
+		},
+		{
+			name:     "trailing slash of request path is kept",
+			prefix:   "/prometheus",
+			path:     "/graph/",
+			expected: "/prometheus/graph/",
+		},
+		{
+			name:     "root path",
+			prefix:   "/prometheus",
+			path:     "/",
+			expected: "/prometheus/",
+		},
+		{
+			name:     "endpoint path",
+			endpoint: "/thanos",
+			path:     "/api/v1/query",
+			expected: "/thanos/api/v1/query",
+		},
+		{
+			name:     "endpoint path and prefix",
+			endpoint: "/thanos",
+			prefix:   "/prometheus",
+			path:     "/api/v1/query",
+			expected: "/prometheus/thanos/api/v1/query",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(upstream.URL + tc.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var opts []Option
+			if tc.prefix != "" {
+				opts = append(opts, WithUpstreamPathPrefix(tc.prefix))
+			}
+
+			p := New(Middlewares(MiddlewareSetUpstream(u)), opts...)
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected upstream path %q; got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewClientCancel(t *testing.T) {
+	canceled := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	p := httptest.NewServer(New(Middlewares(MiddlewareSetUpstream(u)), WithRegistry(reg)))
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequest(http.MethodGet, p.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("expected the request to be canceled")
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the upstream request to be canceled")
+	}
+
+	// The error handler runs after the upstream request was canceled.
+	expected := `
+# HELP http_proxy_errors_total Counter of errors proxying requests to upstreams by category.
+# TYPE http_proxy_errors_total counter
+http_proxy_errors_total{category="canceled"} 1
+`
+	for i := 0; ; i++ {
+		err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_proxy_errors_total")
+		if err == nil {
+			break
+		}
+
+		if i == 50 {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewHTTP10(t *testing.T) {
+	body := "first\nsecond\n"
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "content length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				_, _ = w.Write([]byte(body))
+			},
+		},
+		{
+			name: "streamed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for _, line := range strings.SplitAfter(body, "\n") {
+					_, _ = w.Write([]byte(line))
+					w.(http.Flusher).Flush()
+				}
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := httptest.NewServer(tc.handler)
+			defer upstream.Close()
+
+			u, err := url.Parse(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := httptest.NewServer(New(Middlewares(MiddlewareSetUpstream(u))))
+			defer p.Close()
+
+			conn, err := net.Dial("tcp", p.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := conn.Write([]byte("GET /api/v1/query?query=up HTTP/1.0\r\nHost: observatorium\r\n\r\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			// HTTP/1.0 clients know the response is complete when the server closes the connection,
+			// so reading until EOF must neither time out nor return a chunked body.
+			raw, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d; got %d", http.StatusOK, res.StatusCode)
+			}
+
+			if len(res.TransferEncoding) != 0 {
+				t.Fatalf("expected no transfer encoding; got %v", res.TransferEncoding)
+			}
+
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != body {
+				t.Fatalf("expected body %q; got %q", body, string(b))
+			}
+		})
+	}
+}
+
+func BenchmarkNewTransportReadBufferSize(b *testing.B) {
+	body := []byte(strings.Repeat("a", 8<<20))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{4 * 1024, 64 * 1024, 256 * 1024} {
+		size := size
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			p := httptest.NewServer(New(Middlewares(MiddlewareSetUpstream(u)), WithTransportBufferSizes(size, 0)))
+			defer p.Close()
+
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				res, err := http.Get(p.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+					b.Fatal(err)
+				}
+
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkNewResponseMode(b *testing.B) {
+	chunk := []byte(strings.Repeat("a", 16*1024))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 64; i++ {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Microsecond)
+		}
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		mode ResponseMode
+	}{
+		{name: "default", mode: ResponseModeDefault},
+		{name: "buffered", mode: ResponseModeBuffered},
+		{name: "streamed", mode: ResponseModeStreamed},
+	} {
+		tc := tc
+		b.Run(tc.name, func(b *testing.B) {
+			p := httptest.NewServer(New(Middlewares(MiddlewareSetUpstream(u)), WithResponseMode(tc.mode)))
+			defer p.Close()
+
+			b.SetBytes(int64(64 * len(chunk)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			// The time to the first byte shows the latency streaming saves, the allocations the memory buffering costs.
+			var ttfb time.Duration
+
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+
+				res, err := http.Get(p.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := res.Body.Read(make([]byte, 1)); err != nil {
+					b.Fatal(err)
+				}
+
+				ttfb += time.Since(start)
+
+				if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+					b.Fatal(err)
+				}
+
+				res.Body.Close()
+			}
+
+			b.ReportMetric(float64(ttfb.Nanoseconds())/float64(b.N), "ttfb-ns/op")
+		})
+	}
+}
+
+func TestMiddlewareMetricsShared(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	labels := prometheus.Labels{"proxy": "metricsv1-read"}
+
+	// Handlers for the upstreams of different tenants register the same counter.
+	for _, m := range []Middleware{MiddlewareMetrics(reg, labels), MiddlewareMetrics(reg, labels)} {
+		m(httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+	}
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_proxy_requests_total Counter of proxy HTTP requests.
+# TYPE http_proxy_requests_total counter
+http_proxy_requests_total{method="GET",proxy="metricsv1-read"} 2
+`), "http_proxy_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewResponseHeaderAllowlist(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Thanos-Internal", "node-1")
+		w.Header().Set("X-Request-Id", "abc")
+		w.Header().Set("Retry-After", "5")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected []string
+		removed  []string
+	}{
+		{
+			name:     "all forwarded",
+			expected: []string{"Content-Type", "X-Thanos-Internal", "X-Request-Id", "Retry-After"},
+		},
+		{
+			name:     "allowlist",
+			opts:     []Option{WithResponseHeaderAllowlist([]string{"x-request-id"})},
+			expected: []string{"Content-Type", "X-Request-Id", "Retry-After"},
+			removed:  []string{"X-Thanos-Internal"},
+		},
+		{
+			name:     "empty allowlist",
+			opts:     []Option{WithResponseHeaderAllowlist(nil)},
+			expected: []string{"Content-Type", "Retry-After"},
+			removed:  []string{"X-Thanos-Internal", "X-Request-Id"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p := New(Middlewares(MiddlewareSetUpstream(u)), tc.opts...)
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+
+			for _, h := range tc.expected {
+				if rec.Header().Get(h) == "" {
+					t.Errorf("expected header %s to be forwarded", h)
+				}
+			}
+
+			for _, h := range tc.removed {
+				if v := rec.Header().Get(h); v != "" {
+					t.Errorf("expected header %s to be removed; got %q", h, v)
+				}
+			}
+
+			if rec.Body.String() != "{}" {
+				t.Errorf("expected body %q; got %q", "{}", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewUpstreamServerName(t *testing.T) {
+	serverNames := make(chan string, 1)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	upstream.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		opts       []Option
+		serverName string
+	}{
+		{
+			name:       "inferred from the upstream URL",
+			serverName: "",
+		},
+		{
+			name:       "configured",
+			opts:       []Option{WithUpstreamServerName("thanos-querier.example.com")},
+			serverName: "thanos-querier.example.com",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p := New(Middlewares(MiddlewareSetUpstream(u)), tc.opts...)
+
+			// The upstream's certificate is not trusted, only the server name of the handshake matters.
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+
+			select {
+			case name := <-serverNames:
+				if name != tc.serverName {
+					t.Errorf("expected server name %q; got %q", tc.serverName, name)
+				}
+			default:
+				t.Fatal("expected a TLS handshake with the upstream")
+			}
+		})
+	}
+}
+
+func TestNewStripOutboundHeaders(t *testing.T) {
+	var received http.Header
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(Middlewares(MiddlewareSetUpstream(u)), WithStripOutboundHeaders([]string{"authorization", "Cookie"}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("X-Scope-OrgID", "tenant")
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+
+	for _, h := range []string{"Authorization", "Cookie"} {
+		if v := received.Get(h); v != "" {
+			t.Errorf("expected header %s to be stripped; got %q", h, v)
+		}
+	}
+
+	if v := received.Get("X-Scope-OrgID"); v != "tenant" {
+		t.Errorf("expected other headers to be forwarded; got X-Scope-OrgID %q", v)
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		t.Error("expected the headers of the incoming request to be left untouched")
+	}
+}
+
+func TestNewMaxResponseHeaderBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Warning", strings.Repeat("a", 8<<10))
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		max     int64
+		code    int
+		metrics string
+	}{
+		{
+			name: "default limit",
+			code: http.StatusOK,
+		},
+		{
+			name: "headers too large",
+			max:  4 << 10,
+			code: http.StatusBadGateway,
+			metrics: `
+# HELP http_proxy_errors_total Counter of errors proxying requests to upstreams by category.
+# TYPE http_proxy_errors_total counter
+http_proxy_errors_total{category="response_headers_too_large"} 1
+`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			p := New(Middlewares(MiddlewareSetUpstream(u)), WithRegistry(reg), WithMaxResponseHeaderBytes(tc.max))
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.code != http.StatusOK && rec.Header().Get("Warning") != "" {
+				t.Error("expected the upstream's headers not to be passed on")
+			}
+
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(tc.metrics), "http_proxy_errors_total"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	def := http.DefaultTransport.(*http.Transport)
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		verify func(t *testing.T, tr *http.Transport)
+	}{
+		{
+			name: "defaults",
+			verify: func(t *testing.T, tr *http.Transport) {
+				if tr.Proxy == nil {
+					t.Error("expected the proxy environment variables to be honored")
+				}
+
+				if tr.IdleConnTimeout != def.IdleConnTimeout {
+					t.Errorf("expected idle connection timeout %s; got %s", def.IdleConnTimeout, tr.IdleConnTimeout)
+				}
+
+				if tr.MaxIdleConns != def.MaxIdleConns {
+					t.Errorf("expected at most %d idle connections; got %d", def.MaxIdleConns, tr.MaxIdleConns)
+				}
+
+				if tr.TLSHandshakeTimeout != def.TLSHandshakeTimeout {
+					t.Errorf("expected TLS handshake timeout %s; got %s", def.TLSHandshakeTimeout, tr.TLSHandshakeTimeout)
+				}
+
+				if tr.ForceAttemptHTTP2 {
+					t.Error("expected HTTP/2 not to be attempted unless configured")
+				}
+			},
+		},
+		{
+			name: "configured",
+			opts: []Option{
+				WithTransportBufferSizes(8<<10, 16<<10),
+				WithMaxResponseHeaderBytes(4 << 10),
+				WithUpstreamServerName("upstream.example.com"),
+			},
+			verify: func(t *testing.T, tr *http.Transport) {
+				if tr.ReadBufferSize != 8<<10 || tr.WriteBufferSize != 16<<10 {
+					t.Errorf("expected buffer sizes %d and %d; got %d and %d", 8<<10, 16<<10, tr.ReadBufferSize, tr.WriteBufferSize)
+				}
+
+				if tr.MaxResponseHeaderBytes != 4<<10 {
+					t.Errorf("expected response headers of at most %d bytes; got %d", 4<<10, tr.MaxResponseHeaderBytes)
+				}
+
+				if tr.TLSClientConfig == nil || tr.TLSClientConfig.ServerName != "upstream.example.com" {
+					t.Errorf("expected server name %q; got %+v", "upstream.example.com", tr.TLSClientConfig)
+				}
+
+				if tr.IdleConnTimeout != def.IdleConnTimeout {
+					t.Errorf("expected idle connection timeout %s; got %s", def.IdleConnTimeout, tr.IdleConnTimeout)
+				}
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.verify(t, NewTransport(tc.opts...))
+		})
+	}
+}
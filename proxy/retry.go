@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retryBackoff is the time waited before the first retry, it grows linearly with every further retry.
+const retryBackoff = 100 * time.Millisecond
+
+// DefaultRetryMaxBodyBytes is the size up to which request bodies are buffered to be retried if no other is configured.
+const DefaultRetryMaxBodyBytes = 4 << 20
+
+// DefaultRetryStatusCodes are the upstream status codes retried if none are configured.
+var DefaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// WithRetry retries requests up to the given number of times if the connection to the upstream cannot be established
+// or the upstream answers with one of the given status codes, by default DefaultRetryStatusCodes.
+// Request bodies are buffered in memory to be sent again, up to WithRetryMaxBodyBytes; larger requests are not retried.
+func WithRetry(retries int, statusCodes ...int) Option {
+	return func(c *config) {
+		if len(statusCodes) == 0 {
+			statusCodes = DefaultRetryStatusCodes
+		}
+
+		c.retries = retries
+		c.retryStatusCodes = map[int]struct{}{}
+
+		for _, code := range statusCodes {
+			c.retryStatusCodes[code] = struct{}{}
+		}
+	}
+}
+
+// WithRetryMaxBodyBytes sets the size up to which request bodies are buffered in memory to be retried,
+// by default DefaultRetryMaxBodyBytes. Requests with larger bodies are sent once and not retried.
+func WithRetryMaxBodyBytes(n int64) Option {
+	return func(c *config) {
+		c.retryMaxBodyBytes = n
+	}
+}
+
+// WithRetryOnNetworkErrors makes the retries configured with WithRetry distinguish network errors by type:
+// requests are retried only if the connection was refused or reset, e.g. by a load balancer in front of the upstream,
+// but not on other failures to connect. Timeouts and canceled requests are never retried.
+// As a reset connection may have been reset after the upstream received the request, requests may be sent twice.
+func WithRetryOnNetworkErrors(enabled bool) Option {
+	return func(c *config) {
+		c.retryNetworkErrors = enabled
+	}
+}
+
+// retryTransport is a http.RoundTripper retrying failed requests.
+type retryTransport struct {
+	next          http.RoundTripper
+	retries       int
+	statusCodes   map[int]struct{}
+	networkErrors bool
+	maxBodyBytes  int64
+	retried       *prometheus.CounterVec
+	skipped       prometheus.Counter
+}
+
+func newRetryTransport(
+	next http.RoundTripper,
+	reg prometheus.Registerer,
+	retries int,
+	statusCodes map[int]struct{},
+	networkErrors bool,
+	maxBodyBytes int64,
+) *retryTransport {
+	retried := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_retries_total",
+		Help: "Counter of requests to upstreams retried by reason, either a status code, connection or a type of network error.",
+	}, []string{"reason"})
+	skipped := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_proxy_retries_skipped_total",
+		Help: "Counter of requests to upstreams that are not retried because their body is too large to be buffered.",
+	})
+
+	if reg != nil {
+		retried = registerOrGet(reg, retried).(*prometheus.CounterVec)
+		skipped = registerOrGet(reg, skipped).(prometheus.Counter)
+	}
+
+	return &retryTransport{
+		next:          next,
+		retries:       retries,
+		statusCodes:   statusCodes,
+		networkErrors: networkErrors,
+		maxBodyBytes:  maxBodyBytes,
+		retried:       retried,
+		skipped:       skipped,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, getBody, retries, err := t.rewindBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		req := r.Clone(r.Context())
+		req.Body = body
+
+		if attempt > 0 && getBody != nil {
+			if req.Body, err = getBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := t.next.RoundTrip(req)
+
+		reason, retry := t.retryable(res, err)
+		if !retry || attempt >= retries {
+			return res, err
+		}
+
+		if res != nil {
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		t.retried.WithLabelValues(reason).Inc()
+
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(retryBackoff * time.Duration(attempt+1)):
+		}
+	}
+}
+
+// rewindBody returns the body to send the request with first, a function returning a fresh copy of it for retries,
+// which is nil if the request has no body, and the number of retries allowed for the request.
+// Bodies that cannot be recreated with the request's GetBody are buffered in memory up to the limit,
+// larger ones are sent as they are and the request is not retried.
+func (t *retryTransport) rewindBody(r *http.Request) (io.ReadCloser, func() (io.ReadCloser, error), int, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r.Body, nil, t.retries, nil
+	}
+
+	if r.GetBody != nil {
+		return r.Body, r.GetBody, t.retries, nil
+	}
+
+	if r.ContentLength > t.maxBodyBytes {
+		t.skipped.Inc()
+		return r.Body, nil, 0, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, t.maxBodyBytes+1))
+	if err != nil {
+		r.Body.Close()
+		return nil, nil, 0, err
+	}
+
+	if int64(len(body)) > t.maxBodyBytes {
+		t.skipped.Inc()
+		return readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}, nil, 0, nil
+	}
+
+	r.Body.Close()
+
+	getBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	first, _ := getBody()
+
+	return first, getBody, t.retries, nil
+}
+
+// readCloser reads from a reader and closes a closer, e.g. the original body of a request of which a part was read.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// retryable reports whether the result of a round trip may be retried and why.
+func (t *retryTransport) retryable(res *http.Response, err error) (string, bool) {
+	if err != nil {
+		if t.networkErrors {
+			return retryableNetworkError(err)
+		}
+
+		// Only failures to connect are retried, as the upstream has not seen the request yet.
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout() {
+			return "connection", true
+		}
+
+		return "", false
+	}
+
+	if _, ok := t.statusCodes[res.StatusCode]; ok {
+		return strconv.Itoa(res.StatusCode), true
+	}
+
+	return "", false
+}
+
+// retryableNetworkError reports whether the error is a refused or reset connection and which.
+func retryableNetworkError(err error) (string, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "", false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "", false
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused", true
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryableNetworkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		err           error
+		networkErrors bool
+		reason        string
+		retry         bool
+	}{
+		{
+			name:          "connection refused",
+			err:           &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			networkErrors: true,
+			reason:        "connection_refused",
+			retry:         true,
+		},
+		{
+			name:          "connection reset",
+			err:           &url.Error{Op: "Get", URL: "http://upstream", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}},
+			networkErrors: true,
+			reason:        "connection_reset",
+			retry:         true,
+		},
+		{
+			name:          "other failure to connect",
+			err:           &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)},
+			networkErrors: true,
+		},
+		{
+			name:          "timeout",
+			err:           &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}},
+			networkErrors: true,
+		},
+		{
+			name:          "canceled",
+			err:           fmt.Errorf("round trip: %w", context.Canceled),
+			networkErrors: true,
+		},
+		{
+			name:          "deadline exceeded",
+			err:           fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			networkErrors: true,
+		},
+		{
+			name: "connection reset without network errors",
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+		},
+		{
+			name:   "failure to connect without network errors",
+			err:    &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)},
+			reason: "connection",
+			retry:  true,
+		},
+		{
+			name: "other error",
+			err:  errors.New("unexpected EOF"),
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rt := newRetryTransport(nil, nil, 1, nil, tc.networkErrors, DefaultRetryMaxBodyBytes)
+
+			reason, retry := rt.retryable(nil, tc.err)
+			if retry != tc.retry {
+				t.Fatalf("expected retry %t; got %t", tc.retry, retry)
+			}
+
+			if reason != tc.reason {
+				t.Errorf("expected reason %q; got %q", tc.reason, reason)
+			}
+		})
+	}
+}
+
+func TestNewRetryOnConnectionReset(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		networkErrors bool
+		expected      int
+	}{
+		{
+			name:          "retried",
+			networkErrors: true,
+			expected:      http.StatusOK,
+		},
+		{
+			name:     "not retried",
+			expected: http.StatusBadGateway,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			u := resettingUpstream(t)
+
+			p := New(Middlewares(MiddlewareSetUpstream(u)), WithRetry(1), WithRetryOnNetworkErrors(tc.networkErrors))
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+
+			if rec.Code != tc.expected {
+				t.Fatalf("expected status %d; got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
+
+// resettingUpstream starts an upstream that resets the connection of the first request and answers all others.
+func resettingUpstream(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	var requests int32
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+
+				for {
+					if _, err := http.ReadRequest(r); err != nil {
+						return
+					}
+
+					if atomic.AddInt32(&requests, 1) == 1 {
+						// Closing with a linger of zero sends a RST instead of a FIN.
+						_ = conn.(*net.TCPConn).SetLinger(0)
+						return
+					}
+
+					if _, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestNewRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		opts          []Option
+		failures      int
+		failureCode   int
+		unknownLength bool
+		code          int
+		requests      int
+	}{
+		{
+			name:        "retried on configured status code",
+			opts:        []Option{WithRetry(2, http.StatusServiceUnavailable)},
+			failures:    2,
+			failureCode: http.StatusServiceUnavailable,
+			code:        http.StatusOK,
+			requests:    3,
+		},
+		{
+			name:        "retried on default status code",
+			opts:        []Option{WithRetry(1)},
+			failures:    1,
+			failureCode: http.StatusBadGateway,
+			code:        http.StatusOK,
+			requests:    2,
+		},
+		{
+			name:        "not retried on other status code",
+			opts:        []Option{WithRetry(1, http.StatusServiceUnavailable)},
+			failures:    1,
+			failureCode: http.StatusBadGateway,
+			code:        http.StatusBadGateway,
+			requests:    1,
+		},
+		{
+			name:        "retries exhausted",
+			opts:        []Option{WithRetry(1)},
+			failures:    2,
+			failureCode: http.StatusServiceUnavailable,
+			code:        http.StatusServiceUnavailable,
+			requests:    2,
+		},
+		{
+			name:        "not retried with body too large",
+			opts:        []Option{WithRetry(1), WithRetryMaxBodyBytes(4)},
+			failures:    1,
+			failureCode: http.StatusServiceUnavailable,
+			code:        http.StatusServiceUnavailable,
+			requests:    1,
+		},
+		{
+			name:          "not retried with body of unknown length too large",
+			opts:          []Option{WithRetry(1), WithRetryMaxBodyBytes(4)},
+			failures:      1,
+			failureCode:   http.StatusServiceUnavailable,
+			unknownLength: true,
+			code:          http.StatusServiceUnavailable,
+			requests:      1,
+		},
+		{
+			name:          "retried with body of unknown length",
+			opts:          []Option{WithRetry(1)},
+			failures:      1,
+			failureCode:   http.StatusServiceUnavailable,
+			unknownLength: true,
+			code:          http.StatusOK,
+			requests:      2,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			const body = "up{job=\"api\"} 1"
+
+			var (
+				mu     sync.Mutex
+				bodies []string
+			)
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+
+				mu.Lock()
+				bodies = append(bodies, string(b))
+				n := len(bodies)
+				mu.Unlock()
+
+				if n <= tc.failures {
+					w.WriteHeader(tc.failureCode)
+				}
+			}))
+			defer upstream.Close()
+
+			u, err := url.Parse(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := New(Middlewares(MiddlewareSetUpstream(u)), tc.opts...)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/receive", strings.NewReader(body))
+			if tc.unknownLength {
+				r.Body = ioutil.NopCloser(strings.NewReader(body))
+				r.ContentLength = -1
+			}
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(bodies) != tc.requests {
+				t.Fatalf("expected %d requests to the upstream; got %d", tc.requests, len(bodies))
+			}
+
+			for i, b := range bodies {
+				if b != body {
+					t.Errorf("expected request %d to have body %q; got %q", i, body, b)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/observatorium/observatorium/authorization"
+)
+
+// WithAuthorizer returns a middleware that lets the authorizer decide whether requests are served,
+// e.g. by evaluating a policy engine such as OPA. A nil authorizer allows all requests, like authorization.NopAuthorizer.
+// It must run after authentication, so that the authorizer can use the tenant and subject from the request context.
+// Denied requests are answered with 403 Forbidden and the error's message.
+func WithAuthorizer(a authorization.Authorizer) func(http.Handler) http.Handler {
+	if a == nil {
+		a = authorization.NopAuthorizer{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := a.Authorize(r.Context(), r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/observatorium/observatorium/authorization"
+)
+
+func TestWithAuthorizer(t *testing.T) {
+	denyWrites := authorization.AuthorizerFunc(func(_ context.Context, r *http.Request) error {
+		if r.Method == http.MethodPost {
+			return errors.New("writes are not allowed")
+		}
+		return nil
+	})
+
+	for _, tc := range []struct {
+		name       string
+		authorizer authorization.Authorizer
+		method     string
+		code       int
+		body       string
+	}{
+		{
+			name:   "nil authorizer allows",
+			method: http.MethodPost,
+			code:   http.StatusOK,
+		},
+		{
+			name:       "nop authorizer allows",
+			authorizer: authorization.NopAuthorizer{},
+			method:     http.MethodPost,
+			code:       http.StatusOK,
+		},
+		{
+			name:       "allowed",
+			authorizer: denyWrites,
+			method:     http.MethodGet,
+			code:       http.StatusOK,
+		},
+		{
+			name:       "denied",
+			authorizer: denyWrites,
+			method:     http.MethodPost,
+			code:       http.StatusForbidden,
+			body:       "writes are not allowed",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var served bool
+			h := WithAuthorizer(tc.authorizer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tc.method, "/api/v1/receive", nil))
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+			if served != (tc.code == http.StatusOK) {
+				t.Errorf("expected next handler served to be %t", tc.code == http.StatusOK)
+			}
+			if body := strings.TrimSpace(rec.Body.String()); body != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// WithWriteBodyReadTimeout returns a middleware that reads the whole request body before passing
+// the request on and fails it with 408 Request Timeout if the body is not read within the given duration.
+// This protects write endpoints against slow clients without limiting long-running reads on other routes.
+func WithWriteBodyReadTimeout(d time.Duration) func(http.Handler) http.Handler {
+	type result struct {
+		body []byte
+		err  error
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			done := make(chan result, 1)
+
+			go func() {
+				body, err := ioutil.ReadAll(r.Body)
+				done <- result{body: body, err: err}
+			}()
+
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+
+			select {
+			case res := <-done:
+				if res.err != nil {
+					http.Error(w, "failed to read request body", http.StatusBadRequest)
+					return
+				}
+
+				r.Body = ioutil.NopCloser(bytes.NewReader(res.body))
+				r.ContentLength = int64(len(res.body))
+
+				next.ServeHTTP(w, r)
+			case <-timer.C:
+				requestTimeout(w)
+			case <-r.Context().Done():
+			}
+		})
+	}
+}
+
+// WithMaxBodySize returns a middleware that rejects requests whose body is larger than max bytes.
+// Requests declaring a larger Content-Length are rejected before their body is read,
+// with 417 Expectation Failed if they expect 100 Continue, so that clients do not upload the body,
+// and 413 Request Entity Too Large otherwise. Bodies of unknown length fail to be read beyond the limit.
+func WithMaxBodySize(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				code := http.StatusRequestEntityTooLarge
+				if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+					code = http.StatusExpectationFailed
+				}
+
+				http.Error(w, "request body too large, the limit is "+strconv.FormatInt(max, 10)+" bytes", code)
+
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithMaxDecompressedBytes returns a middleware that rejects snappy-compressed write requests, i.e. Prometheus
+// remote-write and Loki protobuf pushes, that would decompress to more than max bytes with 400 Bad Request,
+// so that small compressed bodies cannot make WithWriteTransform or the upstream allocate huge buffers.
+// The decompressed size is declared at the start of snappy blocks, so only the first bytes of a body are read
+// to check it and nothing is decompressed. Bodies that are not snappy-compressed are passed on as they are.
+func WithMaxDecompressedBytes(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || !snappyCompressed(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			head := make([]byte, binary.MaxVarintLen64)
+
+			n, err := io.ReadFull(r.Body, head)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+				http.Error(w, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+
+			head = head[:n]
+
+			size, err := snappy.DecodedLen(head)
+			if err != nil && n > 0 {
+				http.Error(w, "failed to decompress write request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if int64(size) > max {
+				http.Error(w, "decompressed request body too large, the limit is "+strconv.FormatInt(max, 10)+" bytes",
+					http.StatusBadRequest)
+
+				return
+			}
+
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// snappyCompressed reports whether the body of the request is compressed in the snappy block format.
+func snappyCompressed(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Content-Encoding"), "snappy") ||
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf")
+}
+
+// requestTimeout answers with 408 Request Timeout and closes the client connection,
+// which also unblocks the pending read of the request body.
+// Otherwise the server would keep waiting for the rest of the body after the handler returned.
+func requestTimeout(w http.ResponseWriter) {
+	const msg = "timed out reading request body\n"
+
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(msg)))
+	w.WriteHeader(http.StatusRequestTimeout)
+	_, _ = w.Write([]byte(msg))
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	if h, ok := w.(http.Hijacker); ok {
+		if conn, _, err := h.Hijack(); err == nil {
+			_ = conn.Close()
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestWithWriteBodyReadTimeout(t *testing.T) {
+	s := httptest.NewServer(WithWriteBodyReadTimeout(100 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = w.Write(body)
+	})))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		length int
+		code   int
+	}{
+		{
+			name:   "complete body",
+			body:   "metrics",
+			length: len("metrics"),
+			code:   http.StatusOK,
+		},
+		{
+			name:   "stalled body",
+			body:   "met",
+			length: len("metrics"),
+			code:   http.StatusRequestTimeout,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			req := "POST /api/v1/receive HTTP/1.1\r\n" +
+				"Host: observatorium\r\n" +
+				"Content-Length: " + strconv.Itoa(tc.length) + "\r\n\r\n" + tc.body
+			if _, err := conn.Write([]byte(req)); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.code {
+				t.Fatalf("expected status code %d; got %d", tc.code, res.StatusCode)
+			}
+
+			if tc.code == http.StatusOK {
+				return
+			}
+
+			if !res.Close {
+				t.Error("expected the connection of a stalled request to be closed")
+			}
+		})
+	}
+}
+
+func TestWithMaxBodySizeExpectContinue(t *testing.T) {
+	const max = 16
+
+	s := httptest.NewServer(WithMaxBodySize(max)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = w.Write(body)
+	})))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name      string
+		body      string
+		continued bool
+		code      int
+	}{
+		{
+			name:      "within limit",
+			body:      strings.Repeat("a", max),
+			continued: true,
+			code:      http.StatusOK,
+		},
+		{
+			name:      "exceeding limit",
+			body:      strings.Repeat("a", max+1),
+			continued: false,
+			code:      http.StatusExpectationFailed,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Send the headers only, the body must not be sent before the server asked for it.
+			headers := "POST /api/v1/receive HTTP/1.1\r\n" +
+				"Host: observatorium\r\n" +
+				"Expect: 100-continue\r\n" +
+				"Content-Length: " + strconv.Itoa(len(tc.body)) + "\r\n\r\n"
+			if _, err := conn.Write([]byte(headers)); err != nil {
+				t.Fatal(err)
+			}
+
+			r := bufio.NewReader(conn)
+
+			res, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if continued := res.StatusCode == http.StatusContinue; continued != tc.continued {
+				t.Fatalf("expected 100 Continue to be sent %t; got status code %d", tc.continued, res.StatusCode)
+			}
+
+			if res.StatusCode == http.StatusContinue {
+				if _, err := conn.Write([]byte(tc.body)); err != nil {
+					t.Fatal(err)
+				}
+
+				res, err = http.ReadResponse(r, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.code {
+				t.Fatalf("expected status code %d; got %d", tc.code, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestWithMaxDecompressedBytes(t *testing.T) {
+	const max = 1024
+
+	for _, tc := range []struct {
+		name     string
+		body     []byte
+		encoding string
+		code     int
+	}{
+		{
+			name:     "within limit",
+			body:     snappy.Encode(nil, bytes.Repeat([]byte("a"), max)),
+			encoding: "snappy",
+			code:     http.StatusNoContent,
+		},
+		{
+			name:     "exceeding limit",
+			body:     snappy.Encode(nil, bytes.Repeat([]byte("a"), max+1)),
+			encoding: "snappy",
+			code:     http.StatusBadRequest,
+		},
+		{
+			// A body declaring a huge decompressed size is rejected before it is decompressed.
+			name:     "bomb",
+			body:     []byte{0xff, 0xff, 0xff, 0xff, 0x0f},
+			encoding: "snappy",
+			code:     http.StatusBadRequest,
+		},
+		{
+			name: "not compressed",
+			body: bytes.Repeat([]byte("a"), max+1),
+			code: http.StatusNoContent,
+		},
+		{
+			name:     "empty",
+			encoding: "snappy",
+			code:     http.StatusNoContent,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := WithMaxDecompressedBytes(max)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				if !bytes.Equal(body, tc.body) {
+					http.Error(w, "body was modified", http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/receive", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tc.code {
+				t.Fatalf("expected status code %d; got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
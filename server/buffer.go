@@ -0,0 +1,544 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// replayInterval is the interval at which buffered writes are retried.
+	replayInterval = 5 * time.Second
+	// replayTimeout bounds a single replay attempt against the upstream.
+	replayTimeout = time.Minute
+	// drainInterval is the interval at which buffered writes are retried while draining the buffer.
+	drainInterval = time.Second
+	// bufferFileSuffix is the suffix of files holding buffered writes on disk.
+	bufferFileSuffix = ".write"
+)
+
+// bufferedCredentialHeaders are the request headers holding client credentials. They are removed from buffered
+// write requests, which may be persisted to disk, as the requests were authenticated before being buffered.
+var bufferedCredentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Policies for write requests that do not fit into a full write buffer.
+const (
+	// WriteBufferFullReject rejects the request with 503 Service Unavailable, applying backpressure to the client.
+	WriteBufferFullReject = "reject"
+	// WriteBufferFullDropOldest drops the oldest buffered requests to make room, favoring availability over durability.
+	WriteBufferFullDropOldest = "drop-oldest"
+)
+
+// bufferedWrite is a write request that is waiting to be replayed.
+type bufferedWrite struct {
+	seq uint64
+	// raw holds the request in HTTP/1.1 wire format.
+	raw []byte
+	// digest is the hash of raw, identifying the request among the buffered ones to deduplicate them.
+	digest [sha256.Size]byte
+	// path is the path of the request, used to find the handler of writes restored from disk.
+	path string
+	// next is the handler the request was originally passed to by the middleware and is replayed through.
+	// It is nil for writes restored from disk until a request to the same path is served.
+	next http.Handler
+}
+
+// WriteBuffer buffers write requests that failed because of a transient upstream outage
+// and replays them in order once the upstream recovers.
+// Clients receive a 202 Accepted for buffered requests.
+// Requests identical to one that is already buffered, e.g. sent again by retrying clients, are buffered only once.
+type WriteBuffer struct {
+	logger     log.Logger
+	maxBytes   int
+	dir        string
+	fullPolicy string
+
+	mu       sync.Mutex
+	handlers map[string]http.Handler
+	entries  []*bufferedWrite
+	digests  map[[sha256.Size]byte]struct{}
+	size     int
+	seq      uint64
+
+	buffered     prometheus.Counter
+	deduplicated prometheus.Counter
+	replayed     prometheus.Counter
+	dropped      prometheus.Counter
+	bytes        prometheus.Gauge
+	full         *prometheus.CounterVec
+}
+
+// WriteBufferOption modifies the configuration of a WriteBuffer.
+type WriteBufferOption func(b *WriteBuffer)
+
+// WithWriteBufferFullPolicy sets what happens to write requests that do not fit into the full buffer,
+// either WriteBufferFullReject or WriteBufferFullDropOldest, which is the default.
+func WithWriteBufferFullPolicy(policy string) WriteBufferOption {
+	return func(b *WriteBuffer) {
+		b.fullPolicy = policy
+	}
+}
+
+// NewWriteBuffer creates a new WriteBuffer holding at most maxBytes of buffered requests.
+// If dir is not empty, buffered requests are persisted to the directory and replayed after a restart,
+// otherwise they are only kept in memory.
+// When the buffer is full the oldest buffered requests are dropped, unless configured otherwise.
+// Client credentials, e.g. the Authorization header, are not buffered: the middleware must be applied
+// after authentication and before any middleware setting credentials for the upstream, which applies them on replay.
+func NewWriteBuffer(logger log.Logger, reg prometheus.Registerer, maxBytes int, dir string, opts ...WriteBufferOption) (*WriteBuffer, error) {
+	b := &WriteBuffer{
+		logger:     logger,
+		maxBytes:   maxBytes,
+		dir:        dir,
+		fullPolicy: WriteBufferFullDropOldest,
+		digests:    map[[sha256.Size]byte]struct{}{},
+		handlers:   map[string]http.Handler{},
+		buffered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_write_buffer_buffered_total",
+			Help: "Total number of write requests buffered because of a failing upstream.",
+		}),
+		deduplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_write_buffer_deduplicated_total",
+			Help: "Total number of write requests not buffered because an identical request was already buffered.",
+		}),
+		replayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_write_buffer_replayed_total",
+			Help: "Total number of buffered write requests replayed to the upstream.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_write_buffer_dropped_total",
+			Help: "Total number of buffered write requests dropped before they could be replayed.",
+		}),
+		bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_write_buffer_size_bytes",
+			Help: "Current size of all buffered write requests in bytes.",
+		}),
+		full: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_write_buffer_full_total",
+			Help: "Total number of write requests that did not fit into the write buffer by outcome, rejected or dropped_oldest.",
+		}, []string{"outcome"}),
+	}
+
+	for _, o := range opts {
+		o(b)
+	}
+
+	switch b.fullPolicy {
+	case WriteBufferFullReject, WriteBufferFullDropOldest:
+	default:
+		return nil, fmt.Errorf("unknown write buffer full policy %q", b.fullPolicy)
+	}
+
+	if reg != nil {
+		reg.MustRegister(b.buffered, b.deduplicated, b.replayed, b.dropped, b.bytes, b.full)
+	}
+
+	if dir != "" {
+		if err := b.load(); err != nil {
+			return nil, fmt.Errorf("load buffered writes from %q: %w", dir, err)
+		}
+	}
+
+	return b, nil
+}
+
+// load restores the buffered writes persisted in the buffer's directory.
+func (b *WriteBuffer) load() error {
+	if err := os.MkdirAll(b.dir, 0o750); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(b.dir, "*"+bufferFileSuffix))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(files)
+
+	for _, f := range files {
+		var seq uint64
+		if _, err := fmt.Sscanf(filepath.Base(f), "%d"+bufferFileSuffix, &seq); err != nil {
+			level.Warn(b.logger).Log("msg", "skipping unknown file in write buffer directory", "file", f)
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			level.Warn(b.logger).Log("msg", "skipping unreadable buffered write", "file", f, "err", err)
+			continue
+		}
+
+		e := &bufferedWrite{seq: seq, raw: raw, digest: sha256.Sum256(raw), path: r.URL.Path}
+		b.entries = append(b.entries, e)
+		b.digests[e.digest] = struct{}{}
+		b.size += len(raw)
+
+		if seq > b.seq {
+			b.seq = seq
+		}
+	}
+
+	b.bytes.Set(float64(b.size))
+
+	if len(b.entries) > 0 {
+		level.Info(b.logger).Log("msg", "restored buffered writes", "count", len(b.entries), "bytes", b.size)
+	}
+
+	return nil
+}
+
+// Middleware returns a middleware that buffers write requests failing with a transient upstream error.
+// While there are buffered writes pending, new writes are buffered too so that they are replayed in order.
+// The middleware may be applied to several routes: buffered writes are replayed through the handler of their route.
+// Writes restored from disk are replayed once a request to their path has been served after the restart.
+func (b *WriteBuffer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		if _, ok := b.handlers[r.URL.Path]; !ok {
+			b.handlers[r.URL.Path] = next
+		}
+		b.mu.Unlock()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		if b.pending() {
+			b.bufferOrReject(w, r, next, body)
+			return
+		}
+
+		rec := newResponseRecorder()
+		next.ServeHTTP(rec, r)
+
+		if !isTransientStatus(rec.code) {
+			rec.writeTo(w)
+			return
+		}
+
+		b.bufferOrReject(w, r, next, body)
+	})
+}
+
+// bufferOrReject buffers the request to be replayed through next and answers with 202 Accepted,
+// or with 503 Service Unavailable if the buffer is full and the policy is to reject.
+func (b *WriteBuffer) bufferOrReject(w http.ResponseWriter, r *http.Request, next http.Handler, body []byte) {
+	if !b.enqueue(r, next, body) {
+		serviceUnavailable(w, r, UnavailableCauseBuffer, "write buffer full")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Run replays buffered writes until the given context is canceled.
+func (b *WriteBuffer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			b.replay(ctx)
+		}
+	}
+}
+
+// Drain replays buffered writes until the buffer is empty or the context is canceled.
+// It is meant to be called on shutdown once the server stopped accepting requests,
+// so that buffered writes are not lost on restarts. It logs the number of attempts and its outcome
+// and returns the number of writes left in the buffer.
+func (b *WriteBuffer) Drain(ctx context.Context) int {
+	var attempts, replayed int
+
+	for b.pending() && ctx.Err() == nil {
+		attempts++
+		replayed += b.replay(ctx)
+
+		if !b.pending() {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(drainInterval):
+		}
+	}
+
+	b.mu.Lock()
+	remaining := len(b.entries)
+	b.mu.Unlock()
+
+	if remaining == 0 {
+		level.Info(b.logger).Log("msg", "drained write buffer", "attempts", attempts, "replayed", replayed)
+		return 0
+	}
+
+	level.Warn(b.logger).Log(
+		"msg", "failed to drain write buffer",
+		"attempts", attempts,
+		"replayed", replayed,
+		"remaining", remaining,
+		"persisted", b.dir != "",
+	)
+
+	return remaining
+}
+
+// replay sends buffered writes to the upstream in order until one fails transiently
+// and returns the number of writes replayed successfully.
+func (b *WriteBuffer) replay(ctx context.Context) int {
+	var replayed int
+
+	for {
+		b.mu.Lock()
+		if len(b.entries) == 0 {
+			b.mu.Unlock()
+			return replayed
+		}
+		e := b.entries[0]
+		next := e.next
+		if next == nil {
+			next = b.handlers[e.path]
+		}
+		b.mu.Unlock()
+
+		if next == nil {
+			level.Debug(b.logger).Log("msg", "no handler for restored buffered write yet, postponing replay", "path", e.path)
+			return replayed
+		}
+
+		code, err := b.send(ctx, next, e)
+		if err == nil && isTransientStatus(code) {
+			level.Debug(b.logger).Log("msg", "upstream still failing, postponing replay of buffered writes", "status", code)
+			return replayed
+		}
+
+		switch {
+		case err != nil:
+			level.Warn(b.logger).Log("msg", "dropping buffered write that cannot be replayed", "err", err)
+			b.dropped.Inc()
+		case code/100 != 2:
+			level.Warn(b.logger).Log("msg", "upstream rejected buffered write", "status", code)
+			b.dropped.Inc()
+		default:
+			b.replayed.Inc()
+			replayed++
+		}
+
+		b.remove(e)
+
+		if ctx.Err() != nil {
+			return replayed
+		}
+	}
+}
+
+// send replays a single buffered write through the next handler and returns the resulting status code.
+func (b *WriteBuffer) send(ctx context.Context, next http.Handler, e *bufferedWrite) (int, error) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(e.raw)))
+	if err != nil {
+		return 0, fmt.Errorf("parse buffered request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+
+	// The buffered request is replayed through the same chi sub-router it was originally served by.
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, chi.NewRouteContext())
+	ctx = context.WithValue(ctx, middleware.RequestIDKey, fmt.Sprintf("write-buffer-%d", e.seq))
+
+	rec := newResponseRecorder()
+	next.ServeHTTP(rec, r.WithContext(ctx))
+
+	return rec.code, nil
+}
+
+// pending reports whether there are buffered writes waiting to be replayed.
+func (b *WriteBuffer) pending() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.entries) > 0
+}
+
+// enqueue adds the request, to be replayed through next, to the end of the buffer. If the buffer is full, it drops the oldest entries
+// or, if the policy is to reject, returns false without buffering the request.
+// Requests identical to a buffered one are not buffered again.
+func (b *WriteBuffer) enqueue(r *http.Request, next http.Handler, body []byte) bool {
+	var buf bytes.Buffer
+
+	req := r.Clone(context.Background())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+
+	for _, h := range bufferedCredentialHeaders {
+		req.Header.Del(h)
+	}
+
+	if err := req.Write(&buf); err != nil {
+		level.Warn(b.logger).Log("msg", "failed to serialize write request for buffering", "err", err)
+		b.dropped.Inc()
+
+		return true
+	}
+
+	d := sha256.Sum256(buf.Bytes())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.digests[d]; ok {
+		level.Debug(b.logger).Log("msg", "identical write already buffered, deduplicating write")
+		b.deduplicated.Inc()
+
+		return true
+	}
+
+	if b.fullPolicy == WriteBufferFullReject && b.size+buf.Len() > b.maxBytes {
+		level.Debug(b.logger).Log("msg", "write buffer full, rejecting write", "bytes", buf.Len())
+		b.full.WithLabelValues("rejected").Inc()
+
+		return false
+	}
+
+	if buf.Len() > b.maxBytes {
+		level.Warn(b.logger).Log("msg", "write request too large to be buffered", "bytes", buf.Len())
+		b.dropped.Inc()
+
+		return true
+	}
+
+	for b.size+buf.Len() > b.maxBytes && len(b.entries) > 0 {
+		level.Warn(b.logger).Log("msg", "write buffer full, dropping oldest buffered write")
+		b.dropped.Inc()
+		b.full.WithLabelValues("dropped_oldest").Inc()
+		b.removeLocked(b.entries[0])
+	}
+
+	b.seq++
+	e := &bufferedWrite{seq: b.seq, raw: buf.Bytes(), digest: d, path: r.URL.Path, next: next}
+
+	if b.dir != "" {
+		if err := b.persist(e); err != nil {
+			level.Warn(b.logger).Log("msg", "failed to persist buffered write, keeping it in memory only", "err", err)
+		}
+	}
+
+	b.entries = append(b.entries, e)
+	b.digests[e.digest] = struct{}{}
+	b.size += len(e.raw)
+	b.bytes.Set(float64(b.size))
+	b.buffered.Inc()
+
+	return true
+}
+
+// remove removes the given entry from the buffer.
+func (b *WriteBuffer) remove(e *bufferedWrite) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.removeLocked(e)
+}
+
+func (b *WriteBuffer) removeLocked(e *bufferedWrite) {
+	for i := range b.entries {
+		if b.entries[i] != e {
+			continue
+		}
+
+		b.entries = append(b.entries[:i], b.entries[i+1:]...)
+		delete(b.digests, e.digest)
+		b.size -= len(e.raw)
+		b.bytes.Set(float64(b.size))
+
+		if b.dir != "" {
+			if err := os.Remove(b.filename(e)); err != nil && !os.IsNotExist(err) {
+				level.Warn(b.logger).Log("msg", "failed to remove buffered write from disk", "err", err)
+			}
+		}
+
+		return
+	}
+}
+
+// persist atomically writes the entry to the buffer's directory.
+func (b *WriteBuffer) persist(e *bufferedWrite) error {
+	tmp := b.filename(e) + ".tmp"
+	if err := ioutil.WriteFile(tmp, e.raw, 0o640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, b.filename(e))
+}
+
+func (b *WriteBuffer) filename(e *bufferedWrite) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", e.seq, bufferFileSuffix))
+}
+
+// isTransientStatus reports whether the status code signals a transient upstream failure.
+func isTransientStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// responseRecorder records a response so that it can be inspected before it is sent to the client.
+type responseRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, code: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+// writeTo sends the recorded response to the given writer.
+func (r *responseRecorder) writeTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+
+	w.WriteHeader(r.code)
+	_, _ = w.Write(r.body.Bytes())
+}
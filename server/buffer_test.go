@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeUpstream is a write upstream that can be taken down and records the writes it received.
+type writeUpstream struct {
+	mu     sync.Mutex
+	down   bool
+	writes []string
+	auth   []string
+}
+
+func (u *writeUpstream) setDown(down bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.down = down
+}
+
+func (u *writeUpstream) received() ([]string, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.writes, u.auth
+}
+
+func (u *writeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	u.writes = append(u.writes, string(body))
+	u.auth = append(u.auth, r.Header.Get("Authorization"))
+}
+
+func sendWrite(h http.Handler, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/receive", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	return rec
+}
+
+func TestWriteBufferReplaysInOrder(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	b, err := NewWriteBuffer(log.NewNopLogger(), reg, 1<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &writeUpstream{down: true}
+	h := b.Middleware(u)
+
+	for _, body := range []string{"1", "2", "2", "3"} {
+		if rec := sendWrite(h, body); rec.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d while the upstream is down; got %d", http.StatusAccepted, rec.Code)
+		}
+	}
+
+	u.setDown(false)
+
+	// Writes are buffered while buffered writes are pending, even if the upstream recovered.
+	if rec := sendWrite(h, "4"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d while writes are pending; got %d", http.StatusAccepted, rec.Code)
+	}
+
+	if n := b.replay(context.Background()); n != 4 {
+		t.Errorf("expected 4 writes to be replayed; got %d", n)
+	}
+
+	writes, auth := u.received()
+	if expected := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(writes, expected) {
+		t.Errorf("expected writes %q; got %q", expected, writes)
+	}
+
+	if expected := []string{"", "", "", ""}; !reflect.DeepEqual(auth, expected) {
+		t.Errorf("expected client credentials not to be buffered; got Authorization headers %q", auth)
+	}
+
+	if rec := sendWrite(h, "5"); rec.Code != http.StatusOK {
+		t.Errorf("expected status %d once the buffer is empty; got %d", http.StatusOK, rec.Code)
+	}
+
+	expected := `
+# HELP http_write_buffer_buffered_total Total number of write requests buffered because of a failing upstream.
+# TYPE http_write_buffer_buffered_total counter
+http_write_buffer_buffered_total 4
+# HELP http_write_buffer_deduplicated_total Total number of write requests not buffered because an identical request was already buffered.
+# TYPE http_write_buffer_deduplicated_total counter
+http_write_buffer_deduplicated_total 1
+# HELP http_write_buffer_replayed_total Total number of buffered write requests replayed to the upstream.
+# TYPE http_write_buffer_replayed_total counter
+http_write_buffer_replayed_total 4
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"http_write_buffer_buffered_total", "http_write_buffer_deduplicated_total", "http_write_buffer_replayed_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteBufferFullPolicy(t *testing.T) {
+	const size = 1 << 10
+
+	bodies := []string{strings.Repeat("a", size), strings.Repeat("b", size), strings.Repeat("c", size)}
+
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		codes    []int
+		replayed []string
+		outcome  string
+	}{
+		{
+			name:     "drop oldest",
+			policy:   WriteBufferFullDropOldest,
+			codes:    []int{http.StatusAccepted, http.StatusAccepted, http.StatusAccepted},
+			replayed: bodies[1:],
+			outcome:  "dropped_oldest",
+		},
+		{
+			name:     "reject",
+			policy:   WriteBufferFullReject,
+			codes:    []int{http.StatusAccepted, http.StatusAccepted, http.StatusServiceUnavailable},
+			replayed: bodies[:2],
+			outcome:  "rejected",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+
+			// The buffer fits two of the writes including their headers.
+			b, err := NewWriteBuffer(log.NewNopLogger(), reg, 2*size+size/2, "", WithWriteBufferFullPolicy(tc.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u := &writeUpstream{down: true}
+			h := b.Middleware(u)
+
+			for i, body := range bodies {
+				rec := sendWrite(h, body)
+				if rec.Code != tc.codes[i] {
+					t.Fatalf("expected status %d for write %d; got %d", tc.codes[i], i, rec.Code)
+				}
+
+				if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+					t.Error("expected rejected write to have a Retry-After header")
+				}
+			}
+
+			u.setDown(false)
+			b.replay(context.Background())
+
+			if writes, _ := u.received(); !reflect.DeepEqual(writes, tc.replayed) {
+				t.Errorf("expected %d writes to be replayed; got %d", len(tc.replayed), len(writes))
+			}
+
+			expected := `
+# HELP http_write_buffer_full_total Total number of write requests that did not fit into the write buffer by outcome, rejected or dropped_oldest.
+# TYPE http_write_buffer_full_total counter
+http_write_buffer_full_total{outcome="` + tc.outcome + `"} 1
+`
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_write_buffer_full_total"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWriteBufferReplaysAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewWriteBuffer(log.NewNopLogger(), nil, 1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := b.Middleware(&writeUpstream{down: true})
+
+	for _, body := range []string{"1", "2"} {
+		if rec := sendWrite(h, body); rec.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d while the upstream is down; got %d", http.StatusAccepted, rec.Code)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+bufferFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("expected 2 buffered writes on disk; got %d", len(files))
+	}
+
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(raw, []byte("secret")) {
+			t.Errorf("expected client credentials not to be persisted in %s", f)
+		}
+	}
+
+	// A new buffer on the same directory restores the writes and replays them in order.
+	b, err = NewWriteBuffer(log.NewNopLogger(), nil, 1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &writeUpstream{}
+	h = b.Middleware(u)
+
+	// Writes identical to a restored one are deduplicated.
+	if rec := sendWrite(h, "2"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d while writes are pending; got %d", http.StatusAccepted, rec.Code)
+	}
+
+	b.replay(context.Background())
+
+	if writes, _ := u.received(); !reflect.DeepEqual(writes, []string{"1", "2"}) {
+		t.Errorf("expected writes %q; got %q", []string{"1", "2"}, writes)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+bufferFileSuffix)); len(files) != 0 {
+		t.Errorf("expected replayed writes to be removed from disk; got %d files", len(files))
+	}
+}
+
+func TestWriteBufferDrain(t *testing.T) {
+	b, err := NewWriteBuffer(log.NewNopLogger(), prometheus.NewRegistry(), 1<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &writeUpstream{down: true}
+	h := b.Middleware(u)
+
+	for _, body := range []string{"1", "2"} {
+		if rec := sendWrite(h, body); rec.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d while the upstream is down; got %d", http.StatusAccepted, rec.Code)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if remaining := b.Drain(ctx); remaining != 2 {
+		t.Errorf("expected 2 writes to remain while the upstream is down; got %d", remaining)
+	}
+
+	if d := time.Since(start); d > drainInterval/2 {
+		t.Errorf("expected draining to stop at the deadline; took %s", d)
+	}
+
+	u.setDown(false)
+
+	if remaining := b.Drain(context.Background()); remaining != 0 {
+		t.Errorf("expected no writes to remain once the upstream is up; got %d", remaining)
+	}
+
+	if writes, _ := u.received(); !reflect.DeepEqual(writes, []string{"1", "2"}) {
+		t.Errorf("expected writes %v to be replayed; got %v", []string{"1", "2"}, writes)
+	}
+}
+
+func TestWriteBufferReplaysThroughRoute(t *testing.T) {
+	b, err := NewWriteBuffer(log.NewNopLogger(), nil, 1<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive, push := &writeUpstream{down: true}, &writeUpstream{down: true}
+
+	r := chi.NewRouter()
+	r.With(b.Middleware).Handle("/api/v1/receive", receive)
+	r.With(b.Middleware).Handle("/api/v1/push", push)
+
+	for _, w := range []struct {
+		path string
+		body string
+	}{
+		{path: "/api/v1/receive", body: "1"},
+		{path: "/api/v1/push", body: "2"},
+		{path: "/api/v1/receive", body: "3"},
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, w.path, strings.NewReader(w.body)))
+
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d while the upstreams are down; got %d", http.StatusAccepted, rec.Code)
+		}
+	}
+
+	receive.setDown(false)
+	push.setDown(false)
+
+	b.replay(context.Background())
+
+	if writes, _ := receive.received(); !reflect.DeepEqual(writes, []string{"1", "3"}) {
+		t.Errorf("expected writes %q to be replayed to the receive route; got %q", []string{"1", "3"}, writes)
+	}
+
+	if writes, _ := push.received(); !reflect.DeepEqual(writes, []string{"2"}) {
+		t.Errorf("expected writes %q to be replayed to the push route; got %q", []string{"2"}, writes)
+	}
+}
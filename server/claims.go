@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/observatorium/observatorium/authentication"
+)
+
+// WithClaimHeaders returns a middleware that forwards claims of the authenticated token to the upstream.
+// The given map maps claim names to the request headers they are set in, e.g. {"sub": "X-Auth-Subject"}.
+// Client-provided values for these headers are always removed, so they cannot be spoofed.
+func WithClaimHeaders(headers map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, h := range headers {
+				r.Header.Del(h)
+			}
+
+			claims, ok := authentication.GetClaims(r.Context())
+			if ok {
+				for claim, h := range headers {
+					if v, ok := claims[claim]; ok {
+						r.Header.Set(h, claimValue(v))
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// claimValue formats a claim value as a header value, list claims are joined by commas.
+func claimValue(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, claimValue(e))
+		}
+
+		return strings.Join(values, ",")
+	case float64:
+		// JSON numbers are decoded as floats, avoid exponent notation for e.g. timestamps.
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithClaimHeadersStripsSpoofedHeaders(t *testing.T) {
+	var subject, email string
+
+	h := WithClaimHeaders(map[string]string{
+		"sub":   "X-Auth-Subject",
+		"email": "X-Auth-Email",
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, email = r.Header.Get("X-Auth-Subject"), r.Header.Get("X-Auth-Email")
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/metrics/v1/test/api/v1/query", nil)
+	r.Header.Set("X-Auth-Subject", "admin")
+	r.Header.Set("X-Auth-Email", "admin@example.com")
+
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if subject != "" || email != "" {
+		t.Errorf("expected client-provided claim headers to be removed; got subject %q and email %q", subject, email)
+	}
+}
+
+func TestClaimValue(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{
+			name:     "string",
+			value:    "user",
+			expected: "user",
+		},
+		{
+			name:     "timestamp",
+			value:    float64(1588291200),
+			expected: "1588291200",
+		},
+		{
+			name:     "boolean",
+			value:    true,
+			expected: "true",
+		},
+		{
+			name:     "list",
+			value:    []interface{}{"team-a", "team-b", float64(1)},
+			expected: "team-a,team-b,1",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if v := claimValue(tc.value); v != tc.expected {
+				t.Errorf("expected %q; got %q", tc.expected, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+// maxCoalescedResponseBytes bounds the size of a response kept to be shared with identical requests.
+const maxCoalescedResponseBytes = 1 << 20
+
+// coalescedCall is a query request in flight whose response is shared with identical requests.
+type coalescedCall struct {
+	done chan struct{}
+	// shared is set once done if the response can be shared, i.e. it was successful and small enough to be kept.
+	shared bool
+	header http.Header
+	body   []byte
+}
+
+// WithRequestCoalescing returns a middleware that sends only one of identical GET queries in flight at the same time
+// to the upstream and shares its response with the others. Only successful responses of at most
+// maxCoalescedResponseBytes are shared; otherwise every waiting request is sent to the upstream on its own.
+// The response is passed on to the client of the first request as it is written.
+func WithRequestCoalescing() func(http.Handler) http.Handler {
+	var (
+		mu    sync.Mutex
+		calls = map[string]*coalescedCall{}
+	)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := queryKey(r)
+
+			mu.Lock()
+			c, ok := calls[key]
+
+			if !ok {
+				c = &coalescedCall{done: make(chan struct{})}
+				calls[key] = c
+			}
+			mu.Unlock()
+
+			if !ok {
+				cw := &coalescingResponseWriter{ResponseWriter: w, header: http.Header{}}
+				next.ServeHTTP(cw, r)
+
+				if !cw.wroteHeader {
+					cw.WriteHeader(http.StatusOK)
+				}
+
+				if cw.code == http.StatusOK && cw.body != nil {
+					c.shared = true
+					c.header = cw.header
+					c.body = cw.body.Bytes()
+				}
+
+				mu.Lock()
+				delete(calls, key)
+				mu.Unlock()
+				close(c.done)
+
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-c.done:
+			}
+
+			if !c.shared {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for k, v := range c.header {
+				w.Header()[k] = append([]string{}, v...)
+			}
+
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(c.body)
+		})
+	}
+}
+
+// coalescingResponseWriter passes a response on to the client while keeping a copy of it
+// of at most maxCoalescedResponseBytes to be shared.
+type coalescingResponseWriter struct {
+	http.ResponseWriter
+	// header is the header of the response, passed on once the status code is known.
+	header      http.Header
+	wroteHeader bool
+	code        int
+	// body holds the copy of the response, it is nil once the response exceeds maxCoalescedResponseBytes.
+	body *bytes.Buffer
+}
+
+func (w *coalescingResponseWriter) Header() http.Header {
+	if w.wroteHeader {
+		return w.ResponseWriter.Header()
+	}
+
+	return w.header
+}
+
+func (w *coalescingResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	w.code = code
+	w.body = &bytes.Buffer{}
+
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *coalescingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.body != nil {
+		if w.body.Len()+len(b) > maxCoalescedResponseBytes {
+			w.body = nil
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *coalescingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		return
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithRequestCoalescing(t *testing.T) {
+	const waiting = 4
+
+	large := strings.Repeat("a", maxCoalescedResponseBytes+1)
+
+	for _, tc := range []struct {
+		name      string
+		code      int
+		body      string
+		encodings []string
+		calls     int64
+	}{
+		{
+			name:      "shared",
+			code:      http.StatusOK,
+			body:      "result",
+			encodings: []string{"", "", "", "", ""},
+			calls:     1,
+		},
+		{
+			name:      "by encoding",
+			code:      http.StatusOK,
+			body:      "result",
+			encodings: []string{"", "gzip", "gzip", "", "gzip"},
+			calls:     2,
+		},
+		{
+			name:      "failed",
+			code:      http.StatusInternalServerError,
+			body:      "failed",
+			encodings: []string{"", "", "", "", ""},
+			calls:     1 + waiting,
+		},
+		{
+			name:      "too large to share",
+			code:      http.StatusOK,
+			body:      large,
+			encodings: []string{"", "", "", "", ""},
+			calls:     1 + waiting,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				calls   int64
+				arrived int64
+				release = make(chan struct{})
+				wg      sync.WaitGroup
+			)
+
+			coalesced := WithRequestCoalescing()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&calls, 1)
+				<-release
+
+				w.Header().Set("Content-Encoding", r.Header.Get("Accept-Encoding"))
+				w.WriteHeader(tc.code)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&arrived, 1)
+				coalesced.ServeHTTP(w, r)
+			})
+
+			recs := make([]*httptest.ResponseRecorder, len(tc.encodings))
+
+			for i, encoding := range tc.encodings {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+				if encoding != "" {
+					r.Header.Set("Accept-Encoding", encoding)
+				}
+
+				recs[i] = httptest.NewRecorder()
+
+				wg.Add(1)
+
+				go func(rec *httptest.ResponseRecorder) {
+					defer wg.Done()
+					h.ServeHTTP(rec, r)
+				}(recs[i])
+			}
+
+			for atomic.LoadInt64(&arrived) < int64(len(tc.encodings)) {
+				time.Sleep(time.Millisecond)
+			}
+
+			// Give the requests time to join the request in flight.
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if got := atomic.LoadInt64(&calls); got != tc.calls {
+				t.Errorf("expected %d requests to the upstream; got %d", tc.calls, got)
+			}
+
+			for i, rec := range recs {
+				if rec.Code != tc.code || rec.Body.String() != tc.body {
+					t.Errorf("expected status %d and %d bytes for request %d; got %d and %d bytes",
+						tc.code, len(tc.body), i, rec.Code, rec.Body.Len())
+				}
+
+				if got := rec.Header().Get("Content-Encoding"); got != tc.encodings[i] {
+					t.Errorf("expected Content-Encoding %q for request %d; got %q", tc.encodings[i], i, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// WithQueryComplexityLimits returns a middleware that rejects queries with more than maxSelectors vector selectors
+// or more than maxMatchers label matchers in total, including the metric names, with 400 Bad Request.
+// A limit of zero disables it. Queries that cannot be parsed are passed on, so that the upstream reports the error.
+func WithQueryComplexityLimits(maxSelectors, maxMatchers int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			expr, err := parser.ParseExpr(param(r, "query"))
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var selectors, matchers int
+
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					selectors++
+					matchers += len(vs.LabelMatchers)
+				}
+
+				return nil
+			})
+
+			if maxSelectors > 0 && selectors > maxSelectors {
+				http.Error(w, fmt.Sprintf("query has %d vector selectors, exceeding the limit of %d", selectors, maxSelectors),
+					http.StatusBadRequest)
+
+				return
+			}
+
+			if maxMatchers > 0 && matchers > maxMatchers {
+				http.Error(w, fmt.Sprintf("query has %d label matchers, exceeding the limit of %d", matchers, maxMatchers),
+					http.StatusBadRequest)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
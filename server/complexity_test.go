@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWithQueryComplexityLimits(t *testing.T) {
+	h := WithQueryComplexityLimits(2, 3)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		query string
+		code  int
+	}{
+		{
+			name:  "within limits",
+			path:  "/api/v1/query",
+			query: `rate(http_requests_total{job="api"}[5m]) / rate(http_requests_total[5m])`,
+			code:  http.StatusOK,
+		},
+		{
+			name:  "too many selectors",
+			path:  "/api/v1/query_range",
+			query: `up + up + up`,
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "too many matchers",
+			path:  "/api/v1/query",
+			query: `up{job="api", instance="a", pod="b"}`,
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "invalid query",
+			path:  "/api/v1/query",
+			query: `up{`,
+			code:  http.StatusOK,
+		},
+		{
+			name:  "not a query",
+			path:  "/api/v1/series",
+			query: `up + up + up`,
+			code:  http.StatusOK,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path+"?query="+url.QueryEscape(tc.query), nil))
+
+			if w.Code != tc.code {
+				t.Errorf("expected status code %d; got %d: %s", tc.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
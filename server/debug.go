@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// WithDebugHeader returns a middleware that logs single requests in detail if they carry the token in the header
+// with the given name, e.g. X-Debug, so that a client's requests can be debugged without raising the log level.
+// Such requests are logged at info level with their parameters, the upstreams they were proxied to
+// and the durations of their phases and middleware stages, as far as these are timed with TimePhase and TimeStage.
+// Requests with a missing or wrong token are served as usual. The header is never passed on to the upstreams.
+func WithDebugHeader(logger log.Logger, name, token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(name)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r.Header.Del(name)
+
+			if subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+
+			t, ok := ctx.Value(serverTimingKey{}).(*serverTiming)
+			if !ok {
+				t = &serverTiming{start: time.Now()}
+				ctx = context.WithValue(ctx, serverTimingKey{}, t)
+			}
+
+			// The Server-Timing header of debugged requests reports their middleware stages too.
+			t.mtx.Lock()
+			t.debug = true
+			t.mtx.Unlock()
+
+			var (
+				mtx       sync.Mutex
+				upstreams []string
+			)
+
+			// The proxies' transports report the upstreams they connect to for requests derived from this one.
+			ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+				GetConn: func(hostPort string) {
+					mtx.Lock()
+					upstreams = append(upstreams, hostPort)
+					mtx.Unlock()
+				},
+			})
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			level.Info(logger).Log(
+				"msg", "debug request",
+				"request", middleware.GetReqID(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"params", r.URL.RawQuery,
+				"status", ww.Status(),
+				"upstreams", strings.Join(upstreams, ","),
+				"timing", t.header(true),
+			)
+		})
+	}
+}
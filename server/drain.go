@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// drainPollInterval is the interval at which active streams are checked while draining.
+const drainPollInterval = 500 * time.Millisecond
+
+// Drainer tracks active requests and streams, so that the server can be shut down in two phases:
+// regular requests get a short timeout to complete, long-running streams a longer one.
+type Drainer struct {
+	logger   log.Logger
+	requests int64
+	streams  int64
+}
+
+// NewDrainer creates a new Drainer.
+func NewDrainer(logger log.Logger) *Drainer {
+	return &Drainer{logger: logger}
+}
+
+// Middleware returns a middleware that tracks the active requests and streams.
+func (d *Drainer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter := &d.requests
+		if isStreamRequest(r) {
+			counter = &d.streams
+		}
+
+		atomic.AddInt64(counter, 1)
+		defer atomic.AddInt64(counter, -1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown stops the server from accepting new connections and waits up to requestTimeout for active requests to complete.
+// If streams or requests are still active after that, it waits for them until streamTimeout after the start of the shutdown
+// and then closes the server. The number of active requests and streams is logged at the end of each phase.
+func (d *Drainer) Shutdown(s *http.Server, requestTimeout, streamTimeout time.Duration) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	err := s.Shutdown(ctx)
+
+	cancel()
+
+	requests, streams := d.active()
+	level.Info(d.logger).Log("msg", "finished draining requests", "active_requests", requests, "active_streams", streams)
+
+	if err == nil && requests+streams == 0 {
+		return
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), start.Add(streamTimeout))
+	defer cancel()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for requests+streams > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			requests, streams = d.active()
+		}
+	}
+
+	level.Info(d.logger).Log("msg", "finished draining streams", "active_requests", requests, "active_streams", streams)
+
+	_ = s.Close()
+}
+
+func (d *Drainer) active() (requests, streams int64) {
+	return atomic.LoadInt64(&d.requests), atomic.LoadInt64(&d.streams)
+}
+
+// isStreamRequest reports whether the request is expected to be long-running,
+// i.e. it tails logs, asks for Server-Sent Events or upgrades the connection.
+func isStreamRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/tail") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream") ||
+		r.Header.Get("Upgrade") != ""
+}
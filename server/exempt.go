@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// exemptKey is the context key marking requests to exempt paths.
+type exemptKey struct{}
+
+// WithExemptPaths returns a middleware that marks requests to the given paths as exempt, declaring in one place
+// which paths of the public API, e.g. a public status route, skip authentication, rate limiting and access logging.
+// Exempt requests are passed on to their routes like all others; the middlewares of these chains skip them
+// if they are wrapped with SkipExempt. Paths must match exactly.
+func WithExemptPaths(paths []string) func(http.Handler) http.Handler {
+	exempt := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		exempt[p] = struct{}{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := exempt[r.URL.Path]; ok {
+				r = r.WithContext(context.WithValue(r.Context(), exemptKey{}, true))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IsExempt reports whether the request of the context was marked as exempt by WithExemptPaths.
+func IsExempt(ctx context.Context) bool {
+	exempt, _ := ctx.Value(exemptKey{}).(bool)
+	return exempt
+}
+
+// SkipExempt returns a middleware that applies m to all requests except the ones marked as exempt by WithExemptPaths,
+// which are passed on to the next handler directly.
+func SkipExempt(m func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		h := m(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsExempt(r.Context()) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-kit/kit/log"
+	"github.com/observatorium/observatorium/authentication"
+)
+
+func TestWithExemptPaths(t *testing.T) {
+	const public = "/api/metrics/v1/a/api/v1/rules"
+
+	// requireToken stands in for a tenant's authentication middleware.
+	requireToken := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	var logs bytes.Buffer
+
+	r := chi.NewRouter()
+	r.Use(WithExemptPaths([]string{public}))
+	r.Use(SkipExempt(Logger(log.NewLogfmtLogger(&logs))))
+	r.With(
+		authentication.WithTenant,
+		SkipExempt(authentication.WithTenantMiddlewares(map[string]authentication.Middleware{"a": requireToken})),
+	).Get("/api/metrics/v1/{tenant}/api/v1/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(chi.URLParam(r, "endpoint")))
+	})
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		token bool
+		code  int
+		body  string
+	}{
+		{
+			name: "exempt path without token",
+			path: public,
+			code: http.StatusOK,
+			body: "rules",
+		},
+		{
+			name: "other path without token",
+			path: "/api/metrics/v1/a/api/v1/query",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name:  "other path with token",
+			path:  "/api/metrics/v1/a/api/v1/query",
+			token: true,
+			code:  http.StatusOK,
+			body:  "query",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.token {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("expected the request to reach its route; got body %q", rec.Body.String())
+			}
+
+			if logged := strings.Contains(logs.String(), tc.path); logged == (tc.path == public) {
+				t.Errorf("expected request to be logged: %t; got log %q", tc.path != public, logs.String())
+			}
+		})
+	}
+}
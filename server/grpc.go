@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	observatoriumv1 "github.com/observatorium/observatorium/proto/observatorium/v1"
+)
+
+// grpcForwardedMetadata are the gRPC metadata keys passed on to the HTTP handler as headers,
+// so that clients authenticate as they do over HTTP.
+var grpcForwardedMetadata = []string{"authorization", "x-request-id"}
+
+type grpcConfig struct {
+	listen    string
+	tlsConfig *tls.Config
+}
+
+// GRPCOption modifies the configuration of a gRPC server.
+type GRPCOption func(c *grpcConfig)
+
+// WithGRPCListen sets the address the gRPC server listens on.
+func WithGRPCListen(addr string) GRPCOption {
+	return func(c *grpcConfig) {
+		c.listen = addr
+	}
+}
+
+// WithGRPCTLS makes the gRPC server serve TLS with the given configuration, e.g. the one of the HTTP server.
+// Client certificates verified by it authenticate requests as they do over HTTP.
+func WithGRPCTLS(tlsConfig *tls.Config) GRPCOption {
+	return func(c *grpcConfig) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+// GRPCServer serves the metrics query API over gRPC for clients that prefer it over HTTP.
+// Queries are translated to requests to the metrics API of the given HTTP handler, usually the gateway's own router,
+// so that they are authenticated, authorized and limited like any other query before being proxied to the upstream.
+type GRPCServer struct {
+	logger  log.Logger
+	handler http.Handler
+	listen  string
+	server  *grpc.Server
+}
+
+// NewGRPCServer creates a gRPC server translating queries to requests to the given HTTP handler.
+func NewGRPCServer(logger log.Logger, handler http.Handler, opts ...GRPCOption) *GRPCServer {
+	c := &grpcConfig{}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	var serverOpts []grpc.ServerOption
+	if c.tlsConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(c.tlsConfig)))
+	}
+
+	s := &GRPCServer{
+		logger:  logger,
+		handler: handler,
+		listen:  c.listen,
+		server:  grpc.NewServer(serverOpts...),
+	}
+
+	observatoriumv1.RegisterQueryServer(s.server, s)
+
+	return s
+}
+
+// ListenAndServe listens on the configured address and serves gRPC requests until Shutdown is called.
+func (s *GRPCServer) ListenAndServe() error {
+	if s.listen == "" {
+		return errors.New("no gRPC listen address configured")
+	}
+
+	l, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return fmt.Errorf("listen on %q: %w", s.listen, err)
+	}
+
+	level.Info(s.logger).Log("msg", "starting the gRPC server", "address", s.listen)
+
+	return s.server.Serve(l)
+}
+
+// Shutdown stops accepting requests and waits for the pending ones to finish.
+func (s *GRPCServer) Shutdown() {
+	s.server.GracefulStop()
+}
+
+// Query implements the observatoriumv1.QueryServer interface.
+func (s *GRPCServer) Query(ctx context.Context, in *observatoriumv1.QueryRequest) (*observatoriumv1.QueryResponse, error) {
+	if in.Tenant == "" || in.Query == "" {
+		return nil, status.Error(codes.InvalidArgument, "tenant and query are required")
+	}
+
+	params := url.Values{"query": []string{in.Query}}
+	endpoint := "query"
+
+	if in.Step != "" {
+		endpoint = "query_range"
+		params.Set("start", in.Start)
+		params.Set("end", in.End)
+		params.Set("step", in.Step)
+	} else if in.Time != "" {
+		params.Set("time", in.Time)
+	}
+
+	if in.Timeout != "" {
+		params.Set("timeout", in.Timeout)
+	}
+
+	u := url.URL{
+		Path:     path.Join("/api/metrics/v1", url.PathEscape(in.Tenant), "api/v1", endpoint),
+		RawQuery: params.Encode(),
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Handlers read the request URI like the one of an incoming HTTP request, e.g. for logging and limits.
+	r.RequestURI = u.RequestURI()
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, k := range grpcForwardedMetadata {
+			for _, v := range md.Get(k) {
+				r.Header.Add(k, v)
+			}
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+
+	rec := newResponseRecorder()
+	s.handler.ServeHTTP(rec, r)
+
+	if rec.code != http.StatusOK {
+		return nil, status.Error(grpcCode(rec.code), rec.body.String())
+	}
+
+	return &observatoriumv1.QueryResponse{Body: rec.body.Bytes()}, nil
+}
+
+// grpcCode maps the status code of a failed HTTP response to the corresponding gRPC status code.
+func grpcCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
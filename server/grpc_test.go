@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	observatoriumv1 "github.com/observatorium/observatorium/proto/observatorium/v1"
+)
+
+func TestGRPCServerQuery(t *testing.T) {
+	r := chi.NewRouter()
+	r.Get("/api/metrics/v1/{tenant}/api/v1/{endpoint}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "tenant") == "forbidden" {
+			http.Error(w, "tenant is forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.RequestURI, r.Header.Get("Authorization"))
+	})
+
+	s := NewGRPCServer(log.NewNopLogger(), r)
+	l := bufconn.Listen(1 << 20)
+
+	go func() {
+		_ = s.server.Serve(l)
+	}()
+	defer s.Shutdown()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	client := observatoriumv1.NewQueryClient(conn)
+
+	for _, tc := range []struct {
+		name string
+		req  *observatoriumv1.QueryRequest
+		code codes.Code
+		body string
+	}{
+		{
+			name: "instant query",
+			req:  &observatoriumv1.QueryRequest{Tenant: "a", Query: "up", Time: "1"},
+			code: codes.OK,
+			body: "/api/metrics/v1/a/api/v1/query?query=up&time=1 Bearer token",
+		},
+		{
+			name: "range query",
+			req:  &observatoriumv1.QueryRequest{Tenant: "a", Query: "up", Start: "1", End: "2", Step: "1s", Timeout: "5s"},
+			code: codes.OK,
+			body: "/api/metrics/v1/a/api/v1/query_range?end=2&query=up&start=1&step=1s&timeout=5s Bearer token",
+		},
+		{
+			name: "missing query",
+			req:  &observatoriumv1.QueryRequest{Tenant: "a"},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "denied by handler",
+			req:  &observatoriumv1.QueryRequest{Tenant: "forbidden", Query: "up"},
+			code: codes.PermissionDenied,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+
+			res, err := client.Query(ctx, tc.req)
+			if code := status.Code(err); code != tc.code {
+				t.Fatalf("expected code %s; got %s: %v", tc.code, code, err)
+			}
+			if err != nil {
+				return
+			}
+			if body := string(res.Body); body != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"hash/fnv"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithUpstreamHeaders returns a middleware that sets the given headers, e.g. {"Authorization": "Bearer ..."},
+// on all requests forwarded to the upstreams. Client-provided values of these headers are replaced.
+func WithUpstreamHeaders(headers map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for h, v := range headers {
+				r.Header.Set(h, v)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithQueryUpstreamHeaders returns a middleware that sets the given headers on requests forwarded to the read upstreams,
+// e.g. a read-scoped token. It is meant for the read routes only and, applied after WithUpstreamHeaders,
+// its values take precedence over the ones set for all upstreams.
+func WithQueryUpstreamHeaders(headers map[string]string) func(http.Handler) http.Handler {
+	return WithUpstreamHeaders(headers)
+}
+
+// WithWriteUpstreamHeaders returns a middleware that sets the given headers on requests forwarded to the write upstreams,
+// e.g. a write-scoped token. It is meant for the write routes only and, applied after WithUpstreamHeaders,
+// its values take precedence over the ones set for all upstreams.
+func WithWriteUpstreamHeaders(headers map[string]string) func(http.Handler) http.Handler {
+	return WithUpstreamHeaders(headers)
+}
+
+// WithCanaryHeader returns a middleware that sets the header with the given name and value on the given fraction,
+// between 0 and 1, of the requests forwarded to the upstreams, which can route them to experimental code paths
+// without the upstream URL changing. Requests are selected by their request ID, so that requests retried with
+// the same X-Request-Id header are selected consistently.
+// Client-provided values of the header are removed from requests that are not selected.
+func WithCanaryHeader(reg prometheus.Registerer, name, value string, fraction float64) func(http.Handler) http.Handler {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_canary_requests_total",
+		Help: "Counter of requests forwarded to the upstreams by whether they were tagged with the canary header.",
+	}, []string{"canary"})
+
+	if reg != nil {
+		reg.MustRegister(requests)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if canarySelected(middleware.GetReqID(r.Context()), fraction) {
+				requests.WithLabelValues("true").Inc()
+				r.Header.Set(name, value)
+			} else {
+				requests.WithLabelValues("false").Inc()
+				r.Header.Del(name)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// canarySelected deterministically decides whether the request with the given ID is part of the given fraction.
+// Request IDs are mostly sequential, so the hash is mixed with the finalizer of MurmurHash3
+// to spread IDs differing only in their last digits evenly.
+func canarySelected(reqID string, fraction float64) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(reqID))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return float64(x>>11)/(1<<53) < fraction
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithUpstreamHeaders(t *testing.T) {
+	var received http.Header
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	})
+
+	all := WithUpstreamHeaders(map[string]string{"X-Scope": "all", "Authorization": "Bearer all"})
+
+	for _, tc := range []struct {
+		name     string
+		handler  http.Handler
+		expected map[string]string
+	}{
+		{
+			name:     "all upstreams",
+			handler:  all(upstream),
+			expected: map[string]string{"X-Scope": "all", "Authorization": "Bearer all"},
+		},
+		{
+			name:     "read upstreams",
+			handler:  all(WithQueryUpstreamHeaders(map[string]string{"Authorization": "Bearer read"})(upstream)),
+			expected: map[string]string{"X-Scope": "all", "Authorization": "Bearer read"},
+		},
+		{
+			name:     "write upstreams",
+			handler:  all(WithWriteUpstreamHeaders(map[string]string{"Authorization": "Bearer write"})(upstream)),
+			expected: map[string]string{"X-Scope": "all", "Authorization": "Bearer write"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("Authorization", "Bearer client")
+			r.Header.Set("X-Scope", "client")
+
+			tc.handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			for h, v := range tc.expected {
+				if got := received.Values(h); len(got) != 1 || got[0] != v {
+					t.Errorf("expected header %s to be %q; got %q", h, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWithCanaryHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fraction float64
+		min, max int
+	}{
+		{name: "none", fraction: 0, min: 0, max: 0},
+		{name: "fraction", fraction: 0.3, min: 2700, max: 3300},
+		{name: "all", fraction: 1, min: 10000, max: 10000},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+
+			var canary bool
+
+			h := WithCanaryHeader(reg, "X-Canary", "true", tc.fraction)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				canary = r.Header.Get("X-Canary") == "true"
+			}))
+
+			serve := func(reqID string) bool {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+				r.Header.Set("X-Canary", "true")
+				h.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, reqID)))
+
+				return canary
+			}
+
+			var selected int
+
+			// Request IDs generated by chi differ only in their trailing counter.
+			for i := 0; i < 10000; i++ {
+				reqID := "observatorium/abcdef-" + strconv.Itoa(i)
+
+				s := serve(reqID)
+				if s {
+					selected++
+				}
+
+				if serve(reqID) != s {
+					t.Fatalf("expected request %s to be selected consistently", reqID)
+				}
+			}
+
+			if selected < tc.min || selected > tc.max {
+				t.Errorf("expected between %d and %d of 10000 requests to be tagged; got %d", tc.min, tc.max, selected)
+			}
+
+			expected := `
+# HELP http_canary_requests_total Counter of requests forwarded to the upstreams by whether they were tagged with the canary header.
+# TYPE http_canary_requests_total counter
+`
+			for _, c := range []struct {
+				label string
+				count int
+			}{{label: "false", count: 10000 - selected}, {label: "true", count: selected}} {
+				if c.count > 0 {
+					// Every request was sent twice.
+					expected += fmt.Sprintf("http_canary_requests_total{canary=%q} %d\n", c.label, 2*c.count)
+				}
+			}
+
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/metalmatze/signal/healthcheck"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithWarmup returns a function adding a readiness check to a healthcheck.Handler that fails
+// until the given warmup period has passed, so that both of its readiness endpoints answer with 503 Service Unavailable.
+// This gives connection pools time to fill before the server receives traffic.
+// A zero duration skips the warmup and leaves the handler unchanged.
+func WithWarmup(d time.Duration) func(healthcheck.Handler) healthcheck.Handler {
+	return func(h healthcheck.Handler) healthcheck.Handler {
+		if d > 0 {
+			h.AddReadinessCheck("warmup", warmupCheck(d))
+		}
+
+		return h
+	}
+}
+
+// warmupCheck returns a check that fails until the given warmup period has passed.
+func warmupCheck(d time.Duration) healthcheck.Check {
+	ready := time.Now().Add(d)
+
+	return func() error {
+		if remaining := time.Until(ready); remaining > 0 {
+			return fmt.Errorf("warming up, ready in %s", remaining.Round(time.Second))
+		}
+
+		return nil
+	}
+}
+
+// checkAgeHandler is a healthcheck.Handler recording when each of its checks last succeeded.
+type checkAgeHandler struct {
+	healthcheck.Handler
+	registry prometheus.Registerer
+}
+
+// NewCheckAgeHandler returns a healthcheck.Handler that exposes the time since each check last succeeded
+// as the healthcheck_last_success_age_seconds gauge, next to the checks' status.
+// Until a check succeeds for the first time, the age counts from when it was added.
+// A growing age reveals checks that keep failing or stall, e.g. because of a stuck goroutine.
+func NewCheckAgeHandler(handler healthcheck.Handler, reg prometheus.Registerer) healthcheck.Handler {
+	return &checkAgeHandler{Handler: handler, registry: reg}
+}
+
+func (h *checkAgeHandler) AddLivenessCheck(name string, check healthcheck.Check) {
+	h.Handler.AddLivenessCheck(name, h.wrap(prometheus.Labels{"name": name, "check": "live"}, check))
+}
+
+func (h *checkAgeHandler) AddReadinessCheck(name string, check healthcheck.Check) {
+	h.Handler.AddReadinessCheck(name, h.wrap(prometheus.Labels{"name": name, "check": "ready"}, check))
+}
+
+func (h *checkAgeHandler) wrap(labels prometheus.Labels, check healthcheck.Check) healthcheck.Check {
+	var (
+		mtx         sync.Mutex
+		lastSuccess = time.Now()
+	)
+
+	h.registry.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "healthcheck_last_success_age_seconds",
+			Help:        "The time in seconds since the check last succeeded.",
+			ConstLabels: labels,
+		},
+		func() float64 {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			return time.Since(lastSuccess).Seconds()
+		},
+	))
+
+	return func() error {
+		if err := check(); err != nil {
+			return err
+		}
+
+		mtx.Lock()
+		lastSuccess = time.Now()
+		mtx.Unlock()
+
+		return nil
+	}
+}
+
+// Statuses reported in the body of health endpoints.
+const (
+	HealthStatusOK          = "ok"
+	HealthStatusUnavailable = "unavailable"
+)
+
+// HealthResponse is the default JSON body of the health endpoints.
+type HealthResponse struct {
+	Status    string            `json:"status"`
+	Timestamp time.Time         `json:"timestamp"`
+	Checks    map[string]string `json:"checks,omitempty"`
+}
+
+type healthConfig struct {
+	contentType string
+	body        func(HealthResponse) interface{}
+}
+
+// HealthOption modifies the configuration of a health endpoint.
+type HealthOption func(c *healthConfig)
+
+// WithHealthContentType sets the content type of the health endpoint responses.
+func WithHealthContentType(contentType string) HealthOption {
+	return func(c *healthConfig) {
+		c.contentType = contentType
+	}
+}
+
+// WithHealthBody replaces the body of the health endpoint responses
+// with the JSON encoding of the value returned by the given function.
+func WithHealthBody(body func(HealthResponse) interface{}) HealthOption {
+	return func(c *healthConfig) {
+		c.body = body
+	}
+}
+
+// HealthHandler returns a handler that runs the given healthcheck endpoint, e.g. LiveEndpoint or ReadyEndpoint,
+// and answers with its status code and a JSON body containing the status, a timestamp and the results of the checks.
+// This makes the endpoints usable by health-check tooling that parses the body instead of only the status code.
+func HealthHandler(endpoint http.HandlerFunc, opts ...HealthOption) http.HandlerFunc {
+	c := &healthConfig{
+		contentType: "application/json; charset=utf-8",
+		body: func(res HealthResponse) interface{} {
+			return res
+		},
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := newResponseRecorder()
+		endpoint(rec, r)
+
+		if rec.code == http.StatusMethodNotAllowed {
+			rec.writeTo(w)
+			return
+		}
+
+		res := HealthResponse{
+			Status:    HealthStatusOK,
+			Timestamp: time.Now().UTC(),
+		}
+
+		if rec.code != http.StatusOK {
+			res.Status = HealthStatusUnavailable
+		}
+
+		// The healthcheck endpoints answer with the results of the checks by name.
+		// An empty or unexpected body only means there are no check results to report.
+		_ = json.Unmarshal(rec.body.Bytes(), &res.Checks)
+
+		w.Header().Set("Content-Type", c.contentType)
+		w.WriteHeader(rec.code)
+		_ = json.NewEncoder(w).Encode(c.body(res))
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/metalmatze/signal/healthcheck"
+)
+
+func TestWithWarmup(t *testing.T) {
+	ready := func(h healthcheck.Handler) int {
+		rec := httptest.NewRecorder()
+		h.ReadyEndpoint(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+		return rec.Code
+	}
+
+	t.Run("skipped", func(t *testing.T) {
+		h := WithWarmup(0)(healthcheck.NewHandler())
+
+		if code := ready(h); code != http.StatusOK {
+			t.Errorf("expected status %d without warmup; got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("warmup", func(t *testing.T) {
+		h := WithWarmup(100 * time.Millisecond)(healthcheck.NewHandler())
+
+		if code := ready(h); code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d while warming up; got %d", http.StatusServiceUnavailable, code)
+		}
+
+		time.Sleep(150 * time.Millisecond)
+
+		if code := ready(h); code != http.StatusOK {
+			t.Errorf("expected status %d after warming up; got %d", http.StatusOK, code)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// DefaultHTTP2MaxConcurrentStreams is the default number of streams a client may open concurrently on one connection.
+	DefaultHTTP2MaxConcurrentStreams = 100
+	// DefaultHTTP2MaxReadFrameSize is the default size of the largest frame the server reads.
+	DefaultHTTP2MaxReadFrameSize = 256 * 1024
+)
+
+type http2Config struct {
+	maxConcurrentStreams uint32
+	maxReadFrameSize     uint32
+}
+
+// HTTP2Option modifies the HTTP/2 configuration of a server.
+type HTTP2Option func(c *http2Config)
+
+// WithHTTP2MaxConcurrentStreams limits the number of streams a client may open concurrently on one connection,
+// so that a single client cannot monopolize the server by multiplexing many requests.
+func WithHTTP2MaxConcurrentStreams(n uint32) HTTP2Option {
+	return func(c *http2Config) {
+		c.maxConcurrentStreams = n
+	}
+}
+
+// WithHTTP2MaxReadFrameSize sets the size of the largest frame the server reads, between 16KiB and 16MiB.
+func WithHTTP2MaxReadFrameSize(n uint32) HTTP2Option {
+	return func(c *http2Config) {
+		c.maxReadFrameSize = n
+	}
+}
+
+// ConfigureHTTP2 configures the HTTP/2 support of a server serving TLS. It must be called after the server's TLSConfig is set.
+func ConfigureHTTP2(s *http.Server, opts ...HTTP2Option) error {
+	c := &http2Config{
+		maxConcurrentStreams: DefaultHTTP2MaxConcurrentStreams,
+		maxReadFrameSize:     DefaultHTTP2MaxReadFrameSize,
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return http2.ConfigureServer(s, &http2.Server{
+		MaxConcurrentStreams: c.maxConcurrentStreams,
+		MaxReadFrameSize:     c.maxReadFrameSize,
+	})
+}
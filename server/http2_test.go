@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestConfigureHTTP2(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		opts                 []HTTP2Option
+		maxConcurrentStreams uint32
+		maxFrameSize         uint32
+	}{
+		{
+			name:                 "default",
+			maxConcurrentStreams: DefaultHTTP2MaxConcurrentStreams,
+			maxFrameSize:         DefaultHTTP2MaxReadFrameSize,
+		},
+		{
+			name:                 "configured",
+			opts:                 []HTTP2Option{WithHTTP2MaxConcurrentStreams(10), WithHTTP2MaxReadFrameSize(32 * 1024)},
+			maxConcurrentStreams: 10,
+			maxFrameSize:         32 * 1024,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			if err := ConfigureHTTP2(s.Config, tc.opts...); err != nil {
+				t.Fatal(err)
+			}
+
+			s.TLS = s.Config.TLSConfig
+			s.StartTLS()
+			defer s.Close()
+
+			config := s.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			config.NextProtos = []string{http2.NextProtoTLS}
+
+			conn, err := tls.Dial("tcp", s.Listener.Addr().String(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+				t.Fatal(err)
+			}
+
+			fr := http2.NewFramer(conn, conn)
+			if err := fr.WriteSettings(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			settings, ok := f.(*http2.SettingsFrame)
+			if !ok {
+				t.Fatalf("expected the server to send its settings first; got %v", f)
+			}
+
+			if v, _ := settings.Value(http2.SettingMaxConcurrentStreams); v != tc.maxConcurrentStreams {
+				t.Errorf("expected max concurrent streams %d; got %d", tc.maxConcurrentStreams, v)
+			}
+
+			if v, _ := settings.Value(http2.SettingMaxFrameSize); v != tc.maxFrameSize {
+				t.Errorf("expected max frame size %d; got %d", tc.maxFrameSize, v)
+			}
+		})
+	}
+}
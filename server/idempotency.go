@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/observatorium/authentication"
+)
+
+const (
+	// maxIdempotencyKeys bounds the number of idempotency keys whose responses are kept.
+	maxIdempotencyKeys = 10000
+	// maxIdempotencyKeyLength bounds the length of idempotency keys, longer keys are ignored.
+	maxIdempotencyKeyLength = 256
+	// maxIdempotentResponseBytes bounds the size of a single response kept for replaying.
+	maxIdempotentResponseBytes = 4 << 10
+)
+
+// idempotentCall is a write request with an idempotency key, either in flight or answered at stored.
+type idempotentCall struct {
+	done   chan struct{}
+	rec    *responseRecorder
+	stored time.Time
+}
+
+// WithWriteIdempotency returns a middleware that deduplicates write requests carrying a key in the header
+// with the given name, e.g. Idempotency-Key, so that batches sent again by retrying clients are not written twice.
+// Requests repeating the key of a request answered successfully within the TTL get its response replayed
+// without being passed on; requests repeating the key of a request in flight wait for its response.
+// Failed requests are not remembered, so that they can be retried; one of the requests waiting for them is passed on instead.
+// Keys are scoped by tenant and at most maxIdempotencyKeys are remembered, evicting the oldest ones first.
+func WithWriteIdempotency(headerName string, ttl time.Duration) func(http.Handler) http.Handler {
+	var (
+		mu    sync.Mutex
+		calls = map[string]*idempotentCall{}
+		// order holds the keys of answered calls from oldest to newest.
+		order []string
+	)
+
+	// pruneLocked removes the calls that expired or exceed the maximum number of keys.
+	// As all calls share the TTL, they expire in the order they were answered.
+	pruneLocked := func() {
+		for len(order) > 0 && (len(order) > maxIdempotencyKeys || time.Since(calls[order[0]].stored) > ttl) {
+			delete(calls, order[0])
+			order = order[1:]
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(headerName)
+			if id == "" || len(id) > maxIdempotencyKeyLength {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			tenant, _ := authentication.GetTenant(r.Context())
+			key := strings.Join([]string{tenant, r.URL.Path, id}, "\xff")
+
+			for {
+				mu.Lock()
+				pruneLocked()
+
+				c, ok := calls[key]
+				if !ok {
+					c = &idempotentCall{done: make(chan struct{}), rec: newResponseRecorder()}
+					calls[key] = c
+				}
+				mu.Unlock()
+
+				if !ok {
+					next.ServeHTTP(c.rec, r)
+
+					mu.Lock()
+					if c.rec.code >= 200 && c.rec.code < 300 && c.rec.body.Len() <= maxIdempotentResponseBytes {
+						c.stored = time.Now()
+						order = append(order, key)
+					} else {
+						delete(calls, key)
+					}
+					mu.Unlock()
+					close(c.done)
+
+					c.rec.writeTo(w)
+
+					return
+				}
+
+				select {
+				case <-r.Context().Done():
+					return
+				case <-c.done:
+				}
+
+				// If the call was not remembered, the first waiter to get here sends its request
+				// and the others wait for it, rather than all sending the batch again at once.
+				if c.stored.IsZero() {
+					continue
+				}
+
+				for k, v := range c.rec.header {
+					w.Header()[k] = append([]string{}, v...)
+				}
+
+				w.WriteHeader(c.rec.code)
+				_, _ = w.Write(c.rec.body.Bytes())
+
+				return
+			}
+		})
+	}
+}
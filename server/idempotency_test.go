@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotentWrite sends a write request with the idempotency key and returns its response.
+func idempotentWrite(h http.Handler, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/receive", nil)
+	r.Header.Set(idempotencyHeader, key)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	return rec
+}
+
+func TestWithWriteIdempotency(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ttl   time.Duration
+		keys  []string
+		sleep time.Duration
+		calls int64
+	}{
+		{
+			name:  "replay",
+			ttl:   time.Minute,
+			keys:  []string{"a", "a", "b", "a"},
+			calls: 2,
+		},
+		{
+			name:  "expired",
+			ttl:   10 * time.Millisecond,
+			keys:  []string{"a", "a"},
+			sleep: 20 * time.Millisecond,
+			calls: 2,
+		},
+		{
+			name:  "no key",
+			ttl:   time.Minute,
+			keys:  []string{"", ""},
+			calls: 2,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int64
+
+			h := WithWriteIdempotency(idempotencyHeader, tc.ttl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt64(&calls, 1)
+				w.Header().Set("X-Call", fmt.Sprint(n))
+				w.WriteHeader(http.StatusAccepted)
+			}))
+
+			first := map[string]string{}
+
+			for _, k := range tc.keys {
+				rec := idempotentWrite(h, k)
+				if rec.Code != http.StatusAccepted {
+					t.Fatalf("expected status %d; got %d", http.StatusAccepted, rec.Code)
+				}
+
+				call := rec.Header().Get("X-Call")
+				if c, ok := first[k]; ok && k != "" && tc.sleep == 0 && c != call {
+					t.Errorf("expected response of call %s to be replayed for key %q; got call %s", c, k, call)
+				}
+				first[k] = call
+
+				time.Sleep(tc.sleep)
+			}
+
+			if calls != tc.calls {
+				t.Errorf("expected %d requests to be passed on; got %d", tc.calls, calls)
+			}
+		})
+	}
+}
+
+func TestWithWriteIdempotencyEviction(t *testing.T) {
+	var calls int64
+
+	h := WithWriteIdempotency(idempotencyHeader, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+	}))
+
+	for i := 0; i <= maxIdempotencyKeys; i++ {
+		idempotentWrite(h, fmt.Sprint(i))
+	}
+
+	// Pruning happens on the next request, which evicts the oldest key.
+	idempotentWrite(h, "1")
+	idempotentWrite(h, "0")
+
+	if expected := int64(maxIdempotencyKeys + 2); calls != expected {
+		t.Errorf("expected %d requests to be passed on; got %d", expected, calls)
+	}
+}
+
+func TestWithWriteIdempotencyFailure(t *testing.T) {
+	var (
+		calls   int64
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	h := WithWriteIdempotency(idempotencyHeader, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			close(entered)
+			<-release
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	codes := make([]int, 3)
+
+	for i := range codes {
+		i := i
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			codes[i] = idempotentWrite(h, "a").Code
+		}()
+
+		if i == 0 {
+			<-entered
+		}
+	}
+
+	// Give the other requests time to wait for the first one.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if codes[0] != http.StatusInternalServerError {
+		t.Errorf("expected the first request to fail with status %d; got %d", http.StatusInternalServerError, codes[0])
+	}
+
+	for _, code := range codes[1:] {
+		if code != http.StatusAccepted {
+			t.Errorf("expected the waiting requests to succeed with status %d; got %d", http.StatusAccepted, code)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("expected only one waiting request to be passed on after the failure; got %d requests passed on", calls)
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithIdleExit returns a middleware that calls exit once, if no request was received for the given duration,
+// e.g. to shut down observatorium run by ephemeral task runners and free its resources.
+// The duration starts anew with every request; requests still in flight keep the server from being idle.
+func WithIdleExit(d time.Duration, exit func()) func(http.Handler) http.Handler {
+	var (
+		mtx      sync.Mutex
+		inflight int
+		once     sync.Once
+	)
+
+	timer := time.AfterFunc(d, func() {
+		once.Do(exit)
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			inflight++
+			timer.Stop()
+			mtx.Unlock()
+
+			defer func() {
+				mtx.Lock()
+				inflight--
+				if inflight == 0 {
+					timer.Reset(d)
+				}
+				mtx.Unlock()
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
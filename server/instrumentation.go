@@ -1,16 +1,60 @@
 package server
 
 import (
+	"hash/fnv"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/metalmatze/signal/server/signalhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// defaultSlowRequestThreshold is the duration above which requests are logged regardless of sampling.
+const defaultSlowRequestThreshold = 10 * time.Second
+
+type loggerConfig struct {
+	sampleRate    float64
+	slowThreshold time.Duration
+}
+
+// LoggerOption modifies the configuration of the request logger.
+type LoggerOption func(c *loggerConfig)
+
+// WithAccessLogSampleRate makes the logger log only the given fraction, between 0 and 1, of successful requests.
+// Failed requests (>= 500) and slow requests are always logged.
+// Whether a request is sampled is decided by its request ID, so the decision is the same wherever it is made.
+// The decision of WithSampling takes precedence for requests it handled.
+func WithAccessLogSampleRate(fraction float64) LoggerOption {
+	return func(c *loggerConfig) {
+		c.sampleRate = fraction
+	}
+}
+
+// WithSlowRequestThreshold sets the duration above which requests are always logged.
+func WithSlowRequestThreshold(d time.Duration) LoggerOption {
+	return func(c *loggerConfig) {
+		c.slowThreshold = d
+	}
+}
+
 // Logger returns a middleware to log HTTP requests.
-func Logger(logger log.Logger) func(next http.Handler) http.Handler {
+func Logger(logger log.Logger, opts ...LoggerOption) func(next http.Handler) http.Handler {
+	c := &loggerConfig{
+		sampleRate:    1,
+		slowThreshold: defaultSlowRequestThreshold,
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
@@ -18,14 +62,17 @@ func Logger(logger log.Logger) func(next http.Handler) http.Handler {
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 			next.ServeHTTP(ww, r)
 
+			duration := time.Since(start)
+			reqID := middleware.GetReqID(r.Context())
+
 			keyvals := []interface{}{
-				"request", middleware.GetReqID(r.Context()),
+				"request", reqID,
 				"proto", r.Proto,
 				"method", r.Method,
 				"status", ww.Status(),
 				"content", r.Header.Get("Content-Type"),
 				"path", r.URL.Path,
-				"duration", time.Since(start),
+				"duration", duration,
 				"bytes", ww.BytesWritten(),
 			}
 
@@ -33,7 +80,246 @@ func Logger(logger log.Logger) func(next http.Handler) http.Handler {
 				level.Warn(logger).Log(keyvals...)
 				return
 			}
+			decision, ok := IsSampled(r.Context())
+			if !ok {
+				decision = sampled(reqID, c.sampleRate)
+			}
+			if duration < c.slowThreshold && !decision {
+				return
+			}
 			level.Debug(logger).Log(keyvals...)
 		})
 	}
 }
+
+// sampled deterministically decides whether the request with the given ID is part of the sample of the given rate.
+func sampled(reqID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+
+	if rate <= 0 {
+		return false
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(reqID))
+
+	return float64(h.Sum64())/float64(math.MaxUint64) < rate
+}
+
+// instrumenter records the metrics of HTTP requests like signalhttp's HandlerInstrumenter.
+// If size buckets are configured, the request size is recorded as a histogram with these buckets instead of a summary,
+// and the response size histogram uses them too.
+type instrumenter struct {
+	requestCounter  *prometheus.CounterVec
+	requestSize     prometheus.ObserverVec
+	requestDuration *prometheus.HistogramVec
+	responseSize    *prometheus.HistogramVec
+}
+
+func newInstrumenter(reg prometheus.Registerer, extraLabels []string, sizeBuckets []float64) *instrumenter {
+	labels := append([]string{"code", "method"}, extraLabels...)
+
+	var requestSize interface {
+		prometheus.ObserverVec
+		prometheus.Collector
+	}
+
+	responseSizeBuckets := sizeBuckets
+
+	if len(sizeBuckets) > 0 {
+		requestSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_size_bytes",
+			Help:    "Histogram of request size for HTTP requests.",
+			Buckets: sizeBuckets,
+		}, labels)
+	} else {
+		requestSize = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: "http_request_size_bytes",
+			Help: "Size of HTTP requests.",
+		}, labels)
+		responseSizeBuckets = defaultResponseSizeBuckets
+	}
+
+	ins := &instrumenter{
+		requestCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Counter of HTTP requests.",
+		}, labels),
+		requestSize: requestSize,
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Histogram of latencies for HTTP requests.",
+			Buckets: []float64{.1, .2, .4, 1, 2.5, 5, 8, 20, 60, 120},
+		}, labels),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Histogram of response size for HTTP requests.",
+			Buckets: responseSizeBuckets,
+		}, labels),
+	}
+
+	if reg != nil {
+		reg.MustRegister(ins.requestCounter, requestSize, ins.requestDuration, ins.responseSize)
+	}
+
+	return ins
+}
+
+// NewHandler implements the signalhttp.HandlerInstrumenter interface.
+func (i *instrumenter) NewHandler(labels prometheus.Labels, handler http.Handler) http.HandlerFunc {
+	return promhttp.InstrumentHandlerCounter(i.requestCounter.MustCurryWith(labels),
+		promhttp.InstrumentHandlerRequestSize(i.requestSize.MustCurryWith(labels),
+			instrumentHandlerDuration(i.requestDuration.MustCurryWith(labels),
+				promhttp.InstrumentHandlerResponseSize(i.responseSize.MustCurryWith(labels),
+					handler,
+				),
+			),
+		),
+	)
+}
+
+// instrumentHandlerDuration observes the duration of requests like promhttp.InstrumentHandlerDuration,
+// but attaches the request ID of requests sampled by WithSampling as an exemplar.
+func instrumentHandlerDuration(obs prometheus.ObserverVec, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+
+		o := obs.With(prometheus.Labels{"code": strconv.Itoa(code), "method": strings.ToLower(r.Method)})
+		observeWithExemplar(o, time.Since(start).Seconds(), r)
+	})
+}
+
+// otherLabelValue is the label value of requests whose header value is not in the allowlist.
+const otherLabelValue = "other"
+
+type headerLabel struct {
+	label   string
+	header  string
+	allowed []string
+}
+
+// defaultResponseSizeBuckets are the buckets of the response size histogram if no size buckets are configured,
+// the ones of signalhttp's HandlerInstrumenter.
+var defaultResponseSizeBuckets = prometheus.ExponentialBuckets(100, 10, 8) //nolint:gomnd
+
+type instrumenterConfig struct {
+	headerLabels []headerLabel
+	sizeBuckets  []float64
+}
+
+// InstrumenterOption modifies the configuration of a HandlerInstrumenter.
+type InstrumenterOption func(c *instrumenterConfig)
+
+// WithMetricLabelFromHeader adds the label to the request metrics, set to the value of the request header.
+// Values not in the allowed list are replaced by "other", which bounds the label's cardinality.
+func WithMetricLabelFromHeader(label, header string, allowed []string) InstrumenterOption {
+	return func(c *instrumenterConfig) {
+		c.headerLabels = append(c.headerLabels, headerLabel{label: label, header: header, allowed: allowed})
+	}
+}
+
+// WithSizeBuckets sets the buckets of the request and response size histograms in bytes.
+// It turns the request size metric, a summary by default, into a histogram, which breaks queries relying on its type.
+func WithSizeBuckets(buckets []float64) InstrumenterOption {
+	return func(c *instrumenterConfig) {
+		c.sizeBuckets = buckets
+	}
+}
+
+// headerInstrumenter is a signalhttp.HandlerInstrumenter that adds labels taken from request headers.
+type headerInstrumenter struct {
+	ins          signalhttp.HandlerInstrumenter
+	headerLabels []headerLabel
+}
+
+// NewHandlerInstrumenter creates a signalhttp.HandlerInstrumenter recording the request metrics
+// with the given extra labels and the labels configured by the options.
+func NewHandlerInstrumenter(reg prometheus.Registerer, extraLabels []string, opts ...InstrumenterOption) signalhttp.HandlerInstrumenter {
+	c := &instrumenterConfig{}
+	for _, o := range opts {
+		o(c)
+	}
+
+	if len(c.headerLabels) == 0 {
+		return newInstrumenter(reg, extraLabels, c.sizeBuckets)
+	}
+
+	labels := append([]string{}, extraLabels...)
+	for _, hl := range c.headerLabels {
+		labels = append(labels, hl.label)
+	}
+
+	return &headerInstrumenter{
+		ins:          newInstrumenter(reg, labels, c.sizeBuckets),
+		headerLabels: c.headerLabels,
+	}
+}
+
+// NewHandler implements the signalhttp.HandlerInstrumenter interface.
+func (i *headerInstrumenter) NewHandler(labels prometheus.Labels, handler http.Handler) http.HandlerFunc {
+	// Instrument the handler once for every combination of label values up front,
+	// the allowlists keep the number of combinations small.
+	handlers := map[string]http.Handler{}
+	combinations := []prometheus.Labels{labels}
+
+	for _, hl := range i.headerLabels {
+		var next []prometheus.Labels
+
+		values := append(append([]string{}, hl.allowed...), otherLabelValue)
+
+		for _, ls := range combinations {
+			for _, v := range values {
+				l := prometheus.Labels{hl.label: v}
+				for k, v := range ls {
+					l[k] = v
+				}
+
+				next = append(next, l)
+			}
+		}
+
+		combinations = next
+	}
+
+	for _, ls := range combinations {
+		handlers[i.key(ls)] = i.ins.NewHandler(ls, handler)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ls := prometheus.Labels{}
+
+		for _, hl := range i.headerLabels {
+			ls[hl.label] = otherLabelValue
+
+			value := r.Header.Get(hl.header)
+			for _, a := range hl.allowed {
+				if value == a {
+					ls[hl.label] = value
+					break
+				}
+			}
+		}
+
+		handlers[i.key(ls)].ServeHTTP(w, r)
+	}
+}
+
+// key identifies the combination of header label values in the given labels.
+func (i *headerInstrumenter) key(labels prometheus.Labels) string {
+	values := make([]string, 0, len(i.headerLabels))
+	for _, hl := range i.headerLabels {
+		values = append(values, labels[hl.label])
+	}
+
+	return strings.Join(values, "\xff")
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWithMetricLabelFromHeader(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ins := NewHandlerInstrumenter(reg, []string{"handler"}, WithMetricLabelFromHeader("client", "X-Client", []string{"grafana", "thanos"}))
+
+	h := ins.NewHandler(prometheus.Labels{"handler": "query"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, client := range []string{"grafana", "grafana", "thanos", "curl", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		if client != "" {
+			r.Header.Set("X-Client", client)
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]float64{}
+
+	for _, mf := range mfs {
+		if mf.GetName() != "http_requests_total" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "client" {
+					requests[l.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	for client, expected := range map[string]float64{"grafana": 2, "thanos": 1, otherLabelValue: 2} {
+		if requests[client] != expected {
+			t.Errorf("expected %v requests with client label %q; got %v", expected, client, requests[client])
+		}
+	}
+
+	if len(requests) != 3 {
+		t.Errorf("expected only allowed client label values and %q; got %v", otherLabelValue, requests)
+	}
+}
+
+func TestNewHandlerInstrumenterSizeMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		opts                []InstrumenterOption
+		requestSizeType     dto.MetricType
+		responseSizeBuckets int
+	}{
+		{
+			name:                "default",
+			requestSizeType:     dto.MetricType_SUMMARY,
+			responseSizeBuckets: len(defaultResponseSizeBuckets),
+		},
+		{
+			name:                "size buckets",
+			opts:                []InstrumenterOption{WithSizeBuckets([]float64{1 << 10, 1 << 20})},
+			requestSizeType:     dto.MetricType_HISTOGRAM,
+			responseSizeBuckets: 2,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			ins := NewHandlerInstrumenter(reg, []string{"handler"}, tc.opts...)
+
+			h := ins.NewHandler(prometheus.Labels{"handler": "receive"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/receive", strings.NewReader("write")))
+
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			families := map[string]*dto.MetricFamily{}
+			for _, mf := range mfs {
+				families[mf.GetName()] = mf
+			}
+
+			if got := families["http_request_size_bytes"].GetType(); got != tc.requestSizeType {
+				t.Errorf("expected http_request_size_bytes of type %s; got %s", tc.requestSizeType, got)
+			}
+
+			res := families["http_response_size_bytes"]
+			if got := len(res.GetMetric()[0].GetHistogram().GetBucket()); got != tc.responseSizeBuckets {
+				t.Errorf("expected %d buckets of http_response_size_bytes; got %d", tc.responseSizeBuckets, got)
+			}
+		})
+	}
+}
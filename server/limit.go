@@ -0,0 +1,358 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observatorium/observatorium/authentication"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// retryAfter is the default time clients are asked to wait before retrying rejected requests.
+	retryAfter = 5 * time.Second
+	// longRange is the range above which range queries are considered expensive.
+	longRange = 24 * time.Hour
+)
+
+// Priority is the priority of a request when shedding load.
+type Priority int
+
+const (
+	// PriorityLow marks requests that are shed first, e.g. range queries over long ranges.
+	PriorityLow Priority = iota
+	// PriorityHigh marks interactive requests, e.g. instant queries and writes.
+	PriorityHigh
+)
+
+// String implements the Stringer interface.
+func (p Priority) String() string {
+	if p == PriorityLow {
+		return "low"
+	}
+
+	return "high"
+}
+
+// ClassifyRequest returns the load shedding priority of a request.
+// Range queries over more than a day as well as requests outside the query and write APIs,
+// e.g. for the UI, are of low priority; all other requests are of high priority.
+func ClassifyRequest(r *http.Request) Priority {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+		start, err := parseTime(param(r, "start"))
+		if err != nil {
+			return PriorityHigh
+		}
+
+		end, err := parseTime(param(r, "end"))
+		if err != nil {
+			return PriorityHigh
+		}
+
+		if end.Sub(start) > longRange {
+			return PriorityLow
+		}
+
+		return PriorityHigh
+	case strings.Contains(r.URL.Path, "/api/"):
+		return PriorityHigh
+	default:
+		return PriorityLow
+	}
+}
+
+type limitConfig struct {
+	shedThreshold float64
+	classify      func(r *http.Request) Priority
+
+	queueLength  int
+	queueMaxWait time.Duration
+}
+
+// LimitOption modifies the configuration of a concurrency limit.
+type LimitOption func(c *limitConfig)
+
+// WithLoadShedding makes the concurrency limit reject low priority requests
+// once the share of used capacity exceeds the given threshold between 0 and 1,
+// so that capacity is left for high priority requests during spikes.
+func WithLoadShedding(threshold float64) LimitOption {
+	return func(c *limitConfig) {
+		c.shedThreshold = threshold
+	}
+}
+
+// WithAdmissionQueue makes requests beyond the concurrency limit wait in a FIFO queue of at most maxLen requests
+// for at most maxWait until they are admitted, so that brief bursts succeed instead of being rejected.
+// Requests arriving while the queue is full or waiting for longer than maxWait are rejected.
+// A maxWait of zero lets requests wait until they are canceled.
+func WithAdmissionQueue(maxLen int, maxWait time.Duration) LimitOption {
+	return func(c *limitConfig) {
+		c.queueLength = maxLen
+		c.queueMaxWait = maxWait
+	}
+}
+
+// WithConcurrencyLimit returns a middleware that limits the number of requests served concurrently.
+// Requests beyond the limit are rejected with 503 Service Unavailable and a Retry-After header,
+// unless they can wait for admission in the queue configured by WithAdmissionQueue.
+func WithConcurrencyLimit(reg prometheus.Registerer, limit int, opts ...LimitOption) func(http.Handler) http.Handler {
+	c := &limitConfig{
+		classify: ClassifyRequest,
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_inflight_requests",
+		Help: "Current number of HTTP requests being served.",
+	})
+	rejected := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_rejected_requests_total",
+		Help: "Counter of HTTP requests rejected because of the concurrency limit.",
+	}, []string{"reason", "priority"})
+	wait := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "http_admission_wait_seconds",
+		Help:    "Time HTTP requests waited before being admitted by the concurrency limit.",
+		Buckets: []float64{0.0001, 0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+
+	queued := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_admission_queue_length",
+		Help: "Current number of HTTP requests waiting in the queue for admission by the concurrency limit.",
+	})
+
+	if reg != nil {
+		reg.MustRegister(inflight, rejected, wait, queued)
+	}
+
+	sem := make(chan struct{}, limit)
+
+	// queueLength is the number of requests waiting for admission, it is kept separately from the gauge to be compared.
+	var queueLength int64
+
+	// admit blocks until the request is admitted and returns true, or returns false once the request is rejected
+	// with the reason or canceled, in which case the reason is empty.
+	admit := func(r *http.Request) (string, bool) {
+		select {
+		case sem <- struct{}{}:
+			return "", true
+		default:
+		}
+
+		if atomic.AddInt64(&queueLength, 1) > int64(c.queueLength) {
+			atomic.AddInt64(&queueLength, -1)
+			return "limit", false
+		}
+
+		queued.Inc()
+
+		defer func() {
+			atomic.AddInt64(&queueLength, -1)
+			queued.Dec()
+		}()
+
+		var timeout <-chan time.Time
+
+		if c.queueMaxWait > 0 {
+			t := time.NewTimer(c.queueMaxWait)
+			defer t.Stop()
+
+			timeout = t.C
+		}
+
+		// Blocked channel sends proceed in the order they started, which makes the queue FIFO.
+		select {
+		case sem <- struct{}{}:
+			return "", true
+		case <-timeout:
+			return "queue_timeout", false
+		case <-r.Context().Done():
+			return "", false
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			if c.shedThreshold > 0 && float64(len(sem))/float64(limit) >= c.shedThreshold {
+				if p := c.classify(r); p == PriorityLow {
+					rejected.WithLabelValues("shed", p.String()).Inc()
+					serviceUnavailable(w, r, UnavailableCauseShed, "server overloaded, low priority request shed")
+
+					return
+				}
+			}
+
+			if reason, ok := admit(r); !ok {
+				if reason != "" {
+					rejected.WithLabelValues(reason, c.classify(r).String()).Inc()
+					serviceUnavailable(w, r, UnavailableCauseLimit, "too many concurrent requests")
+				}
+
+				return
+			}
+
+			wait.Observe(time.Since(start).Seconds())
+			inflight.Inc()
+
+			defer func() {
+				<-sem
+				inflight.Dec()
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tenantLimit is the concurrency limit of a tenant.
+type tenantLimit struct {
+	sem    chan struct{}
+	queued int64
+	label  string
+}
+
+// WithTenantConcurrency returns a middleware that limits the number of requests of each tenant served concurrently,
+// so that a single tenant cannot use up the capacity shared by all tenants. Tenants are limited to the limit
+// configured for them or to def otherwise; a limit of 0 leaves a tenant unlimited.
+// Requests beyond their tenant's limit are rejected with 429 Too Many Requests and the Retry-After header
+// configured for UnavailableCauseLimit, unless they are admitted while waiting in the queue of the tenant configured by WithAdmissionQueue.
+// Requests in flight are exposed by tenant for the tenants with a configured limit, all others are summed up as other.
+func WithTenantConcurrency(reg prometheus.Registerer, limits map[string]int, def int, opts ...LimitOption) func(http.Handler) http.Handler {
+	c := &limitConfig{}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	inflight := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_tenant_inflight_requests",
+		Help: "Current number of HTTP requests being served by tenant, for tenants with a configured concurrency limit.",
+	}, []string{"tenant"})
+	rejected := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_tenant_rejected_requests_total",
+		Help: "Counter of HTTP requests rejected because of the concurrency limit of their tenant.",
+	}, []string{"tenant"})
+
+	if reg != nil {
+		reg.MustRegister(inflight, rejected)
+	}
+
+	configured := map[string]*tenantLimit{}
+	for tenant, limit := range limits {
+		if limit > 0 {
+			configured[tenant] = &tenantLimit{sem: make(chan struct{}, limit), label: tenant}
+		}
+	}
+
+	// Tenants without a configured limit are added as they send requests; they are bounded by the tenants configuration.
+	var (
+		mu     sync.Mutex
+		others = map[string]*tenantLimit{}
+	)
+
+	get := func(tenant string) *tenantLimit {
+		if _, ok := limits[tenant]; ok {
+			return configured[tenant]
+		}
+
+		if def <= 0 {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		t, ok := others[tenant]
+		if !ok {
+			t = &tenantLimit{sem: make(chan struct{}, def), label: "other"}
+			others[tenant] = t
+		}
+
+		return t
+	}
+
+	// admit blocks until the request is admitted by the limit of the tenant and returns true,
+	// or returns false once the request is rejected or canceled.
+	admit := func(t *tenantLimit, r *http.Request) bool {
+		select {
+		case t.sem <- struct{}{}:
+			return true
+		default:
+		}
+
+		if atomic.AddInt64(&t.queued, 1) > int64(c.queueLength) {
+			atomic.AddInt64(&t.queued, -1)
+			return false
+		}
+
+		defer atomic.AddInt64(&t.queued, -1)
+
+		var timeout <-chan time.Time
+
+		if c.queueMaxWait > 0 {
+			timer := time.NewTimer(c.queueMaxWait)
+			defer timer.Stop()
+
+			timeout = timer.C
+		}
+
+		select {
+		case t.sem <- struct{}{}:
+			return true
+		case <-timeout:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant, ok := authentication.GetTenant(r.Context())
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			t := get(tenant)
+			if t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !admit(t, r) {
+				if r.Context().Err() != nil {
+					return
+				}
+
+				d := retryAfter
+				if rc, ok := r.Context().Value(retryAfterKey{}).(retryAfterConfig); ok {
+					d = rc.delay(UnavailableCauseLimit)
+				}
+
+				rejected.WithLabelValues(t.label).Inc()
+				setRetryAfter(w, d)
+				http.Error(w, "too many concurrent requests of tenant "+tenant, http.StatusTooManyRequests)
+
+				return
+			}
+
+			inflight.WithLabelValues(t.label).Inc()
+
+			defer func() {
+				<-t.sem
+				inflight.WithLabelValues(t.label).Dec()
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/observatorium/observatorium/authentication"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		expected Priority
+	}{
+		{
+			name:     "instant query",
+			path:     "/api/metrics/v1/test/api/v1/query?query=up",
+			expected: PriorityHigh,
+		},
+		{
+			name:     "short range query",
+			path:     "/api/metrics/v1/test/api/v1/query_range?query=up&start=2020-01-01T00:00:00Z&end=2020-01-01T06:00:00Z",
+			expected: PriorityHigh,
+		},
+		{
+			name:     "long range query",
+			path:     "/api/metrics/v1/test/api/v1/query_range?query=up&start=1577836800&end=1578441600",
+			expected: PriorityLow,
+		},
+		{
+			name:     "range query without range",
+			path:     "/api/metrics/v1/test/api/v1/query_range?query=up",
+			expected: PriorityHigh,
+		},
+		{
+			name:     "write",
+			path:     "/api/metrics/v1/test/api/v1/receive",
+			expected: PriorityHigh,
+		},
+		{
+			name:     "ui",
+			path:     "/api/metrics/v1/test/graph",
+			expected: PriorityHigh,
+		},
+		{
+			name:     "outside the api",
+			path:     "/static/app.js",
+			expected: PriorityLow,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if p := ClassifyRequest(httptest.NewRequest(http.MethodGet, tc.path, nil)); p != tc.expected {
+				t.Errorf("expected priority %s; got %s", tc.expected, p)
+			}
+		})
+	}
+}
+
+func TestWithConcurrencyLimit(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	h := WithConcurrencyLimit(nil, 2, WithLoadShedding(0.5))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	serve := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		return rec.Code
+	}
+
+	// block sends a request that is held in flight until release is closed.
+	block := func() {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			serve("/api/v1/query")
+		}()
+
+		<-entered
+	}
+
+	block()
+
+	if code := serve("/static/app.js"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected low priority requests to be shed above the threshold; got status %d", code)
+	}
+
+	block()
+
+	if code := serve("/api/v1/query"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected requests beyond the limit to be rejected; got status %d", code)
+	}
+
+	close(release)
+	wg.Wait()
+
+	go func() { <-entered }()
+
+	if code := serve("/static/app.js"); code != http.StatusOK {
+		t.Errorf("expected low priority requests to be served below the threshold; got status %d", code)
+	}
+}
+
+func TestWithTenantConcurrencyAdmissionQueue(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	r := chi.NewRouter()
+	r.With(
+		authentication.WithTenant,
+		WithTenantConcurrency(nil, map[string]int{"a": 1}, 0, WithAdmissionQueue(1, 0)),
+	).Get("/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+
+	codes := make(chan int, 2)
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a", nil))
+			codes <- rec.Code
+		}()
+	}
+
+	// The first request is admitted, the second one waits in the queue.
+	<-entered
+	time.Sleep(50 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a", nil))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d with a full queue; got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	release <- struct{}{}
+	<-entered
+	release <- struct{}{}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected the admitted and the queued request to succeed; got status %d", code)
+		}
+	}
+}
+
+func TestWithConcurrencyLimitAdmissionQueue(t *testing.T) {
+	var (
+		entered = make(chan string)
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- r.URL.Path
+		<-release
+	})
+
+	// serve sends a request in the background.
+	serve := func(h http.Handler, path string) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}()
+	}
+
+	t.Run("fifo and full queue", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := WithConcurrencyLimit(reg, 1, WithAdmissionQueue(2, 0))(handler)
+
+		serve(h, "/api/0")
+		<-entered
+
+		serve(h, "/api/1")
+		waitQueueLength(t, reg, 1)
+		serve(h, "/api/2")
+		waitQueueLength(t, reg, 2)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/3", nil))
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d with a full queue; got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+
+		for _, expected := range []string{"/api/1", "/api/2"} {
+			release <- struct{}{}
+
+			if path := <-entered; path != expected {
+				t.Errorf("expected %s to be admitted next; got %s", expected, path)
+			}
+		}
+
+		release <- struct{}{}
+		wg.Wait()
+
+		expected := `
+# HELP http_admission_queue_length Current number of HTTP requests waiting in the queue for admission by the concurrency limit.
+# TYPE http_admission_queue_length gauge
+http_admission_queue_length 0
+# HELP http_rejected_requests_total Counter of HTTP requests rejected because of the concurrency limit.
+# TYPE http_rejected_requests_total counter
+http_rejected_requests_total{priority="high",reason="limit"} 1
+`
+		if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+			"http_admission_queue_length", "http_rejected_requests_total"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := WithConcurrencyLimit(reg, 1, WithAdmissionQueue(1, 10*time.Millisecond))(handler)
+
+		serve(h, "/api/0")
+		<-entered
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/1", nil))
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d after waiting in the queue; got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+
+		release <- struct{}{}
+		wg.Wait()
+
+		expected := `
+# HELP http_rejected_requests_total Counter of HTTP requests rejected because of the concurrency limit.
+# TYPE http_rejected_requests_total counter
+http_rejected_requests_total{priority="high",reason="queue_timeout"} 1
+`
+		if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_rejected_requests_total"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// waitQueueLength waits until the admission queue gauge reaches n
+// and gives the last queued request time to block on admission, so that requests are queued in a known order.
+func waitQueueLength(t *testing.T, g prometheus.Gatherer, n float64) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		mfs, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, mf := range mfs {
+			if mf.GetName() == "http_admission_queue_length" && queueGauge(mf) == n {
+				time.Sleep(10 * time.Millisecond)
+				return
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("admission queue did not reach length %v", n)
+}
+
+func queueGauge(mf *dto.MetricFamily) float64 {
+	if len(mf.GetMetric()) == 0 {
+		return 0
+	}
+
+	return mf.GetMetric()[0].GetGauge().GetValue()
+}
+
+func TestWithTenantConcurrency(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	reg := prometheus.NewRegistry()
+
+	r := chi.NewRouter()
+	r.With(
+		authentication.WithTenant,
+		WithTenantConcurrency(reg, map[string]int{"a": 1, "unlimited": 0}, 2),
+	).Get("/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+
+	// block sends a request of the tenant that is held in flight until release is closed.
+	block := func(tenant string) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+tenant, nil))
+		}()
+
+		<-entered
+	}
+
+	block("a")
+	block("b")
+	block("c")
+	block("c")
+
+	for i := 0; i < 3; i++ {
+		block("unlimited")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tenant string
+	}{
+		{
+			name:   "configured limit",
+			tenant: "a",
+		},
+		{
+			name:   "default limit",
+			tenant: "c",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+tc.tenant, nil))
+
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected status %d; got %d", http.StatusTooManyRequests, rec.Code)
+			}
+
+			if got := rec.Header().Get("Retry-After"); got != "5" {
+				t.Errorf("expected Retry-After header %q; got %q", "5", got)
+			}
+		})
+	}
+
+	expected := `
+# HELP http_tenant_inflight_requests Current number of HTTP requests being served by tenant, for tenants with a configured concurrency limit.
+# TYPE http_tenant_inflight_requests gauge
+http_tenant_inflight_requests{tenant="a"} 1
+http_tenant_inflight_requests{tenant="other"} 3
+# HELP http_tenant_rejected_requests_total Counter of HTTP requests rejected because of the concurrency limit of their tenant.
+# TYPE http_tenant_rejected_requests_total counter
+http_tenant_rejected_requests_total{tenant="a"} 1
+http_tenant_rejected_requests_total{tenant="other"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"http_tenant_inflight_requests", "http_tenant_rejected_requests_total"); err != nil {
+		t.Error(err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+
+	go func() { <-entered }()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d after the requests in flight finished; got %d", http.StatusOK, rec.Code)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// errBacklogNotSupported is returned by listen on platforms that cannot change the backlog of a listening socket.
+var errBacklogNotSupported = errors.New("setting the listen backlog is not supported on this platform")
+
+type listenConfig struct {
+	network         string
+	backlog         int
+	readBufferSize  int
+	writeBufferSize int
+	logger          log.Logger
+}
+
+// ListenOption modifies the configuration of a listener.
+type ListenOption func(c *listenConfig)
+
+// WithListenNetwork sets the network to listen on: tcp binds both IPv4 and IPv6 where supported,
+// tcp4 IPv4 only and tcp6 IPv6 only. The default is tcp.
+func WithListenNetwork(network string) ListenOption {
+	return func(c *listenConfig) {
+		c.network = network
+	}
+}
+
+// WithListenBacklog sets the size of the socket's accept backlog.
+// The value is only a hint: the kernel may cap it, e.g. to net.core.somaxconn on Linux.
+// A value of zero keeps the system default, as does any value on platforms that cannot set the backlog,
+// which is logged as a warning.
+func WithListenBacklog(n int) ListenOption {
+	return func(c *listenConfig) {
+		c.backlog = n
+	}
+}
+
+// WithConnBufferSizes sets the sizes of the kernel's receive and send buffers of accepted connections,
+// e.g. larger send buffers for large query responses on connections with a high bandwidth-delay product.
+// A size of zero keeps the system default, which on Linux is tuned automatically.
+func WithConnBufferSizes(read, write int) ListenOption {
+	return func(c *listenConfig) {
+		c.readBufferSize = read
+		c.writeBufferSize = write
+	}
+}
+
+// WithListenLogger sets the logger used to warn about options that are not supported on this platform.
+func WithListenLogger(logger log.Logger) ListenOption {
+	return func(c *listenConfig) {
+		c.logger = logger
+	}
+}
+
+// Listen announces on the given TCP address and returns a listener configured with the given options.
+func Listen(address string, opts ...ListenOption) (net.Listener, error) {
+	c := &listenConfig{network: "tcp", logger: log.NewNopLogger()}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	switch c.network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q, expected tcp, tcp4 or tcp6", c.network)
+	}
+
+	l, err := net.Listen(c.network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.backlog > 0 {
+		if err := setBacklog(l, c.backlog); errors.Is(err, errBacklogNotSupported) {
+			level.Warn(c.logger).Log("msg", "ignoring listen backlog, using the system default", "err", err)
+		} else if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("set listen backlog: %w", err)
+		}
+	}
+
+	if c.readBufferSize > 0 || c.writeBufferSize > 0 {
+		l = &bufferSizeListener{Listener: l, read: c.readBufferSize, write: c.writeBufferSize}
+	}
+
+	return l, nil
+}
+
+// bufferSizeListener sets the buffer sizes of the TCP connections it accepts.
+type bufferSizeListener struct {
+	net.Listener
+	read  int
+	write int
+}
+
+// Accept implements the net.Listener interface.
+func (l *bufferSizeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if l.read > 0 {
+			_ = tc.SetReadBuffer(l.read)
+		}
+
+		if l.write > 0 {
+			_ = tc.SetWriteBuffer(l.write)
+		}
+	}
+
+	return conn, nil
+}
+
+// setBacklog changes the accept backlog of an already listening socket.
+// The backlog cannot be set with a net.ListenConfig's Control function, as that runs before listen(2).
+func setBacklog(l net.Listener, backlog int) error {
+	sl, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener of type %T does not expose its socket", l)
+	}
+
+	rc, err := sl.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		lerr = listen(fd, backlog)
+	}); err != nil {
+		return err
+	}
+
+	return lerr
+}
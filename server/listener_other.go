@@ -0,0 +1,9 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package server
+
+// listen is not supported on this platform.
+func listen(_ uintptr, _ int) error {
+	return errBacklogNotSupported
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []ListenOption
+	}{
+		{name: "default"},
+		{name: "backlog", opts: []ListenOption{WithListenBacklog(16)}},
+		{name: "large backlog", opts: []ListenOption{WithListenBacklog(1 << 20)}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := Listen("127.0.0.1:0", tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			})}
+			defer s.Close()
+
+			go func() { _ = s.Serve(l) }()
+
+			res, err := http.Get("http://" + l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(body) != "ok" {
+				t.Errorf("expected body %q, got %q", "ok", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package server
+
+import (
+	"syscall"
+)
+
+// listen calls listen(2) again on a listening socket, which updates its backlog.
+func listen(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithMemoryPressureShedding returns a middleware that rejects requests with 503 Service Unavailable
+// while the heap usage exceeds the given threshold, so that the process sheds load instead of running out of memory.
+// The heap usage is read in the background after every garbage collection, when it is closest to the live heap
+// and reading it adds little to the pause the collection already caused, until the given context is canceled.
+func WithMemoryPressureShedding(ctx context.Context, reg prometheus.Registerer, heapThresholdBytes uint64) func(http.Handler) http.Handler {
+	s := newMemoryShedder(reg, heapThresholdBytes)
+
+	go s.run(ctx)
+
+	return s.middleware
+}
+
+// memoryShedder decides whether to shed requests from the last heap usage read.
+type memoryShedder struct {
+	threshold uint64
+	shedding  int32
+
+	heap   prometheus.Gauge
+	active prometheus.Gauge
+}
+
+func newMemoryShedder(reg prometheus.Registerer, heapThresholdBytes uint64) *memoryShedder {
+	s := &memoryShedder{
+		threshold: heapThresholdBytes,
+		heap: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_memory_shedding_heap_bytes",
+			Help: "Heap usage in bytes last read to decide whether to shed requests.",
+		}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_memory_shedding_active",
+			Help: "Whether requests are being shed because the heap usage exceeds the threshold.",
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(s.heap, s.active)
+	}
+
+	return s
+}
+
+// run reads the heap usage after every garbage collection until the context is canceled.
+func (s *memoryShedder) run(ctx context.Context) {
+	gc := make(chan struct{}, 1)
+	notifyGC(ctx, gc)
+
+	var stats runtime.MemStats
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gc:
+			runtime.ReadMemStats(&stats)
+			s.update(stats.HeapAlloc)
+		}
+	}
+}
+
+// update records the heap usage and starts or stops shedding requests.
+func (s *memoryShedder) update(heapBytes uint64) {
+	s.heap.Set(float64(heapBytes))
+
+	if heapBytes > s.threshold {
+		atomic.StoreInt32(&s.shedding, 1)
+		s.active.Set(1)
+
+		return
+	}
+
+	atomic.StoreInt32(&s.shedding, 0)
+	s.active.Set(0)
+}
+
+func (s *memoryShedder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.shedding) == 1 {
+			serviceUnavailable(w, r, UnavailableCauseMemory, "server under memory pressure")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gcSentinel is an unreachable object whose finalizer runs after the garbage collection that found it.
+// It holds a pointer so that it is not batched with other small objects, which would delay its finalizer.
+type gcSentinel struct {
+	_ *int
+}
+
+// notifyGC sends to the channel after every garbage collection, dropping notifications the receiver is not ready for,
+// until the context is canceled.
+func notifyGC(ctx context.Context, c chan<- struct{}) {
+	runtime.SetFinalizer(&gcSentinel{}, func(*gcSentinel) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+
+		notifyGC(ctx, c)
+	})
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMemoryPressureShedding(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := newMemoryShedder(reg, 1<<30)
+	h := s.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name     string
+		heap     uint64
+		expected int
+		gauges   string
+	}{
+		{
+			name:     "below threshold",
+			heap:     1 << 20,
+			expected: http.StatusOK,
+			gauges:   "0",
+		},
+		{
+			name:     "above threshold",
+			heap:     2 << 30,
+			expected: http.StatusServiceUnavailable,
+			gauges:   "1",
+		},
+		{
+			name:     "recovered",
+			heap:     1 << 29,
+			expected: http.StatusOK,
+			gauges:   "0",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s.update(tc.heap)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d; got %d", tc.expected, rec.Code)
+			}
+
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_memory_shedding_active Whether requests are being shed because the heap usage exceeds the threshold.
+# TYPE http_memory_shedding_active gauge
+http_memory_shedding_active `+tc.gauges+`
+`), "http_memory_shedding_active"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWithMemoryPressureSheddingAfterGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Any heap exceeds a threshold of one byte.
+	h := WithMemoryPressureShedding(ctx, nil, 1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+		if rec.Code == http.StatusServiceUnavailable {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("expected requests to be shed once the heap usage was read after a garbage collection")
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// isQueryPath reports whether the request targets the Prometheus instant or range query API.
+func isQueryPath(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/api/v1/query") || strings.HasSuffix(r.URL.Path, "/api/v1/query_range")
+}
+
+// isFormRequest reports whether the request carries its parameters in a form-encoded body.
+func isFormRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && ct == "application/x-www-form-urlencoded"
+}
+
+// modifyParams calls fn with the parameters of the request and writes the modified parameters back.
+// Parameters are taken from the form-encoded body of POST requests and from the URL otherwise,
+// mirroring where Prometheus API clients put them.
+func modifyParams(r *http.Request, fn func(params url.Values)) error {
+	if !isFormRequest(r) {
+		params := r.URL.Query()
+		fn(params)
+		r.URL.RawQuery = params.Encode()
+
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+
+	fn(params)
+
+	encoded := params.Encode()
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(encoded))
+	r.ContentLength = int64(len(encoded))
+	r.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+
+	return nil
+}
+
+// param returns the value of a parameter of the request, leaving the request's body readable.
+func param(r *http.Request, name string) string {
+	var value string
+
+	_ = modifyParams(r, func(params url.Values) {
+		value = params.Get(name)
+	})
+
+	return value
+}
+
+// parseTime parses a Prometheus API timestamp, given either in RFC3339 or as a Unix timestamp in seconds.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseDuration parses a Prometheus API duration, given either in seconds or as a duration string like 30s.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+
+	d, err := model.ParseDuration(s)
+
+	return time.Duration(d), err
+}
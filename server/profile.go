@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// WithProfileAuth returns a middleware that requires requests to the pprof endpoints under /debug/pprof/
+// to carry the given token as a bearer token in the Authorization header, like WithTokenAuth,
+// so that profiling can stay enabled without being exposed to everyone reaching the listener.
+// Other paths are not affected.
+func WithProfileAuth(token string) func(http.Handler) http.Handler {
+	auth := WithTokenAuth(token, "profiling")
+
+	return func(next http.Handler) http.Handler {
+		protected := auth(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			protected.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithTokenAuth returns a middleware that requires requests to carry the given token as a bearer token
+// in the Authorization header, e.g. for administrative endpoints of the internal server.
+// Requests without a valid token are rejected with 401 Unauthorized and a challenge for the given realm.
+// An empty token rejects all requests.
+func WithTokenAuth(token, realm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
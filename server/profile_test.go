@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithProfileAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		token string
+		path  string
+		auth  string
+		code  int
+	}{
+		{
+			name:  "other path",
+			token: "secret",
+			path:  "/metrics",
+			code:  http.StatusOK,
+		},
+		{
+			name:  "no token",
+			token: "secret",
+			path:  "/debug/pprof/heap",
+			code:  http.StatusUnauthorized,
+		},
+		{
+			name:  "wrong token",
+			token: "secret",
+			path:  "/debug/pprof/heap",
+			auth:  "Bearer wrong",
+			code:  http.StatusUnauthorized,
+		},
+		{
+			name:  "basic auth",
+			token: "secret",
+			path:  "/debug/pprof/heap",
+			auth:  "Basic c2VjcmV0",
+			code:  http.StatusUnauthorized,
+		},
+		{
+			name:  "valid token",
+			token: "secret",
+			path:  "/debug/pprof/heap",
+			auth:  "Bearer secret",
+			code:  http.StatusOK,
+		},
+		{
+			name: "empty configured token",
+			path: "/debug/pprof/heap",
+			auth: "Bearer ",
+			code: http.StatusUnauthorized,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := WithProfileAuth(tc.token)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestWithTokenAuth(t *testing.T) {
+	h := WithTokenAuth("secret", "cache")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name string
+		auth string
+		code int
+	}{
+		{
+			name: "no token",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "valid token",
+			auth: "Bearer secret",
+			code: http.StatusOK,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/-/cache/flush", nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != `Bearer realm="cache"` {
+				t.Errorf("expected a challenge for the cache realm; got %q", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// WithDefaultMaxSourceResolution returns a middleware that adds the max_source_resolution parameter
+// to query requests that do not specify one, so that queries over long ranges use downsampled data.
+// Client-provided values are preserved.
+func WithDefaultMaxSourceResolution(d time.Duration) func(http.Handler) http.Handler {
+	resolution := model.Duration(d).String()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err := modifyParams(r, func(params url.Values) {
+				if params.Get("max_source_resolution") == "" {
+					params.Set("max_source_resolution", resolution)
+				}
+			}); err != nil {
+				http.Error(w, "failed to parse query parameters", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithDefaultLookbackDelta returns a middleware that adds the lookback_delta parameter
+// to query requests that do not specify one, so that all clients get the same staleness behavior.
+// Client-provided values are preserved.
+func WithDefaultLookbackDelta(d time.Duration) func(http.Handler) http.Handler {
+	delta := model.Duration(d).String()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err := modifyParams(r, func(params url.Values) {
+				if params.Get("lookback_delta") == "" {
+					params.Set("lookback_delta", delta)
+				}
+			}); err != nil {
+				http.Error(w, "failed to parse query parameters", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithMaxLookbackDelta returns a middleware that caps the lookback_delta parameter of query requests at max,
+// as large lookback deltas make queries more expensive. Capped requests are answered with a Warning header.
+// Invalid or negative values are rejected with 400 Bad Request.
+func WithMaxLookbackDelta(max time.Duration) func(http.Handler) http.Handler {
+	capped := model.Duration(max).String()
+	warning := `299 - "lookback_delta capped at ` + capped + `"`
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			value := param(r, "lookback_delta")
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			delta, err := parseDuration(value)
+			if err != nil || delta < 0 {
+				http.Error(w, "invalid lookback_delta parameter", http.StatusBadRequest)
+				return
+			}
+
+			if delta > max {
+				if err := modifyParams(r, func(params url.Values) {
+					params.Set("lookback_delta", capped)
+				}); err != nil {
+					http.Error(w, "failed to parse query parameters", http.StatusBadRequest)
+					return
+				}
+
+				w.Header().Add("Warning", warning)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithQueryParamValidation returns a middleware that rejects query requests missing required parameters
+// with 400 Bad Request, e.g. "missing required parameter: query", instead of passing them on to the upstream.
+// Instant queries require the query parameter, range queries additionally start, end and step.
+func WithQueryParamValidation() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			required := []string{"query"}
+			if strings.HasSuffix(r.URL.Path, "/api/v1/query_range") {
+				required = append(required, "start", "end", "step")
+			}
+
+			for _, name := range required {
+				if param(r, name) == "" {
+					http.Error(w, "missing required parameter: "+name, http.StatusBadRequest)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithQueryParamValidation(t *testing.T) {
+	h := WithQueryParamValidation()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		code   int
+		body   string
+	}{
+		{
+			name:   "instant query",
+			method: http.MethodGet,
+			path:   "/api/v1/query?query=up",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "instant query without query",
+			method: http.MethodGet,
+			path:   "/api/v1/query?time=1",
+			code:   http.StatusBadRequest,
+			body:   "missing required parameter: query\n",
+		},
+		{
+			name:   "instant query with empty query",
+			method: http.MethodGet,
+			path:   "/api/v1/query?query=",
+			code:   http.StatusBadRequest,
+			body:   "missing required parameter: query\n",
+		},
+		{
+			name:   "range query",
+			method: http.MethodGet,
+			path:   "/api/v1/query_range?query=up&start=1&end=2&step=1",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "range query without query",
+			method: http.MethodGet,
+			path:   "/api/v1/query_range?start=1&end=2&step=1",
+			code:   http.StatusBadRequest,
+			body:   "missing required parameter: query\n",
+		},
+		{
+			name:   "range query without step",
+			method: http.MethodGet,
+			path:   "/api/v1/query_range?query=up&start=1&end=2",
+			code:   http.StatusBadRequest,
+			body:   "missing required parameter: step\n",
+		},
+		{
+			name:   "form-encoded query",
+			method: http.MethodPost,
+			path:   "/api/v1/query",
+			form:   url.Values{"query": []string{"up"}},
+			code:   http.StatusOK,
+		},
+		{
+			name:   "form-encoded query without query",
+			method: http.MethodPost,
+			path:   "/api/v1/query",
+			form:   url.Values{"time": []string{"1"}},
+			code:   http.StatusBadRequest,
+			body:   "missing required parameter: query\n",
+		},
+		{
+			name:   "other path",
+			method: http.MethodGet,
+			path:   "/api/v1/labels",
+			code:   http.StatusOK,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.form.Encode()))
+			if tc.form != nil {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status code %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Fatalf("expected body %q; got %q", tc.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithLookbackDelta(t *testing.T) {
+	var lookbackDelta string
+
+	h := WithDefaultLookbackDelta(5 * time.Minute)(WithMaxLookbackDelta(time.Hour)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lookbackDelta = r.URL.Query().Get("lookback_delta")
+		}),
+	))
+
+	for _, tc := range []struct {
+		name          string
+		path          string
+		code          int
+		lookbackDelta string
+		warning       string
+	}{
+		{
+			name:          "default",
+			path:          "/api/v1/query?query=up",
+			code:          http.StatusOK,
+			lookbackDelta: "5m",
+		},
+		{
+			name:          "client-provided",
+			path:          "/api/v1/query_range?query=up&lookback_delta=30m",
+			code:          http.StatusOK,
+			lookbackDelta: "30m",
+		},
+		{
+			name:          "capped",
+			path:          "/api/v1/query?query=up&lookback_delta=1d",
+			code:          http.StatusOK,
+			lookbackDelta: "1h",
+			warning:       `299 - "lookback_delta capped at 1h"`,
+		},
+		{
+			name: "invalid",
+			path: "/api/v1/query?query=up&lookback_delta=-5m",
+			code: http.StatusBadRequest,
+		},
+		{
+			name:          "other path",
+			path:          "/api/v1/labels",
+			code:          http.StatusOK,
+			lookbackDelta: "",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			lookbackDelta = ""
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status code %d; got %d", tc.code, rec.Code)
+			}
+
+			if lookbackDelta != tc.lookbackDelta {
+				t.Errorf("expected lookback_delta %q; got %q", tc.lookbackDelta, lookbackDelta)
+			}
+
+			if got := rec.Header().Get("Warning"); got != tc.warning {
+				t.Errorf("expected Warning header %q; got %q", tc.warning, got)
+			}
+		})
+	}
+}
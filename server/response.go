@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errResponseTooLarge is returned to handlers writing more than the allowed response size.
+var errResponseTooLarge = errors.New("response too large")
+
+// WithMaxQueryResponseBytes returns a middleware that fails query responses larger than n bytes
+// with 413 Request Entity Too Large. Responses declaring a larger Content-Length are rejected right away,
+// others are held back while they are written and aborted as soon as they exceed the limit,
+// so at most n bytes are kept in memory per request.
+func WithMaxQueryResponseBytes(reg prometheus.Registerer, n int64) func(http.Handler) http.Handler {
+	aborted := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_query_responses_too_large_total",
+		Help: "Total number of query responses aborted because they exceeded the maximum response size.",
+	})
+
+	if reg != nil {
+		reg.MustRegister(aborted)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			lw := &limitedResponseWriter{ResponseWriter: w, limit: n, code: http.StatusOK}
+
+			defer func() {
+				if !lw.exceeded {
+					return
+				}
+
+				// The reverse proxy aborts the handler once writing the response fails.
+				if rvr := recover(); rvr != nil && rvr != http.ErrAbortHandler { //nolint:errorlint
+					panic(rvr)
+				}
+
+				aborted.Inc()
+
+				for _, h := range []string{"Content-Encoding", "Content-Length", "Content-Type", "Etag", "Last-Modified"} {
+					w.Header().Del(h)
+				}
+
+				http.Error(w, "query response exceeds the limit of "+strconv.FormatInt(n, 10)+" bytes",
+					http.StatusRequestEntityTooLarge)
+			}()
+
+			next.ServeHTTP(lw, r)
+
+			if !lw.exceeded {
+				w.WriteHeader(lw.code)
+				_, _ = w.Write(lw.buf.Bytes())
+			}
+		})
+	}
+}
+
+// limitedResponseWriter holds back a response until it is complete, failing writes beyond the limit.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	limit    int64
+	code     int
+	buf      bytes.Buffer
+	exceeded bool
+}
+
+func (w *limitedResponseWriter) WriteHeader(code int) {
+	w.code = code
+
+	if cl, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && cl > w.limit {
+		w.exceeded = true
+	}
+}
+
+func (w *limitedResponseWriter) Write(b []byte) (int, error) {
+	if w.exceeded {
+		return 0, errResponseTooLarge
+	}
+
+	if int64(w.buf.Len()+len(b)) > w.limit {
+		w.exceeded = true
+		w.buf = bytes.Buffer{}
+
+		return 0, errResponseTooLarge
+	}
+
+	return w.buf.Write(b)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMaxQueryResponseBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		code    int
+		body    string
+		aborted string
+	}{
+		{
+			name: "within limit",
+			path: "/api/metrics/v1/test/api/v1/query",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte("0123456789"))
+			},
+			code:    http.StatusOK,
+			body:    "0123456789",
+			aborted: "0",
+		},
+		{
+			name: "content length too large",
+			path: "/api/metrics/v1/test/api/v1/query_range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "11")
+				w.WriteHeader(http.StatusOK)
+
+				if _, err := w.Write([]byte("0123456789a")); err == nil {
+					t.Error("expected writing a response with a too large Content-Length to fail")
+				}
+			},
+			code:    http.StatusRequestEntityTooLarge,
+			aborted: "1",
+		},
+		{
+			name: "aborted mid-stream",
+			path: "/api/metrics/v1/test/api/v1/query",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				for i := 0; i < 3; i++ {
+					if _, err := w.Write([]byte("0123")); err != nil {
+						// The reverse proxy aborts the handler once writing the response fails.
+						panic(http.ErrAbortHandler)
+					}
+				}
+
+				t.Error("expected writing beyond the limit to fail")
+			},
+			code:    http.StatusRequestEntityTooLarge,
+			aborted: "1",
+		},
+		{
+			name: "not a query",
+			path: "/api/metrics/v1/test/api/v1/series",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("0123456789abcdef"))
+			},
+			code:    http.StatusOK,
+			body:    "0123456789abcdef",
+			aborted: "0",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			h := WithMaxQueryResponseBytes(reg, 10)(tc.handler)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, rec.Body.String())
+			}
+
+			if tc.code == http.StatusRequestEntityTooLarge && rec.Header().Get("Content-Type") == "application/json" {
+				t.Error("expected the headers of the aborted response to be removed")
+			}
+
+			expected := `
+# HELP http_query_responses_too_large_total Total number of query responses aborted because they exceeded the maximum response size.
+# TYPE http_query_responses_too_large_total counter
+http_query_responses_too_large_total ` + tc.aborted + `
+`
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_query_responses_too_large_total"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
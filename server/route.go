@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RouteMatcher reports whether a request matches a route.
+type RouteMatcher func(r *http.Request) bool
+
+// PathPrefixMatcher returns a RouteMatcher matching requests whose path starts with the given prefix.
+func PathPrefixMatcher(prefix string) RouteMatcher {
+	return func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+}
+
+// HeaderMatcher returns a RouteMatcher matching requests carrying the given header value.
+func HeaderMatcher(name, value string) RouteMatcher {
+	return func(r *http.Request) bool {
+		for _, v := range r.Header.Values(name) {
+			if v == value {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// WithRoute returns a middleware that sends requests matching the matcher to the given upstream handler,
+// e.g. a reverse proxy, instead of the next handler. All other requests are passed on unchanged.
+// Chaining multiple routes checks them in order, the first matching route wins.
+func WithRoute(matcher RouteMatcher, upstream http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if matcher(r) {
+				upstream.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRoute(t *testing.T) {
+	// handler answers with its name, so that the handler serving a request can be told apart.
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		})
+	}
+
+	var h http.Handler = handler("next")
+	h = WithRoute(HeaderMatcher("X-Upstream", "canary"), handler("canary"))(h)
+	h = WithRoute(PathPrefixMatcher("/api/v1/receive"), handler("receive"))(h)
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		headers []string
+		handler string
+	}{
+		{
+			name:    "no match",
+			path:    "/api/v1/query",
+			handler: "next",
+		},
+		{
+			name:    "path prefix",
+			path:    "/api/v1/receive",
+			handler: "receive",
+		},
+		{
+			name:    "header",
+			path:    "/api/v1/query",
+			headers: []string{"stable", "canary"},
+			handler: "canary",
+		},
+		{
+			name:    "other header value",
+			path:    "/api/v1/query",
+			headers: []string{"stable"},
+			handler: "next",
+		},
+		{
+			name:    "first match wins",
+			path:    "/api/v1/receive",
+			headers: []string{"canary"},
+			handler: "receive",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for _, v := range tc.headers {
+				r.Header.Add("X-Upstream", v)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if got := rec.Body.String(); got != tc.handler {
+				t.Errorf("expected request to be served by %s; got %s", tc.handler, got)
+			}
+		})
+	}
+}
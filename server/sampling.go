@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exemplarLabel is the name of the exemplar label holding the request ID of sampled requests.
+const exemplarLabel = "request_id"
+
+// sampledKey is the context key of the sampling decision of a request.
+type sampledKey struct{}
+
+// WithSampling returns a middleware that decides once whether a request is sampled, given the fraction of requests
+// between 0 and 1 to sample, so that all signals agree on the same requests: the access log of Logger logs sampled
+// requests and the request duration histogram of NewHandlerInstrumenter attaches their request ID as an exemplar.
+// As the decision is made by request ID, it must be applied after middleware.RequestID.
+// Failed and slow requests are logged regardless of the decision.
+func WithSampling(rate float64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision := sampled(middleware.GetReqID(r.Context()), rate)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sampledKey{}, decision)))
+		})
+	}
+}
+
+// IsSampled returns the sampling decision made by WithSampling for the request of the context
+// and whether a decision was made.
+func IsSampled(ctx context.Context) (sampled, ok bool) {
+	sampled, ok = ctx.Value(sampledKey{}).(bool)
+	return sampled, ok
+}
+
+// observeWithExemplar observes the value and attaches the request ID as an exemplar if the request was sampled.
+// Request IDs too long for an exemplar, e.g. ones provided by clients, are not attached.
+func observeWithExemplar(o prometheus.Observer, v float64, r *http.Request) {
+	e, ok := o.(prometheus.ExemplarObserver)
+	if !ok {
+		o.Observe(v)
+		return
+	}
+
+	if s, _ := IsSampled(r.Context()); !s {
+		o.Observe(v)
+		return
+	}
+
+	id := middleware.GetReqID(r.Context())
+	if id == "" || !utf8.ValidString(id) || utf8.RuneCountInString(exemplarLabel+id) > prometheus.ExemplarMaxRunes {
+		o.Observe(v)
+		return
+	}
+
+	e.ObserveWithExemplar(v, prometheus.Labels{exemplarLabel: id})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWithSampling(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rate    float64
+		sampled bool
+	}{
+		{name: "all", rate: 1, sampled: true},
+		{name: "none", rate: 0, sampled: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var sampled, ok bool
+			h := middleware.RequestID(WithSampling(tc.rate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sampled, ok = IsSampled(r.Context())
+			})))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if !ok {
+				t.Fatal("expected a sampling decision")
+			}
+			if sampled != tc.sampled {
+				t.Errorf("expected sampled to be %t; got %t", tc.sampled, sampled)
+			}
+		})
+	}
+
+	t.Run("decided by request ID", func(t *testing.T) {
+		var decisions []bool
+		h := WithSampling(0.5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, _ := IsSampled(r.Context())
+			decisions = append(decisions, s)
+		}))
+
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			h.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, "id")))
+		}
+
+		for _, d := range decisions[1:] {
+			if d != decisions[0] {
+				t.Fatalf("expected the same decision for the same request ID; got %v", decisions)
+			}
+		}
+	})
+
+	t.Run("no decision without middleware", func(t *testing.T) {
+		if _, ok := IsSampled(context.Background()); ok {
+			t.Error("expected no sampling decision")
+		}
+	})
+}
+
+func TestObserveWithExemplar(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		id       string
+		sampled  bool
+		exemplar bool
+	}{
+		{name: "sampled", id: "abc", sampled: true, exemplar: true},
+		{name: "not sampled", id: "abc", sampled: false},
+		{name: "no request ID", sampled: true},
+		{name: "request ID too long", id: strings.Repeat("a", prometheus.ExemplarMaxRunes), sampled: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test", Buckets: []float64{1}})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			ctx := context.WithValue(r.Context(), middleware.RequestIDKey, tc.id)
+			ctx = context.WithValue(ctx, sampledKey{}, tc.sampled)
+
+			observeWithExemplar(h, 0.5, r.WithContext(ctx))
+
+			m := &dto.Metric{}
+			if err := h.Write(m); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.GetHistogram().GetSampleCount(); got != 1 {
+				t.Errorf("expected 1 observation; got %d", got)
+			}
+
+			e := m.GetHistogram().GetBucket()[0].GetExemplar()
+			if !tc.exemplar {
+				if e != nil {
+					t.Errorf("expected no exemplar; got %v", e)
+				}
+				return
+			}
+
+			if e == nil || len(e.GetLabel()) != 1 || e.GetLabel()[0].GetName() != exemplarLabel || e.GetLabel()[0].GetValue() != tc.id {
+				t.Errorf("expected exemplar %s=%q; got %v", exemplarLabel, tc.id, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// middlewareTimingKey is the context key of the histogram observing the duration of middleware stages.
+type middlewareTimingKey struct{}
+
+// stageKey is the context key of a running middleware stage.
+type stageKey struct {
+	name string
+}
+
+// WithMiddlewareTiming returns a middleware that observes the time requests spend in each middleware stage
+// wrapped by TimeStage, e.g. authentication or the concurrency limit, in a histogram labeled by stage,
+// so that it can be found where latency is introduced in the middleware chain.
+// As timing every stage has overhead, it is meant to be enabled while diagnosing latency.
+// If disabled, the middleware does nothing and registers no metrics.
+func WithMiddlewareTiming(reg prometheus.Registerer, enabled bool) func(http.Handler) http.Handler {
+	if !enabled {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_middleware_stage_duration_seconds",
+		Help:    "Time HTTP requests spent in a middleware stage before being passed on or rejected.",
+		Buckets: []float64{0.0001, 0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"stage"})
+
+	if reg != nil {
+		reg.MustRegister(duration)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), middlewareTimingKey{}, duration)))
+		})
+	}
+}
+
+// TimeStage wraps the middleware m as the stage with the given name. The stage is timed from entering m
+// until m passes the request on to the next handler, or returns if it does not, e.g. as it rejects the request.
+// Stages are also reported as phases of requests debugged with WithDebugHeader, in its log and,
+// if enabled, in the Server-Timing header; they are never reported to other clients, as they reveal the gateway's internals.
+// It does nothing for requests that are handled by none of these.
+func TimeStage(name string, m func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	key := stageKey{name: name}
+
+	return func(next http.Handler) http.Handler {
+		h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if end, ok := r.Context().Value(key).(func()); ok {
+				end()
+			}
+
+			next.ServeHTTP(w, r)
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			end, ok := beginStage(r, name, true)
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+			defer end()
+
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key, end)))
+		})
+	}
+}
+
+// TimeHandler returns a middleware that observes the time requests spend in the wrapped handler,
+// usually the proxy to the upstream, as the stage with the given name until the handler returns.
+// Unlike TimeStage, it only observes the histogram of WithMiddlewareTiming, as handlers are reported as phases by TimePhase.
+func TimeHandler(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			end, ok := beginStage(r, name, false)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			defer end()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// beginStage starts timing the stage with the given name, optionally also as an internal phase,
+// and returns the function ending it, which has no effect when called more than once.
+// It returns false if the request is neither observed by WithMiddlewareTiming nor traced.
+func beginStage(r *http.Request, name string, phase bool) (func(), bool) {
+	duration, observed := r.Context().Value(middlewareTimingKey{}).(*prometheus.HistogramVec)
+	_, traced := r.Context().Value(serverTimingKey{}).(*serverTiming)
+
+	if !observed && (!phase || !traced) {
+		return nil, false
+	}
+
+	endPhase := func() {}
+	if phase {
+		endPhase = addPhase(r.Context(), name, true)
+	}
+
+	var once sync.Once
+
+	start := time.Now()
+
+	return func() {
+		once.Do(func() {
+			endPhase()
+
+			if observed {
+				duration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			}
+		})
+	}, true
+}
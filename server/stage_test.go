@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTimeStageServerTiming(t *testing.T) {
+	const token = "secret"
+
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	h = TimePhase("upstream")(h)
+	h = TimeStage("authentication", func(next http.Handler) http.Handler { return next })(h)
+	h = WithDebugHeader(log.NewNopLogger(), "X-Debug", token)(h)
+	h = WithServerTiming(true)(h)
+
+	for _, tc := range []struct {
+		name     string
+		token    string
+		expected []string
+	}{
+		{
+			name:     "no debug header",
+			expected: []string{"upstream", "total"},
+		},
+		{
+			name:     "wrong token",
+			token:    "wrong",
+			expected: []string{"upstream", "total"},
+		},
+		{
+			name:     "debugged",
+			token:    token,
+			expected: []string{"authentication", "upstream", "total"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+			if tc.token != "" {
+				r.Header.Set("X-Debug", tc.token)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			var phases []string
+			for _, m := range strings.Split(rec.Header().Get("Server-Timing"), ", ") {
+				phases = append(phases, strings.SplitN(m, ";", 2)[0])
+			}
+
+			if strings.Join(phases, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected Server-Timing phases %q; got %q", tc.expected, phases)
+			}
+		})
+	}
+}
+
+func TestWithMiddlewareTiming(t *testing.T) {
+	const upstreamLatency = 20 * time.Millisecond
+
+	// chain times a passing and a rejecting middleware as stages and the handler as the upstream.
+	chain := func(h http.Handler) http.Handler {
+		h = TimeHandler("upstream")(h)
+		h = TimeStage("limit", func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/reject" {
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})(h)
+		h = TimeStage("authentication", func(next http.Handler) http.Handler { return next })(h)
+
+		return h
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(upstreamLatency)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := WithMiddlewareTiming(reg, true)(chain(upstream))
+
+		for _, path := range []string{"/", "/reject"} {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mfs) != 1 {
+			t.Fatalf("expected one metric family; got %d", len(mfs))
+		}
+
+		counts := map[string]uint64{}
+		sums := map[string]float64{}
+
+		for _, m := range mfs[0].GetMetric() {
+			stage := m.GetLabel()[0].GetValue()
+			counts[stage] = m.GetHistogram().GetSampleCount()
+			sums[stage] = m.GetHistogram().GetSampleSum()
+		}
+
+		for stage, expected := range map[string]uint64{"authentication": 2, "limit": 2, "upstream": 1} {
+			if counts[stage] != expected {
+				t.Errorf("expected %d observations of stage %s; got %d", expected, stage, counts[stage])
+			}
+		}
+
+		if sums["upstream"] < upstreamLatency.Seconds() {
+			t.Errorf("expected the upstream stage to take at least %s; got %vs", upstreamLatency, sums["upstream"])
+		}
+
+		if sums["authentication"] >= upstreamLatency.Seconds() {
+			t.Errorf("expected the authentication stage to end before the upstream; got %vs", sums["authentication"])
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := WithMiddlewareTiming(reg, false)(chain(upstream))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status %d; got %d", http.StatusOK, rec.Code)
+		}
+
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mfs) != 0 {
+			t.Errorf("expected no metrics to be registered; got %d", len(mfs))
+		}
+	})
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/observatorium/observatorium/authentication"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// maxStaleEntries bounds the number of responses kept for serving stale.
+	maxStaleEntries = 1024
+	// maxStaleEntryBytes bounds the size of a single response kept for serving stale.
+	maxStaleEntryBytes = 1 << 20
+	// staleWarning is the Warning header sent with stale responses, see RFC 7234 section 5.5.1.
+	staleWarning = `110 - "Response is Stale"`
+)
+
+// staleEntry is the last successful response to a query.
+type staleEntry struct {
+	key    string
+	query  string
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// StaleCache keeps the last successful responses to queries and serves them
+// when the upstream fails, so that dashboards keep working during short upstream outages.
+type StaleCache struct {
+	logger       log.Logger
+	maxStaleness time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*staleEntry
+	// order holds the keys of the entries from oldest to newest.
+	order []string
+
+	served prometheus.Counter
+}
+
+// NewStaleCache creates a new StaleCache serving responses at most maxStaleness old.
+func NewStaleCache(logger log.Logger, reg prometheus.Registerer, maxStaleness time.Duration) *StaleCache {
+	c := &StaleCache{
+		logger:       logger,
+		maxStaleness: maxStaleness,
+		entries:      map[string]*staleEntry{},
+		served: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_stale_responses_served_total",
+			Help: "Total number of stale responses served because the upstream failed.",
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(c.served)
+	}
+
+	return c
+}
+
+// Middleware returns a middleware that stores successful responses to GET queries
+// and serves the stored response with a Warning header if the upstream fails with a 5xx status code.
+// Only GET queries are eligible and responses marked with Cache-Control no-store are never stored.
+// Responses are passed on to the client as they are written and only responses of at most maxStaleEntryBytes are kept.
+func (c *StaleCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !isQueryPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := queryKey(r)
+
+		sw := &staleResponseWriter{
+			ResponseWriter: w,
+			header:         http.Header{},
+			load: func(code int) (*staleEntry, bool) {
+				end := startPhase(r.Context(), "cache")
+				defer end()
+
+				e, ok := c.load(key)
+				if ok {
+					level.Debug(c.logger).Log("msg", "serving stale response", "status", code, "age", time.Since(e.stored))
+					c.served.Inc()
+				}
+
+				return e, ok
+			},
+		}
+		next.ServeHTTP(sw, r)
+
+		if !sw.wroteHeader {
+			sw.WriteHeader(http.StatusOK)
+		}
+
+		if sw.body != nil {
+			c.store(key, normalizeQuery(param(r, "query")), sw.header, sw.body.Bytes())
+		}
+	})
+}
+
+// staleResponseWriter passes a response on to the client while keeping a copy of it if it is successful,
+// or replaces it with a stored response if it failed and a stored response is available.
+type staleResponseWriter struct {
+	http.ResponseWriter
+	// header is the header of the response, passed on once the status code is known.
+	header http.Header
+	// load returns the stored response to replace the failed response with the given status code.
+	load func(code int) (*staleEntry, bool)
+
+	wroteHeader bool
+	// stale is set if the response was replaced by a stored one, the rest of the response is discarded.
+	stale bool
+	// body holds the copy of a successful response that may be stored, it is nil if the response may not be stored.
+	body *bytes.Buffer
+}
+
+func (w *staleResponseWriter) Header() http.Header {
+	if w.wroteHeader && !w.stale {
+		return w.ResponseWriter.Header()
+	}
+
+	return w.header
+}
+
+func (w *staleResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	switch {
+	case code == http.StatusOK && cacheable(w.header):
+		w.body = &bytes.Buffer{}
+	case code >= http.StatusInternalServerError:
+		if e, ok := w.load(code); ok {
+			w.stale = true
+
+			for k, v := range e.header {
+				w.ResponseWriter.Header()[k] = v
+			}
+
+			w.ResponseWriter.Header().Add("Warning", staleWarning)
+			w.ResponseWriter.WriteHeader(http.StatusOK)
+			_, _ = w.ResponseWriter.Write(e.body)
+
+			return
+		}
+	}
+
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *staleResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.stale {
+		return len(b), nil
+	}
+
+	if w.body != nil {
+		if w.body.Len()+len(b) > maxStaleEntryBytes {
+			w.body = nil
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *staleResponseWriter) Flush() {
+	if !w.wroteHeader || w.stale {
+		return
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// queryKey identifies the query of the request, including its tenant so that responses are never shared between tenants
+// and the representations it accepts, so that e.g. gzip-encoded responses are only shared with clients accepting them.
+// The PromQL query is normalized, so that queries differing only in formatting or the order of matchers share a key.
+func queryKey(r *http.Request) string {
+	tenant, _ := authentication.GetTenant(r.Context())
+
+	params := r.URL.Query()
+	if q := params.Get("query"); q != "" {
+		params.Set("query", normalizeQuery(q))
+	}
+
+	return strings.Join([]string{
+		tenant,
+		r.URL.Path,
+		params.Encode(),
+		strings.Join(r.Header.Values("Accept"), ","),
+		strings.Join(r.Header.Values("Accept-Encoding"), ","),
+	}, "\xff")
+}
+
+// normalizeQuery returns the canonical form of a PromQL query as printed by the Prometheus parser,
+// which sorts label matchers and removes insignificant whitespace. Queries that cannot be parsed are returned as is.
+func normalizeQuery(q string) string {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return q
+	}
+
+	return expr.String()
+}
+
+func (c *StaleCache) load(key string) (*staleEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.stored) > c.maxStaleness {
+		return nil, false
+	}
+
+	return e, true
+}
+
+func (c *StaleCache) store(key, query string, header http.Header, body []byte) {
+	if len(body) > maxStaleEntryBytes {
+		return
+	}
+
+	e := &staleEntry{
+		key:    key,
+		query:  query,
+		header: header.Clone(),
+		body:   append([]byte{}, body...),
+		stored: time.Now(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		c.removeLocked(key)
+	}
+
+	for len(c.order) >= maxStaleEntries {
+		c.removeLocked(c.order[0])
+	}
+
+	c.entries[key] = e
+	c.order = append(c.order, key)
+}
+
+// Flush removes the stored responses to queries matching the pattern, or all responses if it is nil,
+// and returns the number of removed responses.
+func (c *StaleCache) Flush(pattern *regexp.Regexp) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var evicted int
+
+	for key, e := range c.entries {
+		if pattern == nil || pattern.MatchString(e.query) {
+			c.removeLocked(key)
+			evicted++
+		}
+	}
+
+	return evicted
+}
+
+// FlushHandler flushes stored responses on POST requests, e.g. after data in the upstream was corrected.
+// The optional match parameter is a regular expression selecting the normalized queries to flush.
+// It responds with the number of evicted responses.
+func (c *StaleCache) FlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	var pattern *regexp.Regexp
+
+	if match := r.FormValue("match"); match != "" {
+		var err error
+
+		pattern, err = regexp.Compile(match)
+		if err != nil {
+			http.Error(w, "invalid match parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	evicted := c.Flush(pattern)
+	level.Info(c.logger).Log("msg", "flushed stale cache", "match", r.FormValue("match"), "evicted", evicted)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Evicted int `json:"evicted"`
+	}{Evicted: evicted})
+}
+
+func (c *StaleCache) removeLocked(key string) {
+	delete(c.entries, key)
+
+	for i := range c.order {
+		if c.order[i] == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// cacheable reports whether the response with the given header may be stored.
+func cacheable(header http.Header) bool {
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			if d := strings.TrimSpace(strings.ToLower(d)); d == "no-store" || d == "private" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
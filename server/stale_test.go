@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStaleCache(t *testing.T) {
+	var (
+		code   int
+		body   string
+		header http.Header
+	)
+
+	reg := prometheus.NewRegistry()
+	c := NewStaleCache(log.NewNopLogger(), reg, time.Hour)
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	}))
+
+	query := func(q, encoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(q), nil)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	large := strings.Repeat("a", maxStaleEntryBytes+1)
+
+	// Store the responses while the upstream is healthy.
+	code = http.StatusOK
+
+	for _, tc := range []struct {
+		query   string
+		body    string
+		noStore bool
+	}{
+		{query: "up", body: "fresh"},
+		{query: "large", body: large},
+		{query: "private", body: "private", noStore: true},
+	} {
+		body = tc.body
+		header = http.Header{"Content-Type": {"application/json"}}
+
+		if tc.noStore {
+			header.Set("Cache-Control", "no-store")
+		}
+
+		rec := query(tc.query, "")
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.body {
+			t.Fatalf("expected query %q to be passed on; got status %d and %d bytes", tc.query, rec.Code, rec.Body.Len())
+		}
+	}
+
+	// Serve the stored responses while the upstream fails.
+	code = http.StatusServiceUnavailable
+	body = "upstream unavailable"
+	header = nil
+
+	for _, tc := range []struct {
+		name     string
+		query    string
+		encoding string
+		code     int
+		body     string
+	}{
+		{
+			name:  "stored",
+			query: "up",
+			code:  http.StatusOK,
+			body:  "fresh",
+		},
+		{
+			name:  "normalized query",
+			query: "up  ",
+			code:  http.StatusOK,
+			body:  "fresh",
+		},
+		{
+			name:     "other encoding",
+			query:    "up",
+			encoding: "gzip",
+			code:     http.StatusServiceUnavailable,
+			body:     body,
+		},
+		{
+			name:  "too large to store",
+			query: "large",
+			code:  http.StatusServiceUnavailable,
+			body:  body,
+		},
+		{
+			name:  "no-store",
+			query: "private",
+			code:  http.StatusServiceUnavailable,
+			body:  body,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rec := query(tc.query, tc.encoding)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if rec.Body.String() != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, rec.Body.String())
+			}
+
+			if stale := rec.Header().Get("Warning") == staleWarning; stale != (tc.code == http.StatusOK) {
+				t.Errorf("expected stale response %t; got Warning header %q", tc.code == http.StatusOK, rec.Header().Get("Warning"))
+			}
+
+			if tc.code == http.StatusOK && rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("expected stored Content-Type header; got %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	// Stored responses older than the maximum staleness are not served.
+	c.mu.Lock()
+	for _, e := range c.entries {
+		e.stored = time.Now().Add(-2 * time.Hour)
+	}
+	c.mu.Unlock()
+
+	if rec := query("up", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected expired response not to be served; got status %d", rec.Code)
+	}
+
+	expected := `
+# HELP http_stale_responses_served_total Total number of stale responses served because the upstream failed.
+# TYPE http_stale_responses_served_total counter
+http_stale_responses_served_total 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_stale_responses_served_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statsDQuantiles are the latency percentiles pushed to StatsD.
+var statsDQuantiles = []float64{0.5, 0.9, 0.99}
+
+type statsDConfig struct {
+	prefix    string
+	namespace string
+}
+
+// StatsDOption modifies the configuration of a StatsD exporter.
+type StatsDOption func(c *statsDConfig)
+
+// WithStatsDPrefix sets the prefix of the names of the metrics pushed to StatsD, by default observatorium.
+func WithStatsDPrefix(prefix string) StatsDOption {
+	return func(c *statsDConfig) {
+		c.prefix = prefix
+	}
+}
+
+// WithStatsDNamespace sets the namespace the HTTP metrics are registered with, e.g. with --metrics.namespace.
+func WithStatsDNamespace(namespace string) StatsDOption {
+	return func(c *statsDConfig) {
+		c.namespace = namespace
+	}
+}
+
+// StatsDExporter periodically pushes the key metrics of the HTTP server to a StatsD endpoint,
+// for monitoring systems that do not scrape Prometheus metrics: the number of requests and of 5xx errors
+// as counters, from which StatsD derives rates, and latency percentiles estimated from the histogram
+// of request durations over the interval as gauges in milliseconds.
+// It reads the metrics registered by the handler instrumenter, which keep being exposed to Prometheus.
+type StatsDExporter struct {
+	logger   log.Logger
+	gatherer prometheus.Gatherer
+	addr     string
+	interval time.Duration
+
+	prefix      string
+	requestsKey string
+	durationKey string
+
+	last statsDSnapshot
+}
+
+// statsDSnapshot holds the totals of the HTTP metrics over all handlers at one point in time.
+type statsDSnapshot struct {
+	requests float64
+	errors   float64
+	// buckets are the cumulative counts of the request duration histogram by upper bound.
+	buckets map[float64]uint64
+	count   uint64
+}
+
+// NewStatsDExporter creates an exporter pushing the metrics gathered from g to the StatsD endpoint at addr every interval.
+func NewStatsDExporter(logger log.Logger, g prometheus.Gatherer, addr string, interval time.Duration, opts ...StatsDOption) *StatsDExporter {
+	c := &statsDConfig{prefix: "observatorium"}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	namespace := ""
+	if c.namespace != "" {
+		namespace = c.namespace + "_"
+	}
+
+	return &StatsDExporter{
+		logger:      logger,
+		gatherer:    g,
+		addr:        addr,
+		interval:    interval,
+		prefix:      c.prefix,
+		requestsKey: namespace + "http_requests_total",
+		durationKey: namespace + "http_request_duration_seconds",
+	}
+}
+
+// Run pushes the metrics every interval until the context is canceled.
+func (e *StatsDExporter) Run(ctx context.Context) error {
+	conn, err := net.Dial("udp", e.addr)
+	if err != nil {
+		return fmt.Errorf("connect to StatsD at %q: %w", e.addr, err)
+	}
+	defer conn.Close()
+
+	if e.last, err = e.snapshot(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		s, err := e.snapshot()
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "failed to gather metrics for StatsD", "err", err)
+			continue
+		}
+
+		// StatsD is spoken over UDP, so lost packets are not reported and a packet failing to send is not retried.
+		if _, err := conn.Write(e.lines(s)); err != nil {
+			level.Warn(e.logger).Log("msg", "failed to push metrics to StatsD", "err", err)
+		}
+
+		e.last = s
+	}
+}
+
+// snapshot sums up the HTTP metrics of all handlers.
+func (e *StatsDExporter) snapshot() (statsDSnapshot, error) {
+	s := statsDSnapshot{buckets: map[float64]uint64{}}
+
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		return s, err
+	}
+
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case e.requestsKey:
+			for _, m := range mf.GetMetric() {
+				v := m.GetCounter().GetValue()
+				s.requests += v
+
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "code" && strings.HasPrefix(l.GetValue(), "5") {
+						s.errors += v
+					}
+				}
+			}
+		case e.durationKey:
+			for _, m := range mf.GetMetric() {
+				h := m.GetHistogram()
+				s.count += h.GetSampleCount()
+
+				for _, b := range h.GetBucket() {
+					s.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+				}
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// lines returns the StatsD lines of the changes since the last snapshot.
+func (e *StatsDExporter) lines(s statsDSnapshot) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%s.requests:%d|c\n", e.prefix, int64(s.requests-e.last.requests))
+	fmt.Fprintf(&b, "%s.errors:%d|c\n", e.prefix, int64(s.errors-e.last.errors))
+
+	count := s.count - e.last.count
+	if count == 0 {
+		return b.Bytes()
+	}
+
+	bounds := make([]float64, 0, len(s.buckets))
+	for bound := range s.buckets {
+		bounds = append(bounds, bound)
+	}
+
+	sort.Float64s(bounds)
+
+	for _, q := range statsDQuantiles {
+		fmt.Fprintf(&b, "%s.request_duration_ms.p%g:%.3f|g\n", e.prefix, q*100, 1000*e.quantile(q, count, bounds, s))
+	}
+
+	return b.Bytes()
+}
+
+// quantile estimates the quantile of the request durations observed since the last snapshot in seconds
+// by interpolating linearly within the bucket it falls into.
+// Quantiles beyond the largest bucket are estimated as its upper bound.
+func (e *StatsDExporter) quantile(q float64, count uint64, bounds []float64, s statsDSnapshot) float64 {
+	rank := q * float64(count)
+
+	var lower, below float64
+
+	for _, bound := range bounds {
+		cumulative := float64(s.buckets[bound] - e.last.buckets[bound])
+
+		if cumulative >= rank {
+			if cumulative == below {
+				return bound
+			}
+
+			return lower + (bound-lower)*(rank-below)/(cumulative-below)
+		}
+
+		lower, below = bound, cumulative
+	}
+
+	return lower
+}
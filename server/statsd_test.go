@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newStatsDTestMetrics registers the HTTP metrics read by the StatsD exporter.
+func newStatsDTestMetrics(reg prometheus.Registerer) (*prometheus.CounterVec, prometheus.Observer) {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Counter of HTTP requests.",
+	}, []string{"code", "handler"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Histogram of latencies for HTTP requests.",
+		Buckets: []float64{0.1, 0.5, 1},
+	}, []string{"handler"})
+
+	reg.MustRegister(requests, duration)
+
+	return requests, duration.WithLabelValues("query")
+}
+
+func TestStatsDExporterLines(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	requests, duration := newStatsDTestMetrics(reg)
+
+	e := NewStatsDExporter(log.NewNopLogger(), reg, "127.0.0.1:0", time.Second)
+
+	// Requests before the last snapshot are not pushed again.
+	requests.WithLabelValues("200", "query").Add(3)
+	duration.Observe(5)
+
+	last, err := e.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.last = last
+
+	requests.WithLabelValues("200", "query").Add(8)
+	requests.WithLabelValues("503", "query").Add(2)
+
+	for _, d := range []float64{0.05, 0.05, 0.05, 0.05, 0.05, 0.3, 0.3, 0.3, 0.3, 0.8} {
+		duration.Observe(d)
+	}
+
+	s, err := e.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `observatorium.requests:10|c
+observatorium.errors:2|c
+observatorium.request_duration_ms.p50:100.000|g
+observatorium.request_duration_ms.p90:500.000|g
+observatorium.request_duration_ms.p99:950.000|g
+`
+	if got := string(e.lines(s)); got != expected {
+		t.Errorf("expected lines:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestStatsDExporterRun(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reg := prometheus.NewRegistry()
+	newStatsDTestMetrics(reg)
+
+	e := NewStatsDExporter(log.NewNopLogger(), reg, conn.LocalAddr().String(), 10*time.Millisecond, WithStatsDPrefix("gateway"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = e.Run(ctx) }()
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[:n]); !strings.HasPrefix(got, "gateway.requests:0|c\n") {
+		t.Errorf("expected the request counter to be pushed with the configured prefix; got %q", got)
+	}
+}
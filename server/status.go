@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// WithStatusRemap returns a middleware that replaces the status codes of responses
+// with the ones configured in the given map, e.g. {422: 400}.
+// Status codes not in the map and the response bodies are left untouched.
+func WithStatusRemap(logger log.Logger, remap map[int]int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&remapResponseWriter{
+				ResponseWriter: w,
+				remap: func(code int) int {
+					to, ok := remap[code]
+					if !ok {
+						return code
+					}
+
+					level.Debug(logger).Log(
+						"msg", "remapping response status code",
+						"request", middleware.GetReqID(r.Context()),
+						"path", r.URL.Path,
+						"from", code,
+						"to", to,
+					)
+
+					return to
+				},
+			}, r)
+		})
+	}
+}
+
+// remapResponseWriter is a http.ResponseWriter that rewrites the status code of the response.
+type remapResponseWriter struct {
+	http.ResponseWriter
+	remap       func(code int) int
+	wroteHeader bool
+}
+
+func (w *remapResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(w.remap(code))
+}
+
+func (w *remapResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements the http.Flusher interface, so that streamed responses keep working.
+func (w *remapResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface, so that protocol upgrades keep working.
+func (w *remapResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not implement http.Hijacker", w.ResponseWriter)
+	}
+
+	return h.Hijack()
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestWithStatusRemap(t *testing.T) {
+	remap := WithStatusRemap(log.NewNopLogger(), map[int]int{
+		http.StatusUnprocessableEntity: http.StatusBadRequest,
+		http.StatusServiceUnavailable:  http.StatusBadGateway,
+	})
+
+	for _, tc := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected int
+		body     string
+	}{
+		{
+			name: "remapped",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = w.Write([]byte("bad query"))
+			},
+			expected: http.StatusBadRequest,
+			body:     "bad query",
+		},
+		{
+			name: "other remapped",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+			expected: http.StatusBadGateway,
+			body:     "unavailable\n",
+		},
+		{
+			name: "not configured",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			expected: http.StatusNotFound,
+		},
+		{
+			name: "implicit ok",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			},
+			expected: http.StatusOK,
+			body:     "ok",
+		},
+		{
+			name: "superfluous write header",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.WriteHeader(http.StatusOK)
+			},
+			expected: http.StatusBadRequest,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			remap(tc.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d; got %d", tc.expected, rec.Code)
+			}
+
+			if rec.Body.String() != tc.body {
+				t.Errorf("expected body %q; got %q", tc.body, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("flush", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		remap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f, ok := w.(http.Flusher)
+			if !ok {
+				t.Fatal("expected the response writer to implement http.Flusher")
+			}
+
+			_, _ = w.Write([]byte("event"))
+			f.Flush()
+		})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/tail", nil))
+
+		if !rec.Flushed {
+			t.Error("expected the response to be flushed")
+		}
+	})
+}
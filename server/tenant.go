@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/observatorium/observatorium/authentication"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithTenantUpstreams returns a middleware that sends the requests of the tenants in the map to their handlers,
+// e.g. API handlers proxying to the upstreams of the tenant's own cluster.
+// Requests of all other tenants are passed on to the next, default handler.
+func WithTenantUpstreams(handlers map[string]http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant, ok := authentication.GetTenant(r.Context())
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if h, ok := handlers[tenant]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithTenantFromCert returns a middleware that sets the header to the tenant extracted from the client certificate
+// the request was authenticated with via mTLS, e.g. with TenantFromCommonName, replacing any value sent by the client,
+// so that the upstream tenant is bound to the certificate. Requests not authenticated with a client certificate,
+// or whose certificate the tenant cannot be extracted from, are rejected with 401 Unauthorized.
+// The extracted tenant must be the name or, as given in tenantIDs, the ID of the tenant the request was authenticated
+// and authorized for, as a CA may be trusted by several tenants; otherwise the request is rejected with 403 Forbidden.
+func WithTenantFromCert(header string, tenantIDs map[string]string, extract func(*x509.Certificate) (string, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cert, ok := authentication.GetClientCertificate(r.Context())
+			if !ok {
+				http.Error(w, "no verified client certificate presented", http.StatusUnauthorized)
+				return
+			}
+
+			tenant, err := extract(cert)
+			if err != nil {
+				http.Error(w, "could not determine tenant from client certificate", http.StatusUnauthorized)
+				return
+			}
+
+			name, ok := authentication.GetTenant(r.Context())
+			if !ok || (tenant != name && tenant != tenantIDs[name]) {
+				http.Error(w, "client certificate does not belong to the tenant", http.StatusForbidden)
+				return
+			}
+
+			r.Header.Set(header, tenant)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TenantFromCommonName extracts the tenant from the common name of the subject of a certificate.
+func TenantFromCommonName(cert *x509.Certificate) (string, error) {
+	if cert.Subject.CommonName == "" {
+		return "", errors.New("certificate has no common name")
+	}
+
+	return cert.Subject.CommonName, nil
+}
+
+// TenantFromURISAN extracts the tenant from the first URI SAN of a certificate, e.g. a SPIFFE ID.
+func TenantFromURISAN(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) == 0 {
+		return "", errors.New("certificate has no URI SAN")
+	}
+
+	return cert.URIs[0].String(), nil
+}
+
+// WithActiveTenants returns a middleware that records the tenants of requests and exposes the number of distinct tenants
+// seen within the given window as a gauge, without a label per tenant.
+// Tenants are bounded by the tenants configuration, so they are counted exactly rather than estimated.
+func WithActiveTenants(reg prometheus.Registerer, window time.Duration) func(http.Handler) http.Handler {
+	var (
+		mu       sync.Mutex
+		lastSeen = map[string]time.Time{}
+	)
+
+	active := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "http_active_tenants",
+		Help: "Number of distinct tenants that sent requests within the configured window.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for tenant, t := range lastSeen {
+			if time.Since(t) > window {
+				delete(lastSeen, tenant)
+			}
+		}
+
+		return float64(len(lastSeen))
+	})
+
+	if reg != nil {
+		reg.MustRegister(active)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tenant, ok := authentication.GetTenant(r.Context()); ok {
+				mu.Lock()
+				lastSeen[tenant] = time.Now()
+				mu.Unlock()
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithTenantRequestMetrics returns a middleware that counts requests by tenant, method and status code.
+// The tenant label makes the metric's cardinality grow with the number of tenants,
+// so it is meant to be registered on a debug registry that is scraped rarely.
+func WithTenantRequestMetrics(reg prometheus.Registerer) func(http.Handler) http.Handler {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_tenant_requests_total",
+		Help: "Counter of HTTP requests by tenant.",
+	}, []string{"tenant", "method", "code"})
+
+	if reg != nil {
+		reg.MustRegister(requests)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant, _ := authentication.GetTenant(r.Context())
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			requests.WithLabelValues(tenant, r.Method, strconv.Itoa(ww.Status())).Inc()
+		})
+	}
+}
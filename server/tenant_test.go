@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/observatorium/observatorium/authentication"
+)
+
+func TestWithTenantUpstreams(t *testing.T) {
+	upstream := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		})
+	}
+
+	r := chi.NewRouter()
+	r.Route("/api/metrics/v1/{tenant}", func(r chi.Router) {
+		r.Use(authentication.WithTenant)
+		r.Use(WithTenantUpstreams(map[string]http.Handler{"cluster-b": upstream("cluster-b")}))
+		r.Mount("/", upstream("default"))
+	})
+
+	for _, tc := range []struct {
+		tenant   string
+		expected string
+	}{
+		{tenant: "cluster-b", expected: "cluster-b"},
+		{tenant: "cluster-a", expected: "default"},
+	} {
+		tc := tc
+		t.Run(tc.tenant, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/metrics/v1/"+tc.tenant+"/api/v1/query", nil))
+
+			if got := w.Body.String(); got != tc.expected {
+				t.Errorf("expected the request to be sent to the %s upstream; got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+// newTestCertificate creates a certificate with the given common name signed by the parent,
+// or a self-signed CA certificate if parent is nil.
+func newTestCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"client"},
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestWithTenantFromCert(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "ca", nil, nil)
+
+	// Both tenants trust the same CA, so a certificate of one tenant is authenticated for the other one too.
+	mtls := authentication.NewMTLS([]authentication.MTLSConfig{{Tenant: "a", CA: ca}, {Tenant: "b", CA: ca}})
+	tenantIDs := map[string]string{"a": "id-a", "b": "id-b"}
+
+	var upstreamTenant string
+
+	r := chi.NewRouter()
+	r.With(
+		authentication.WithTenant,
+		authentication.WithTenantMiddlewares(mtls),
+		WithTenantFromCert("X-Tenant", tenantIDs, TenantFromCommonName),
+	).Get("/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		upstreamTenant = r.Header.Get("X-Tenant")
+	})
+
+	for _, tc := range []struct {
+		name     string
+		tenant   string
+		cn       string
+		noCert   bool
+		code     int
+		upstream string
+	}{
+		{
+			name:     "tenant name",
+			tenant:   "a",
+			cn:       "a",
+			code:     http.StatusOK,
+			upstream: "a",
+		},
+		{
+			name:     "tenant ID",
+			tenant:   "a",
+			cn:       "id-a",
+			code:     http.StatusOK,
+			upstream: "id-a",
+		},
+		{
+			name:   "other tenant",
+			tenant: "a",
+			cn:     "b",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "ID of other tenant",
+			tenant: "a",
+			cn:     "id-b",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "no common name",
+			tenant: "a",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:   "no certificate",
+			tenant: "a",
+			noCert: true,
+			code:   http.StatusUnauthorized,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamTenant = ""
+
+			req := httptest.NewRequest(http.MethodGet, "/"+tc.tenant, nil)
+			req.Header.Set("X-Tenant", "spoofed")
+			req.TLS = &tls.ConnectionState{}
+
+			if !tc.noCert {
+				cert, _ := newTestCertificate(t, tc.cn, ca, caKey)
+				req.TLS.PeerCertificates = []*x509.Certificate{cert}
+			}
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if upstreamTenant != tc.upstream {
+				t.Errorf("expected upstream tenant %q; got %q", tc.upstream, upstreamTenant)
+			}
+		})
+	}
+}
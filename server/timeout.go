@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// WithClientTimeoutHeader returns a middleware that lets clients set the timeout of their requests in the given header,
+// e.g. X-Query-Timeout: 30s. The timeout becomes the deadline of the request's context and,
+// for query requests, the timeout parameter sent to the upstream.
+// Timeouts above max are capped at max; invalid or non-positive values are rejected with 400 Bad Request.
+func WithClientTimeoutHeader(name string, max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(name)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			timeout, err := parseDuration(value)
+			if err != nil || timeout <= 0 {
+				http.Error(w, "invalid timeout in header "+name, http.StatusBadRequest)
+				return
+			}
+
+			if timeout > max {
+				timeout = max
+			}
+
+			if isQueryPath(r) {
+				if err := modifyParams(r, func(params url.Values) {
+					params.Set("timeout", model.Duration(timeout).String())
+				}); err != nil {
+					http.Error(w, "failed to parse query parameters", http.StatusBadRequest)
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// WithMaxUpstreamTimeout returns a middleware that honors the timeout parameter of query requests
+// by setting it as the deadline of the request's context, so that the request to the upstream is canceled with it.
+// Timeouts above max are capped at max and the effective timeout is forwarded to the upstream;
+// invalid or non-positive values are rejected with 400 Bad Request.
+func WithMaxUpstreamTimeout(max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			value := param(r, "timeout")
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			timeout, err := parseDuration(value)
+			if err != nil || timeout <= 0 {
+				http.Error(w, "invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+
+			if timeout > max {
+				timeout = max
+
+				if err := modifyParams(r, func(params url.Values) {
+					params.Set("timeout", model.Duration(timeout).String())
+				}); err != nil {
+					http.Error(w, "failed to parse query parameters", http.StatusBadRequest)
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// WithUpstreamQueryTimeout returns a middleware that sets the timeout parameter of query requests to d,
+// or to the timeout asked for by the client if it is shorter, so that the upstream itself bounds the evaluation of queries,
+// independently of the deadline of the request's context. Other parameters are preserved;
+// invalid or non-positive timeouts are rejected with 400 Bad Request.
+func WithUpstreamQueryTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isQueryPath(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			timeout := d
+
+			if value := param(r, "timeout"); value != "" {
+				requested, err := parseDuration(value)
+				if err != nil || requested <= 0 {
+					http.Error(w, "invalid timeout parameter", http.StatusBadRequest)
+					return
+				}
+
+				if requested < timeout {
+					timeout = requested
+				}
+			}
+
+			if err := modifyParams(r, func(params url.Values) {
+				params.Set("timeout", model.Duration(timeout).String())
+			}); err != nil {
+				http.Error(w, "failed to parse query parameters", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
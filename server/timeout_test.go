@@ -0,0 +1,266 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timeoutRecorder is a handler recording the timeout parameter and the time left until the deadline of requests.
+type timeoutRecorder struct {
+	param    string
+	deadline time.Duration
+}
+
+func (h *timeoutRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.param = r.URL.Query().Get("timeout")
+	h.deadline = 0
+
+	if d, ok := r.Context().Deadline(); ok {
+		h.deadline = time.Until(d)
+	}
+}
+
+func TestWithClientTimeoutHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		header   string
+		code     int
+		param    string
+		deadline time.Duration
+	}{
+		{
+			name: "no header",
+			path: "/api/v1/query?query=up",
+			code: http.StatusOK,
+		},
+		{
+			name:     "query",
+			path:     "/api/v1/query?query=up",
+			header:   "30s",
+			code:     http.StatusOK,
+			param:    "30s",
+			deadline: 30 * time.Second,
+		},
+		{
+			name:     "seconds",
+			path:     "/api/v1/query_range?query=up",
+			header:   "10",
+			code:     http.StatusOK,
+			param:    "10s",
+			deadline: 10 * time.Second,
+		},
+		{
+			name:     "capped",
+			path:     "/api/v1/query?query=up",
+			header:   "1h",
+			code:     http.StatusOK,
+			param:    "1m",
+			deadline: time.Minute,
+		},
+		{
+			name:     "not a query",
+			path:     "/api/v1/series",
+			header:   "30s",
+			code:     http.StatusOK,
+			deadline: 30 * time.Second,
+		},
+		{
+			name:   "invalid",
+			path:   "/api/v1/query?query=up",
+			header: "soon",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "negative",
+			path:   "/api/v1/query?query=up",
+			header: "-5s",
+			code:   http.StatusBadRequest,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			next := &timeoutRecorder{}
+
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.header != "" {
+				r.Header.Set("X-Query-Timeout", tc.header)
+			}
+
+			rec := httptest.NewRecorder()
+			WithClientTimeoutHeader("X-Query-Timeout", time.Minute)(next).ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if next.param != tc.param {
+				t.Errorf("expected timeout parameter %q; got %q", tc.param, next.param)
+			}
+
+			if next.deadline > tc.deadline || next.deadline < tc.deadline-time.Second {
+				t.Errorf("expected a deadline in %s; got %s", tc.deadline, next.deadline)
+			}
+		})
+	}
+}
+
+func TestWithMaxUpstreamTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		code     int
+		param    string
+		deadline time.Duration
+	}{
+		{
+			name: "no timeout",
+			path: "/api/v1/query?query=up",
+			code: http.StatusOK,
+		},
+		{
+			name:     "within max",
+			path:     "/api/v1/query?query=up&timeout=30s",
+			code:     http.StatusOK,
+			param:    "30s",
+			deadline: 30 * time.Second,
+		},
+		{
+			name:     "capped",
+			path:     "/api/v1/query_range?query=up&timeout=600",
+			code:     http.StatusOK,
+			param:    "1m",
+			deadline: time.Minute,
+		},
+		{
+			name:  "not a query",
+			path:  "/api/v1/series?timeout=1h",
+			code:  http.StatusOK,
+			param: "1h",
+		},
+		{
+			name: "invalid",
+			path: "/api/v1/query?query=up&timeout=soon",
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "zero",
+			path: "/api/v1/query?query=up&timeout=0",
+			code: http.StatusBadRequest,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			next := &timeoutRecorder{}
+
+			rec := httptest.NewRecorder()
+			WithMaxUpstreamTimeout(time.Minute)(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if next.param != tc.param {
+				t.Errorf("expected timeout parameter %q; got %q", tc.param, next.param)
+			}
+
+			if next.deadline > tc.deadline || next.deadline < tc.deadline-time.Second {
+				t.Errorf("expected a deadline in %s; got %s", tc.deadline, next.deadline)
+			}
+		})
+	}
+}
+
+func TestWithUpstreamQueryTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		param  string
+		query  string
+	}{
+		{
+			name:  "default",
+			path:  "/api/v1/query?query=up",
+			code:  http.StatusOK,
+			param: "2m",
+			query: "up",
+		},
+		{
+			name:  "shorter requested",
+			path:  "/api/v1/query_range?query=up&timeout=30s",
+			code:  http.StatusOK,
+			param: "30s",
+			query: "up",
+		},
+		{
+			name:  "longer requested",
+			path:  "/api/v1/query?query=up&timeout=1h",
+			code:  http.StatusOK,
+			param: "2m",
+			query: "up",
+		},
+		{
+			name:   "form",
+			method: http.MethodPost,
+			path:   "/api/v1/query",
+			body:   "query=up&timeout=10",
+			code:   http.StatusOK,
+			param:  "10s",
+			query:  "up",
+		},
+		{
+			name: "not a query",
+			path: "/api/v1/labels",
+			code: http.StatusOK,
+		},
+		{
+			name: "invalid",
+			path: "/api/v1/query?query=up&timeout=-1s",
+			code: http.StatusBadRequest,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var param, query string
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Fatal(err)
+				}
+
+				param, query = r.Form.Get("timeout"), r.Form.Get("query")
+			})
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, tc.path, strings.NewReader(tc.body))
+			if tc.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			rec := httptest.NewRecorder()
+			WithUpstreamQueryTimeout(2*time.Minute)(next).ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d", tc.code, rec.Code)
+			}
+
+			if param != tc.param {
+				t.Errorf("expected timeout parameter %q; got %q", tc.param, param)
+			}
+
+			if query != tc.query {
+				t.Errorf("expected query parameter %q to be preserved; got %q", tc.query, query)
+			}
+		})
+	}
+}
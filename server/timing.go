@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTimingKey is the context key of the phases timed for the Server-Timing header.
+type serverTimingKey struct{}
+
+// serverTiming holds the phases of a request reported in the Server-Timing header.
+type serverTiming struct {
+	mtx    sync.Mutex
+	start  time.Time
+	phases []*timingPhase
+	// debug is set for requests debugged with WithDebugHeader, whose internal phases are reported too.
+	debug bool
+}
+
+// timingPhase is a phase of a request, e.g. the request to the upstream.
+type timingPhase struct {
+	name  string
+	start time.Time
+	dur   time.Duration
+	done  bool
+	// internal marks phases revealing the gateway's internals, e.g. middleware stages timed by TimeStage.
+	internal bool
+}
+
+// WithServerTiming returns a middleware that reports the duration of the phases of requests,
+// e.g. the request to the upstream, and their total duration in the Server-Timing header,
+// so that clients can see where latency goes, e.g. in the network panel of browsers.
+// As the header is sent before the body, durations are measured until the response headers are written
+// and only phases that ran until then are reported. If disabled, the middleware does nothing.
+func WithServerTiming(enabled bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := &serverTiming{start: time.Now()}
+
+			next.ServeHTTP(&headerHookResponseWriter{
+				ResponseWriter: w,
+				hook: func() {
+					t.mtx.Lock()
+					debug := t.debug
+					t.mtx.Unlock()
+
+					if v := t.header(debug); v != "" {
+						w.Header().Set("Server-Timing", v)
+					}
+				},
+			}, r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, t)))
+		})
+	}
+}
+
+// TimePhase returns a middleware that times the wrapped handler as the phase with the given name
+// in the Server-Timing header, until it writes the response headers or returns.
+// It does nothing for requests that are not handled by WithServerTiming.
+func TimePhase(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(serverTimingKey{}) == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			end := startPhase(r.Context(), name)
+			defer end()
+
+			next.ServeHTTP(&headerHookResponseWriter{ResponseWriter: w, hook: end}, r)
+		})
+	}
+}
+
+// startPhase starts timing the phase with the given name, if the request is handled by WithServerTiming,
+// and returns the function ending it. Ending a phase more than once has no effect.
+func startPhase(ctx context.Context, name string) func() {
+	return addPhase(ctx, name, false)
+}
+
+// addPhase starts timing the phase like startPhase. Internal phases are only reported for debugged requests.
+func addPhase(ctx context.Context, name string, internal bool) func() {
+	t, ok := ctx.Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return func() {}
+	}
+
+	p := &timingPhase{name: name, start: time.Now(), internal: internal}
+
+	t.mtx.Lock()
+	t.phases = append(t.phases, p)
+	t.mtx.Unlock()
+
+	return func() {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+
+		if !p.done {
+			p.dur = time.Since(p.start)
+			p.done = true
+		}
+	}
+}
+
+// header returns the value of the Server-Timing header with the durations in milliseconds,
+// including the internal phases if requested. Phases that have not ended yet are reported with the time they have run so far.
+func (t *serverTiming) header(internal bool) string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	metrics := make([]string, 0, len(t.phases)+1)
+
+	for _, p := range t.phases {
+		if p.internal && !internal {
+			continue
+		}
+
+		dur := p.dur
+		if !p.done {
+			dur = time.Since(p.start)
+		}
+
+		metrics = append(metrics, timingMetric(p.name, dur))
+	}
+
+	metrics = append(metrics, timingMetric("total", time.Since(t.start)))
+
+	return strings.Join(metrics, ", ")
+}
+
+func timingMetric(name string, d time.Duration) string {
+	return name + ";dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// headerHookResponseWriter is a http.ResponseWriter that calls a hook once before the response headers are written.
+type headerHookResponseWriter struct {
+	http.ResponseWriter
+	hook        func()
+	wroteHeader bool
+}
+
+func (w *headerHookResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.hook()
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerHookResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements the http.Flusher interface, so that streamed responses keep working.
+func (w *headerHookResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface, so that protocol upgrades keep working.
+func (w *headerHookResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not implement http.Hijacker", w.ResponseWriter)
+	}
+
+	return h.Hijack()
+}
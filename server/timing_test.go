@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseServerTiming returns the durations in milliseconds by metric name of a Server-Timing header.
+func parseServerTiming(t *testing.T, header string) map[string]float64 {
+	t.Helper()
+
+	durations := map[string]float64{}
+
+	for _, metric := range strings.Split(header, ", ") {
+		parts := strings.SplitN(metric, ";dur=", 2)
+		if len(parts) != 2 {
+			t.Fatalf("invalid Server-Timing metric %q", metric)
+		}
+
+		d, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		durations[parts[0]] = d
+	}
+
+	return durations
+}
+
+func TestWithServerTiming(t *testing.T) {
+	upstream := TimePhase("upstream")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	t.Run("enabled", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		WithServerTiming(true)(upstream).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+		durations := parseServerTiming(t, rec.Header().Get("Server-Timing"))
+		if len(durations) != 2 {
+			t.Fatalf("expected the upstream and total durations; got %v", durations)
+		}
+
+		if durations["upstream"] < 20 {
+			t.Errorf("expected an upstream duration of at least 20ms; got %vms", durations["upstream"])
+		}
+
+		if durations["total"] < durations["upstream"] {
+			t.Errorf("expected a total duration of at least the upstream duration; got %vms", durations["total"])
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		WithServerTiming(false)(upstream).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+		if v := rec.Header().Get("Server-Timing"); v != "" {
+			t.Errorf("expected no Server-Timing header; got %q", v)
+		}
+
+		if rec.Body.String() != "ok" {
+			t.Errorf("expected the response to be passed on; got %q", rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"testing"
+)
+
+func TestWithClientCertVerifier(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://cluster.local/ns/monitoring/sa/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherID, err := url.Parse("spiffe://cluster.local/ns/default/sa/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &tls.Config{}
+	ConfigureTLS(c, WithClientCertVerifier(AllowURISANs([]string{spiffeID.String()})))
+
+	for _, tc := range []struct {
+		name     string
+		raw      [][]byte
+		verified [][]*x509.Certificate
+		valid    bool
+	}{
+		{
+			name:     "allowed URI SAN",
+			verified: [][]*x509.Certificate{{{URIs: []*url.URL{otherID, spiffeID}}}},
+			valid:    true,
+		},
+		{
+			name:     "other URI SAN",
+			verified: [][]*x509.Certificate{{{URIs: []*url.URL{otherID}}}},
+			valid:    false,
+		},
+		{
+			name:     "no URI SAN",
+			verified: [][]*x509.Certificate{{{}}},
+			valid:    false,
+		},
+		{
+			name:  "no certificate",
+			valid: true,
+		},
+		{
+			name:  "unverified invalid certificate",
+			raw:   [][]byte{[]byte("invalid")},
+			valid: false,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := c.VerifyPeerCertificate(tc.raw, tc.verified)
+			if tc.valid && err != nil {
+				t.Errorf("expected the certificate to be accepted; got %v", err)
+			}
+
+			if !tc.valid && err == nil {
+				t.Error("expected the certificate to be rejected")
+			}
+		})
+	}
+}
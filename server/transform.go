@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// WithWriteTransform returns a middleware that lets the transform modify Prometheus remote-write requests,
+// e.g. to rename the value of a cluster label, before they are forwarded to the upstream.
+// It is an extension point for embedding observatorium as a library rather than a relabeling engine.
+//
+// Every write request is snappy-decompressed, decoded, transformed, encoded and compressed again,
+// which costs CPU and memory proportional to the size of the request; requests are held in memory while transformed.
+// Requests that cannot be decoded or that the transform fails are rejected with 400 Bad Request.
+func WithWriteTransform(transform func(*prompb.WriteRequest) error) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			compressed, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+
+			raw, err := snappy.Decode(nil, compressed)
+			if err != nil {
+				http.Error(w, "failed to decompress write request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var wreq prompb.WriteRequest
+			if err := wreq.Unmarshal(raw); err != nil {
+				http.Error(w, "failed to decode write request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := transform(&wreq); err != nil {
+				http.Error(w, "failed to transform write request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			raw, err = wreq.Marshal()
+			if err != nil {
+				http.Error(w, "failed to encode write request", http.StatusInternalServerError)
+				return
+			}
+
+			body := snappy.Encode(nil, raw)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestWithWriteTransform(t *testing.T) {
+	// renameCluster is a sample transform renaming the value of the cluster label.
+	renameCluster := func(wreq *prompb.WriteRequest) error {
+		for i := range wreq.Timeseries {
+			for j := range wreq.Timeseries[i].Labels {
+				if l := &wreq.Timeseries[i].Labels[j]; l.Name == "cluster" && l.Value == "old" {
+					l.Value = "new"
+				}
+			}
+		}
+
+		return nil
+	}
+
+	series := func(cluster string) prompb.WriteRequest {
+		return prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: cluster}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}}}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		transform func(*prompb.WriteRequest) error
+		body      []byte
+		code      int
+		expected  prompb.WriteRequest
+	}{
+		{
+			name:      "rename label value",
+			transform: renameCluster,
+			body:      encodeWriteRequest(t, series("old")),
+			code:      http.StatusOK,
+			expected:  series("new"),
+		},
+		{
+			name:      "other label value",
+			transform: renameCluster,
+			body:      encodeWriteRequest(t, series("other")),
+			code:      http.StatusOK,
+			expected:  series("other"),
+		},
+		{
+			name: "failing transform",
+			transform: func(*prompb.WriteRequest) error {
+				return errors.New("rejected")
+			},
+			body: encodeWriteRequest(t, series("old")),
+			code: http.StatusBadRequest,
+		},
+		{
+			name:      "invalid body",
+			transform: renameCluster,
+			body:      []byte("not snappy"),
+			code:      http.StatusBadRequest,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var received prompb.WriteRequest
+
+			h := WithWriteTransform(tc.transform)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				compressed, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if int64(len(compressed)) != r.ContentLength {
+					t.Fatalf("expected content length %d; got %d", len(compressed), r.ContentLength)
+				}
+
+				raw, err := snappy.Decode(nil, compressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := received.Unmarshal(raw); err != nil {
+					t.Fatal(err)
+				}
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/receive", bytes.NewReader(tc.body)))
+
+			if rec.Code != tc.code {
+				t.Fatalf("expected status code %d; got %d", tc.code, rec.Code)
+			}
+
+			if tc.code == http.StatusOK && !reflect.DeepEqual(received.Timeseries, tc.expected.Timeseries) {
+				t.Fatalf("expected time series %v; got %v", tc.expected.Timeseries, received.Timeseries)
+			}
+		})
+	}
+}
+
+func encodeWriteRequest(t *testing.T, wreq prompb.WriteRequest) []byte {
+	t.Helper()
+
+	raw, err := wreq.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snappy.Encode(nil, raw)
+}
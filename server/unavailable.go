@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Causes of 503 Service Unavailable responses, for which the Retry-After header can be configured separately.
+const (
+	UnavailableCauseLimit    = "limit"
+	UnavailableCauseShed     = "shed"
+	UnavailableCauseMemory   = "memory"
+	UnavailableCauseUpstream = "upstream"
+	UnavailableCauseBuffer   = "buffer"
+)
+
+type retryAfterKey struct{}
+
+type retryAfterConfig struct {
+	fallback time.Duration
+	causes   map[string]time.Duration
+}
+
+// WithRetryAfter returns a middleware that configures the Retry-After header of 503 Service Unavailable responses.
+// Responses rejected by observatorium itself carry the delay configured for their cause, or d if none is configured.
+// Other 503 responses, e.g. from upstreams, carry the delay configured for UnavailableCauseUpstream
+// unless they set a Retry-After header themselves.
+func WithRetryAfter(d time.Duration, causes map[string]time.Duration) func(http.Handler) http.Handler {
+	c := retryAfterConfig{fallback: d, causes: causes}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), retryAfterKey{}, c)
+
+			next.ServeHTTP(&remapResponseWriter{
+				ResponseWriter: w,
+				remap: func(code int) int {
+					if code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+						setRetryAfter(w, c.delay(UnavailableCauseUpstream))
+					}
+
+					return code
+				},
+			}, r.WithContext(ctx))
+		})
+	}
+}
+
+func (c retryAfterConfig) delay(cause string) time.Duration {
+	if d, ok := c.causes[cause]; ok {
+		return d
+	}
+
+	return c.fallback
+}
+
+// serviceUnavailable replies with 503 Service Unavailable, asking the client to retry after the delay configured
+// for the cause with WithRetryAfter, or the default of retryAfter.
+func serviceUnavailable(w http.ResponseWriter, r *http.Request, cause, msg string) {
+	d := retryAfter
+	if c, ok := r.Context().Value(retryAfterKey{}).(retryAfterConfig); ok {
+		d = c.delay(cause)
+	}
+
+	setRetryAfter(w, d)
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())))
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithRetryAfter(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/limit":
+			serviceUnavailable(w, r, UnavailableCauseLimit, "too many concurrent requests")
+		case "/shed":
+			serviceUnavailable(w, r, UnavailableCauseShed, "server overloaded")
+		case "/upstream":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/upstream-retry-after":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	for _, tc := range []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+		path       string
+		retryAfter string
+	}{
+		{
+			name:       "cause",
+			middleware: WithRetryAfter(10*time.Second, map[string]time.Duration{UnavailableCauseLimit: 2 * time.Second}),
+			path:       "/limit",
+			retryAfter: "2",
+		},
+		{
+			name:       "fallback",
+			middleware: WithRetryAfter(10*time.Second, map[string]time.Duration{UnavailableCauseLimit: 2 * time.Second}),
+			path:       "/shed",
+			retryAfter: "10",
+		},
+		{
+			name:       "upstream",
+			middleware: WithRetryAfter(10*time.Second, map[string]time.Duration{UnavailableCauseUpstream: time.Minute}),
+			path:       "/upstream",
+			retryAfter: "60",
+		},
+		{
+			name:       "upstream setting retry after",
+			middleware: WithRetryAfter(10*time.Second, map[string]time.Duration{UnavailableCauseUpstream: time.Minute}),
+			path:       "/upstream-retry-after",
+			retryAfter: "30",
+		},
+		{
+			name:       "not configured",
+			middleware: func(next http.Handler) http.Handler { return next },
+			path:       "/limit",
+			retryAfter: "5",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.middleware(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected status code %d; got %d", http.StatusServiceUnavailable, w.Code)
+			}
+
+			if got := w.Header().Get("Retry-After"); got != tc.retryAfter {
+				t.Errorf("expected Retry-After %q; got %q", tc.retryAfter, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upload is the body of a write request in flight, counting the bytes read from it.
+type upload struct {
+	io.ReadCloser
+	received *int64
+	total    prometheus.Counter
+}
+
+func (u upload) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.AddInt64(u.received, int64(n))
+		u.total.Add(float64(n))
+	}
+
+	return n, err
+}
+
+// WithUploadProgress returns a middleware that exposes the progress of write uploads while they are in flight:
+// the bytes received from request bodies as they are read, the number of uploads in progress and the bytes
+// received so far by the largest of them. Given the limit enforced by WithMaxBodySize, which is exposed as well
+// unless it is 0, alerts can fire as uploads approach the limit before they are rejected.
+// It must wrap WithMaxBodySize to count the bytes actually received from clients.
+func WithUploadProgress(reg prometheus.Registerer, limit int64) func(http.Handler) http.Handler {
+	var (
+		mu      sync.Mutex
+		uploads = map[*int64]struct{}{}
+	)
+
+	received := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_write_upload_received_bytes_total",
+		Help: "Counter of bytes received from the bodies of write requests, counted as they are read.",
+	})
+	inProgress := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_write_uploads_in_progress",
+		Help: "Number of write requests whose body is being received.",
+	})
+	largest := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "http_write_upload_largest_in_progress_bytes",
+		Help: "Bytes received so far by the largest write request in progress.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var max int64
+
+		for n := range uploads {
+			if v := atomic.LoadInt64(n); v > max {
+				max = v
+			}
+		}
+
+		return float64(max)
+	})
+
+	if reg != nil {
+		reg.MustRegister(received, inProgress, largest)
+
+		if limit > 0 {
+			maxBody := prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "http_write_max_body_bytes",
+				Help: "The maximum size in bytes of the bodies of write requests.",
+			})
+			maxBody.Set(float64(limit))
+			reg.MustRegister(maxBody)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			n := new(int64)
+
+			mu.Lock()
+			uploads[n] = struct{}{}
+			mu.Unlock()
+			inProgress.Inc()
+
+			defer func() {
+				mu.Lock()
+				delete(uploads, n)
+				mu.Unlock()
+				inProgress.Dec()
+			}()
+
+			r.Body = upload{ReadCloser: r.Body, received: n, total: received}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithUploadProgress(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	var (
+		read    = make(chan struct{})
+		release = make(chan struct{})
+		done    = make(chan struct{})
+	)
+
+	h := WithUploadProgress(reg, 100)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadFull(r.Body, make([]byte, 10)); err != nil {
+			t.Error(err)
+		}
+
+		close(read)
+		<-release
+
+		_, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/receive", strings.NewReader(strings.Repeat("a", 40))))
+	}()
+
+	names := []string{
+		"http_write_upload_received_bytes_total",
+		"http_write_uploads_in_progress",
+		"http_write_upload_largest_in_progress_bytes",
+		"http_write_max_body_bytes",
+	}
+
+	<-read
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_write_max_body_bytes The maximum size in bytes of the bodies of write requests.
+# TYPE http_write_max_body_bytes gauge
+http_write_max_body_bytes 100
+# HELP http_write_upload_largest_in_progress_bytes Bytes received so far by the largest write request in progress.
+# TYPE http_write_upload_largest_in_progress_bytes gauge
+http_write_upload_largest_in_progress_bytes 10
+# HELP http_write_upload_received_bytes_total Counter of bytes received from the bodies of write requests, counted as they are read.
+# TYPE http_write_upload_received_bytes_total counter
+http_write_upload_received_bytes_total 10
+# HELP http_write_uploads_in_progress Number of write requests whose body is being received.
+# TYPE http_write_uploads_in_progress gauge
+http_write_uploads_in_progress 1
+`), names...); err != nil {
+		t.Errorf("while uploading: %v", err)
+	}
+
+	close(release)
+	<-done
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_write_max_body_bytes The maximum size in bytes of the bodies of write requests.
+# TYPE http_write_max_body_bytes gauge
+http_write_max_body_bytes 100
+# HELP http_write_upload_largest_in_progress_bytes Bytes received so far by the largest write request in progress.
+# TYPE http_write_upload_largest_in_progress_bytes gauge
+http_write_upload_largest_in_progress_bytes 0
+# HELP http_write_upload_received_bytes_total Counter of bytes received from the bodies of write requests, counted as they are read.
+# TYPE http_write_upload_received_bytes_total counter
+http_write_upload_received_bytes_total 40
+# HELP http_write_uploads_in_progress Number of write requests whose body is being received.
+# TYPE http_write_uploads_in_progress gauge
+http_write_uploads_in_progress 0
+`), names...); err != nil {
+		t.Errorf("after the upload: %v", err)
+	}
+}
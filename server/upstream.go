@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// CheckUpstreams checks that a TCP connection can be established to each of the given upstreams
+// within the timeout and returns an error for the first upstream that is unreachable.
+// Nil upstreams are skipped.
+func CheckUpstreams(timeout time.Duration, upstreams ...*url.URL) error {
+	for _, u := range upstreams {
+		if u == nil {
+			continue
+		}
+
+		address := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+
+			address = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return fmt.Errorf("upstream %s://%s is unreachable: %w", u.Scheme, u.Host, err)
+		}
+
+		_ = conn.Close()
+	}
+
+	return nil
+}
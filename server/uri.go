@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithMaxURILength returns a middleware that rejects requests whose request URI, i.e. path and query string,
+// is longer than max bytes with 414 URI Too Long, e.g. machine-generated queries that would break intermediaries,
+// instead of passing them on to the upstream.
+func WithMaxURILength(reg prometheus.Registerer, max int) func(http.Handler) http.Handler {
+	rejected := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_uri_too_long_requests_total",
+		Help: "Counter of HTTP requests rejected because their request URI exceeded the maximum length.",
+	})
+
+	if reg != nil {
+		reg.MustRegister(rejected)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.RequestURI) > max {
+				rejected.Inc()
+				http.Error(w, "request URI too long", http.StatusRequestURITooLong)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
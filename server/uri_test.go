@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMaxURILength(t *testing.T) {
+	const max = 32
+
+	reg := prometheus.NewRegistry()
+	h := WithMaxURILength(reg, max)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name string
+		uri  string
+		code int
+	}{
+		{
+			name: "within limit",
+			uri:  "/api/v1/query?query=" + strings.Repeat("a", max-len("/api/v1/query?query=")),
+			code: http.StatusOK,
+		},
+		{
+			name: "path exceeding limit",
+			uri:  "/" + strings.Repeat("a", max),
+			code: http.StatusRequestURITooLong,
+		},
+		{
+			name: "query exceeding limit",
+			uri:  "/api/v1/query?query=" + strings.Repeat("a", max),
+			code: http.StatusRequestURITooLong,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rec.Code)
+			}
+		})
+	}
+
+	expected := `
+# HELP http_uri_too_long_requests_total Counter of HTTP requests rejected because their request URI exceeded the maximum length.
+# TYPE http_uri_too_long_requests_total counter
+http_uri_too_long_requests_total 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_uri_too_long_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,6 +3,7 @@ package tls
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -24,9 +25,9 @@ func NewServerConfig(logger log.Logger, certFile, keyFile, minVersion string, ci
 		return nil, fmt.Errorf("server credentials: %w", err)
 	}
 
-	version, err := flag.TLSVersion(minVersion)
+	version, err := flag.TLSVersion(normalizeVersion(minVersion))
 	if err != nil {
-		return nil, fmt.Errorf("TLS version invalid: %w", err)
+		return nil, fmt.Errorf("TLS version invalid, must be one of %s: %w", strings.Join(flag.TLSPossibleVersions(), ", "), err)
 	}
 
 	cipherSuiteIDs, err := flag.TLSCipherSuites(cipherSuites)
@@ -46,3 +47,22 @@ func NewServerConfig(logger log.Logger, certFile, keyFile, minVersion string, ci
 
 	return tlsCfg, nil
 }
+
+// normalizeVersion maps short TLS version names like "TLS1.2" or "1.2"
+// to the Go constant names like "VersionTLS12" that are expected by flag.TLSVersion.
+func normalizeVersion(v string) string {
+	short := strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(v), "TLS"), "V")
+
+	switch short {
+	case "1.0", "10":
+		return "VersionTLS10"
+	case "1.1", "11":
+		return "VersionTLS11"
+	case "1.2", "12":
+		return "VersionTLS12"
+	case "1.3", "13":
+		return "VersionTLS13"
+	default:
+		return v
+	}
+}